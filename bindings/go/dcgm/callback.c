@@ -1,4 +1,12 @@
+#include "dcgm_agent.h"
+#include "dcgm_structs.h"
+
 int violationNotify(void* p) {
     int ViolationRegistration(void*);
     return ViolationRegistration(p);
 }
+
+int valuesSinceNotify(dcgm_field_entity_group_t entityGroupId, dcgm_field_eid_t entityId, dcgmFieldValue_v1 *values, int numValues, void *userData) {
+    int ValuesSinceRegistration(dcgm_field_entity_group_t, dcgm_field_eid_t, dcgmFieldValue_v1*, int, void*);
+    return ValuesSinceRegistration(entityGroupId, entityId, values, numValues, userData);
+}
@@ -3,10 +3,14 @@ package dcgm
 /*
 #include "./dcgm_agent.h"
 #include "./dcgm_structs.h"
+
+// wrapper for go callback function
+extern int valuesSinceNotify(dcgm_field_entity_group_t entityGroupId, dcgm_field_eid_t entityId, dcgmFieldValue_v1 *values, int numValues, void *userData);
 */
 import "C"
 import (
 	"fmt"
+	"sync"
 	"unicode"
 	"unsafe"
 )
@@ -74,7 +78,23 @@ func WatchFields(gpuId uint, fieldsGroup FieldHandle, groupName string) (groupId
 	return group, nil
 }
 
+// UnwatchFields stops watching the fields of the field group on the group
+func UnwatchFields(fieldsGroup FieldHandle, group GroupHandle) error {
+	result := C.dcgmUnwatchFields(handle.handle, group.handle, fieldsGroup.handle)
+	if err := errorString(result); err != nil {
+		return fmt.Errorf("Error unwatching fields: %s", err)
+	}
+
+	return nil
+}
+
 func WatchFieldsWithGroup(fieldsGroup FieldHandle, group GroupHandle) error {
+	return WatchFieldsWithGroupEx(fieldsGroup, group, updateFreq, maxKeepAge, maxKeepSamples)
+}
+
+// WatchFieldsWithGroupEx watches the fields with an explicit update frequency (in usec),
+// maximum age (in sec) and maximum number of samples (0 = no limit) kept by DCGM.
+func WatchFieldsWithGroupEx(fieldsGroup FieldHandle, group GroupHandle, updateFreq int64, maxKeepAge float64, maxKeepSamples int32) error {
 	result := C.dcgmWatchFields(handle.handle, group.handle, fieldsGroup.handle,
 		C.longlong(updateFreq), C.double(maxKeepAge), C.int(maxKeepSamples))
 
@@ -162,13 +182,62 @@ func (fv FieldValue_v1) Float64() float64 {
 }
 
 func (fv FieldValue_v1) String() string {
-	return *(*string)(unsafe.Pointer(&fv.Value[0]))
+	return C.GoString((*C.char)(unsafe.Pointer(&fv.Value[0])))
 }
 
 func (fv FieldValue_v1) Blob() [4096]byte {
 	return fv.Value
 }
 
+// values received by ValuesSinceRegistration, calls to GetValuesSince are serialized
+var valuesSince struct {
+	sync.Mutex
+	values []FieldValue_v2
+}
+
+// GetValuesSince returns the values of the watched fields of a group that were updated since
+// the given timestamp (in usec since 1970, 0 returns all the values kept by DCGM) and the
+// timestamp to use for the next call.
+func GetValuesSince(group GroupHandle, fieldsGroup FieldHandle, since int64) ([]FieldValue_v2, int64, error) {
+	valuesSince.Lock()
+	defer valuesSince.Unlock()
+
+	var next C.longlong
+	valuesSince.values = nil
+
+	result := C.dcgmGetValuesSince_v2(handle.handle, group.handle, fieldsGroup.handle, C.longlong(since), &next,
+		C.dcgmFieldValueEntityEnumeration_f(C.valuesSinceNotify), nil)
+	values := valuesSince.values
+	valuesSince.values = nil
+
+	if err := errorString(result); err != nil {
+		return nil, since, fmt.Errorf("Error getting the values since %d: %s", since, err)
+	}
+
+	return values, int64(next), nil
+}
+
+// ValuesSinceRegistration is a go callback function for dcgmGetValuesSince_v2() wrapped in C.valuesSinceNotify()
+//export ValuesSinceRegistration
+func ValuesSinceRegistration(entityGroupId C.dcgm_field_entity_group_t, entityId C.dcgm_field_eid_t, values *C.dcgmFieldValue_v1, numValues C.int, userData unsafe.Pointer) C.int {
+	cvalues := (*[1 << 20]C.dcgmFieldValue_v1)(unsafe.Pointer(values))[:numValues:numValues]
+
+	for _, v := range toFieldValue(cvalues) {
+		valuesSince.values = append(valuesSince.values, FieldValue_v2{
+			Version:       v.Version,
+			EntityGroupId: Field_Entity_Group(entityGroupId),
+			EntityId:      uint(entityId),
+			FieldId:       v.FieldId,
+			FieldType:     v.FieldType,
+			Status:        v.Status,
+			Ts:            v.Ts,
+			Value:         v.Value,
+		})
+	}
+
+	return 0
+}
+
 func toFieldValue_v2(cfields []C.dcgmFieldValue_v2) []FieldValue_v2 {
 	fields := make([]FieldValue_v2, len(cfields))
 	for i, f := range cfields {
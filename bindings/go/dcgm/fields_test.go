@@ -0,0 +1,12 @@
+package dcgm
+
+import "testing"
+
+func TestFieldValueString(t *testing.T) {
+	var fv FieldValue_v1
+	copy(fv.Value[:], "460.32\x00stale bytes of a longer value")
+
+	if s := fv.String(); s != "460.32" {
+		t.Errorf("Field value string is wrong, got %q, want: %q", s, "460.32")
+	}
+}
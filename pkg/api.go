@@ -0,0 +1,206 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const jsonContentType = "application/json; charset=utf-8"
+
+// APIMetrics serves the latest collection as JSON, the same collection as
+// /metrics. The entities can be filtered with the "gpu", "uuid", "namespace"
+// and "field" query parameters, a parameter can be repeated to match any of
+// its values.
+func (s *MetricsServer) APIMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics, err := s.collectMetrics()
+	if err != nil {
+		logrus.Errorf("Failed to collect metrics with error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, APIError{Error: "Failed to collect metrics"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, APIMetricsResponse{Entities: EncodeAPIEntities(metrics, r.URL.Query())})
+}
+
+// ReloadCounters reloads the counters file, as when the file changes. The
+// current counters are kept if the file is invalid, the error is returned.
+func (s *MetricsServer) ReloadCounters(w http.ResponseWriter, r *http.Request) {
+	if s.reloadCounters == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := s.reloadCounters(); err != nil {
+		logrus.Errorf("Failed to reload the counters, keeping the current ones: %v", err)
+		writeJSON(w, http.StatusInternalServerError, APIError{Error: err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(status)
+
+	// The status is already sent, failures are most likely a client that went away
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Errorf("Failed to write JSON response with error: %v", err)
+	}
+}
+
+// EncodeAPIEntities groups the metrics by entity, the GPU or GPU instance and
+// the pod it's attributed to, in the order of the collection. Entities
+// without any field left after the filtering are omitted.
+func EncodeAPIEntities(metrics [][]Metric, filters url.Values) []APIEntity {
+	entities := []APIEntity{}
+	index := map[string]int{}
+
+	for _, device := range metrics {
+		for _, m := range device {
+			if !matchesAPIFilters(m, filters) {
+				continue
+			}
+
+			key := apiEntityKey(m)
+			i, ok := index[key]
+			if !ok {
+				attributes := m.Attributes
+				if attributes == nil {
+					attributes = map[string]string{}
+				}
+
+				i = len(entities)
+				index[key] = i
+				entities = append(entities, APIEntity{
+					GPU:           m.GPU,
+					UUID:          m.GPUUUID,
+					Device:        m.GPUDevice,
+					ModelName:     m.GPUModelName,
+					MigProfile:    m.MigProfile,
+					GPUInstanceID: m.GPUInstanceID,
+					Hostname:      m.Hostname,
+					Attributes:    attributes,
+					Fields:        []APIField{},
+				})
+			}
+
+			entities[i].Fields = append(entities[i].Fields, apiField(m))
+		}
+	}
+
+	return entities
+}
+
+func matchesAPIFilters(m Metric, filters url.Values) bool {
+	matches := func(name string, values ...string) bool {
+		wanted, ok := filters[name]
+		if !ok {
+			return true
+		}
+
+		for _, w := range wanted {
+			for _, v := range values {
+				if v != "" && v == w {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+
+	return matches("gpu", m.GPU) &&
+		matches("uuid", m.GPUUUID) &&
+		matches("namespace", m.Attributes[namespaceAttribute], m.Attributes[oldNamespaceAttribute]) &&
+		matches("field", m.Counter.FieldName)
+}
+
+func apiEntityKey(m Metric) string {
+	parts := []string{m.GPU, m.GPUUUID, m.GPUDevice, m.GPUModelName, m.MigProfile, m.GPUInstanceID, m.Hostname}
+
+	keys := make([]string, 0, len(m.Attributes))
+	for k := range m.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		parts = append(parts, k, m.Attributes[k])
+	}
+
+	return strings.Join(parts, "\x00")
+}
+
+func apiField(m Metric) APIField {
+	f := APIField{
+		Name:  m.Counter.FieldName,
+		Type:  m.Counter.PromType,
+		Unit:  m.Counter.Unit,
+		Help:  m.Counter.Help,
+		Value: apiValue(m),
+	}
+
+	if !m.Timestamp.IsZero() {
+		ts := m.Timestamp
+		f.Timestamp = &ts
+	}
+
+	if d := m.Distribution; d != nil {
+		f.Distribution = &APIDistribution{Count: d.Count, Sum: apiFloat(d.Sum)}
+		for _, b := range d.Buckets {
+			f.Distribution.Buckets = append(f.Distribution.Buckets, APIBucket{UpperBound: b.UpperBound, Count: b.Count})
+		}
+		for _, q := range d.Quantiles {
+			f.Distribution.Quantiles = append(f.Distribution.Quantiles, APIQuantile{Quantile: q.Quantile, Value: apiFloat(q.Value)})
+		}
+	}
+
+	return f
+}
+
+// Numerical values are JSON numbers, info metrics and other values are
+// strings. JSON doesn't have NaN and infinite numbers, they are strings too.
+func apiValue(m Metric) interface{} {
+	if m.Counter.PromType == "info" {
+		return m.Value
+	}
+
+	v, err := strconv.ParseFloat(m.Value, 64)
+	if err != nil {
+		return m.Value
+	}
+
+	return apiFloat(v)
+}
+
+func apiFloat(v float64) interface{} {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return formatFloat(v)
+	}
+
+	return v
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIMetrics(t *testing.T) {
+	metrics := sampleMetrics()
+	ts := time.Unix(1600000000, 0).UTC()
+	for i := range metrics[0] {
+		metrics[0][i].Hostname = "node"
+		metrics[0][i].Timestamp = ts
+		metrics[0][i].Attributes = map[string]string{podAttribute: "pod", namespaceAttribute: "ns"}
+	}
+
+	s, cleanup, err := NewMetricsServer(&Config{}, make(chan [][]Metric), nil)
+	require.NoError(t, err)
+	defer cleanup()
+	s.updateMetrics(metrics)
+
+	r := httptest.NewRequest("GET", "/api/v1/metrics", nil)
+	w := httptest.NewRecorder()
+	s.APIMetrics(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, jsonContentType, w.Header().Get("Content-Type"))
+
+	var resp struct {
+		Entities []map[string]interface{}
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Entities, 1)
+
+	entity := resp.Entities[0]
+	require.Equal(t, "0", entity["gpu"])
+	require.Equal(t, "GPU-0000", entity["uuid"])
+	require.Equal(t, "node", entity["hostname"])
+	require.Equal(t, map[string]interface{}{"pod": "pod", "namespace": "ns"}, entity["attributes"])
+	require.NotContains(t, entity, "migProfile")
+
+	fields := entity["fields"].([]interface{})
+	require.Len(t, fields, 3)
+	require.Equal(t, map[string]interface{}{
+		"name":      "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION",
+		"type":      "counter",
+		"unit":      "millijoules",
+		"help":      "Energy help info",
+		"value":     float64(1000),
+		"timestamp": "2020-09-13T12:26:40Z",
+	}, fields[0])
+	require.Equal(t, "460.32", fields[2].(map[string]interface{})["value"])
+}
+
+func TestEncodeAPIEntitiesFilters(t *testing.T) {
+	var metrics [][]Metric
+	for gpu := 0; gpu < 3; gpu++ {
+		device := sampleMetrics()[0]
+		for i := range device {
+			device[i].GPU = fmt.Sprint(gpu)
+			device[i].GPUUUID = fmt.Sprintf("GPU-%d", gpu)
+			device[i].Attributes = map[string]string{namespaceAttribute: fmt.Sprintf("ns%d", gpu%2)}
+		}
+		metrics = append(metrics, device)
+	}
+
+	tests := []struct {
+		query    string
+		gpus     []string
+		nbFields int
+	}{
+		{"", []string{"0", "1", "2"}, 9},
+		{"gpu=1", []string{"1"}, 3},
+		{"gpu=0&gpu=2", []string{"0", "2"}, 6},
+		{"uuid=GPU-2", []string{"2"}, 3},
+		{"namespace=ns0", []string{"0", "2"}, 6},
+		{"namespace=ns0&gpu=1", nil, 0},
+		{"field=DCGM_FI_DRIVER_VERSION&field=DCGM_FI_DEV_POWER_USAGE_watts&gpu=1", []string{"1"}, 2},
+		{"field=DCGM_FI_DEV_GPU_TEMP", nil, 0},
+	}
+
+	for _, tc := range tests {
+		filters, err := url.ParseQuery(tc.query)
+		require.NoError(t, err)
+
+		var gpus []string
+		nbFields := 0
+		for _, e := range EncodeAPIEntities(metrics, filters) {
+			gpus = append(gpus, e.GPU)
+			nbFields += len(e.Fields)
+		}
+
+		require.Equal(t, tc.gpus, gpus, tc.query)
+		require.Equal(t, tc.nbFields, nbFields, tc.query)
+	}
+}
+
+func TestAPIMetricsCollectionError(t *testing.T) {
+	cache := NewMetricsCache(func() ([][]Metric, error) { return nil, fmt.Errorf("DCGM error") }, time.Second)
+	s, cleanup, err := NewMetricsServer(&Config{}, make(chan [][]Metric), cache)
+	require.NoError(t, err)
+	defer cleanup()
+
+	w := httptest.NewRecorder()
+	s.APIMetrics(w, httptest.NewRequest("GET", "/api/v1/metrics", nil))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.JSONEq(t, `{"error": "Failed to collect metrics"}`, w.Body.String())
+}
+
+func TestReloadCountersAPI(t *testing.T) {
+	s, cleanup, err := NewMetricsServer(&Config{}, make(chan [][]Metric), nil)
+	require.NoError(t, err)
+	defer cleanup()
+
+	reload := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/counters/reload", nil))
+		return w
+	}
+
+	require.Equal(t, http.StatusNotFound, reload().Code)
+
+	var reloadErr error
+	s.reloadCounters = func() error { return reloadErr }
+	require.Equal(t, http.StatusNoContent, reload().Code)
+
+	reloadErr = fmt.Errorf("Invalid counters file")
+	w := reload()
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.JSONEq(t, `{"error": "Invalid counters file"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/counters/reload", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// In the scrape collect mode, metrics are collected when they are requested.
+// Results are reused for at least minInterval and concurrent requests wait
+// for the collection in progress instead of querying DCGM again.
+func NewMetricsCache(collect func() ([][]Metric, error), minInterval time.Duration) *MetricsCache {
+	return &MetricsCache{
+		collect:     collect,
+		minInterval: minInterval,
+		now:         time.Now,
+	}
+}
+
+func (c *MetricsCache) Get() ([][]Metric, error) {
+	c.Lock()
+
+	if c.metrics != nil && c.now().Sub(c.collectedAt) < c.minInterval {
+		defer c.Unlock()
+		return c.metrics, nil
+	}
+
+	if call := c.inflight; call != nil {
+		c.Unlock()
+		<-call.done
+		return call.metrics, call.err
+	}
+
+	call := &collectCall{done: make(chan struct{})}
+	c.inflight = call
+	c.Unlock()
+
+	call.metrics, call.err = c.collect()
+
+	c.Lock()
+	// Failures aren't cached, the next request tries again
+	if call.err == nil {
+		c.metrics = call.metrics
+		c.collectedAt = c.now()
+	}
+	c.inflight = nil
+	c.Unlock()
+
+	close(call.done)
+
+	return call.metrics, call.err
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsCacheCoalescing(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+
+	cache := NewMetricsCache(func() ([][]Metric, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return sampleMetrics(), nil
+	}, time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			metrics, err := cache.Get()
+			require.NoError(t, err)
+			require.Len(t, metrics, 1)
+		}()
+	}
+
+	// Let every request reach the cache before the collection completes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestMetricsCacheMinInterval(t *testing.T) {
+	var calls int
+	var fail bool
+	now := time.Unix(1600000000, 0)
+
+	cache := NewMetricsCache(func() ([][]Metric, error) {
+		calls++
+		if fail {
+			return nil, fmt.Errorf("DCGM is unavailable")
+		}
+		return sampleMetrics(), nil
+	}, 5*time.Second)
+	cache.now = func() time.Time { return now }
+
+	_, err := cache.Get()
+	require.NoError(t, err)
+
+	now = now.Add(4 * time.Second)
+	_, err = cache.Get()
+	require.NoError(t, err)
+	require.Equal(t, 1, calls)
+
+	now = now.Add(time.Second)
+	_, err = cache.Get()
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+
+	// Failures are not cached
+	fail = true
+	now = now.Add(5 * time.Second)
+	_, err = cache.Get()
+	require.Error(t, err)
+	_, err = cache.Get()
+	require.Error(t, err)
+	require.Equal(t, 4, calls)
+}
+
+func TestMetricsScrapeCollectMode(t *testing.T) {
+	fail := false
+	cache := NewMetricsCache(func() ([][]Metric, error) {
+		if fail {
+			return nil, fmt.Errorf("DCGM is unavailable")
+		}
+		return sampleMetrics(), nil
+	}, 0)
+
+	s, cleanup, err := NewMetricsServer(&Config{}, nil, cache)
+	require.NoError(t, err)
+	defer cleanup()
+
+	w := httptest.NewRecorder()
+	s.Metrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION{gpu=\"0\"")
+
+	fail = true
+	w = httptest.NewRecorder()
+	s.Metrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+
+	w = httptest.NewRecorder()
+	s.Health(w, httptest.NewRequest("GET", "/health", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// Flags that can't be set in the config file
+var cliOnlyFlags = map[string]bool{
+	CLIConfigFile: true,
+	"help":        true,
+	"version":     true,
+}
+
+// LoadConfig builds the configuration from the CLI flags, the environment
+// variables and the config file. The flags that are set on the command line or
+// in the environment take precedence over the config file.
+func LoadConfig(c *cli.Context) (*Config, error) {
+	filename := c.String(CLIConfigFile)
+	if filename == "" {
+		return contextToConfig(c)
+	}
+
+	values, err := LoadConfigFile(filename, c.App.Flags)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := contextToConfig(&fileConfigSource{ctx: c, values: values})
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %v", filename, err)
+	}
+	config.ConfigFile = filename
+
+	return config, nil
+}
+
+// LoadConfigFile reads a YAML map of flag names to values, e.g:
+// "collect-interval: 10000". Unknown flags and values of the wrong type are
+// errors.
+func LoadConfigFile(filename string, flags []cli.Flag) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]interface{}
+	if err := yaml.UnmarshalStrict(content, &values); err != nil {
+		return nil, fmt.Errorf("Failed to parse config file %s: %v", filename, err)
+	}
+
+	known := make(map[string]cli.Flag, len(flags))
+	for _, f := range flags {
+		if name := f.Names()[0]; !cliOnlyFlags[name] {
+			known[name] = f
+		}
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		v := values[name]
+
+		var ok bool
+		var expected string
+		switch known[name].(type) {
+		case *cli.StringFlag:
+			_, ok = v.(string)
+			expected = "a string"
+		case *cli.IntFlag:
+			_, ok = v.(int)
+			expected = "an integer"
+		case *cli.BoolFlag:
+			_, ok = v.(bool)
+			expected = "a boolean"
+		default:
+			return nil, fmt.Errorf("Unknown setting '%s' in config file %s", name, filename)
+		}
+
+		if !ok {
+			return nil, fmt.Errorf("Invalid value '%v' of setting '%s' in config file %s, expected %s", v, name, filename, expected)
+		}
+	}
+
+	return values, nil
+}
+
+// The settings are read from the CLI context, or from the config file when
+// they aren't set on the command line or in the environment.
+type configSource interface {
+	String(name string) string
+	Int(name string) int
+	Bool(name string) bool
+	IsSet(name string) bool
+}
+
+type fileConfigSource struct {
+	ctx    *cli.Context
+	values map[string]interface{} // Validated by LoadConfigFile
+}
+
+func (s *fileConfigSource) lookup(name string) (interface{}, bool) {
+	if s.ctx.IsSet(name) {
+		return nil, false
+	}
+
+	v, ok := s.values[name]
+	return v, ok
+}
+
+func (s *fileConfigSource) String(name string) string {
+	if v, ok := s.lookup(name); ok {
+		return v.(string)
+	}
+
+	return s.ctx.String(name)
+}
+
+func (s *fileConfigSource) Int(name string) int {
+	if v, ok := s.lookup(name); ok {
+		return v.(int)
+	}
+
+	return s.ctx.Int(name)
+}
+
+func (s *fileConfigSource) Bool(name string) bool {
+	if v, ok := s.lookup(name); ok {
+		return v.(bool)
+	}
+
+	return s.ctx.Bool(name)
+}
+
+func (s *fileConfigSource) IsSet(name string) bool {
+	_, ok := s.values[name]
+	return ok || s.ctx.IsSet(name)
+}
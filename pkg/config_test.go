@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func testLoadConfig(t *testing.T, args ...string) (*Config, error) {
+	var config *Config
+	var err error
+
+	app := NewApp()
+	app.Action = func(c *cli.Context) error {
+		config, err = LoadConfig(c)
+		return nil
+	}
+	require.NoError(t, app.Run(append([]string{"dcgm-exporter"}, args...)))
+
+	return config, err
+}
+
+func TestLoadConfig(t *testing.T) {
+	filename := writeTestFile(t, `
+collectors: /etc/dcgm-exporter/dcp-metrics-included.csv
+collect-interval: 10000
+kubernetes: true
+devices: g:0,1
+remote-hostengine-info: dcgm:5555
+kubernetes-node-name: gpu-node
+kubernetes-pod-labels: "team, app.kubernetes.io/name,"
+enable-counters-reload: true
+`)
+
+	config, err := testLoadConfig(t, "--config", filename, "-c", "5000")
+	require.NoError(t, err)
+
+	require.Equal(t, filename, config.ConfigFile)
+	require.Equal(t, "/etc/dcgm-exporter/dcp-metrics-included.csv", config.CollectorsFile)
+	require.Equal(t, 5000, config.CollectInterval) // The command line takes precedence
+	require.True(t, config.Kubernetes)
+	require.Equal(t, []int{0, 1}, config.Devices.GpuRange)
+	require.True(t, config.UseRemoteHE)
+	require.Equal(t, "dcgm:5555", config.RemoteHEInfo)
+	require.Equal(t, ":9400", config.Address) // Default value
+	require.Equal(t, "gpu-node", config.KubernetesNodeName)
+	require.Equal(t, testGPUResources, config.KubernetesGPUResources) // Default value
+	require.Equal(t, []string{"team", "app.kubernetes.io/name"}, config.KubernetesPodLabels)
+	require.True(t, config.EnableCountersReload)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []string{
+		"unknown: true\n",
+		"config: other.yaml\n",
+		"collect-interval: fast\n",
+		"kubernetes: 1\n",
+		"address: 9400\n",
+		"collect-interval: 1000\ncollect-interval: 2000\n",
+		"collect-mode: sometimes\n",
+		"devices: x\n",
+		"- address\n",
+		"kubernetes-pod-labels: team\nkubernetes-node-name: gpu-node\n",
+		"kubernetes: true\nkubernetes-pod-owners: true\n",
+		"kubernetes-shared-gpus: split\n",
+		"kubernetes-gpu-resources: nvidia.com/gpu\n",
+		"kubernetes-gpu-resources: nvidia.com/gpu=uuid\n",
+		"kubernetes-gpu-resources: nvidia.com/[gpu=gpu-uuid\n",
+		"kubernetes-gpu-resources: =gpu-uuid\n",
+		"kubernetes-gpu-resources: \",\"\n",
+		"container-runtime-socket: /var/run/docker.sock\n",
+		"containers: true\ncontainer-labels: app\n",
+		"containers: true\nkubernetes: true\nuse-old-namespace: true\n",
+	}
+
+	for _, content := range tests {
+		_, err := testLoadConfig(t, "--config", writeTestFile(t, content))
+		require.Error(t, err, content)
+	}
+
+	_, err := testLoadConfig(t, "--config", "/does/not/exist.yaml")
+	require.Error(t, err)
+}
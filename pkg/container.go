@@ -0,0 +1,318 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	containerIDAttribute    = "container_id"
+	containerNameAttribute  = "container_name"
+	containerImageAttribute = "container_image"
+
+	containerLabelPrefix = "container_label_"
+)
+
+var (
+	// The IDs of the containers in their cgroup, e.g: "/docker/<id>" with
+	// cgroup v1, "/system.slice/docker-<id>.scope" or
+	// "/system.slice/containerd.service/<namespace>-<id>.scope" with cgroup v2
+	containerCgroup = regexp.MustCompile(`[0-9a-f]{64}`)
+
+	containerRuntimeTimeout = 5 * time.Second
+)
+
+// NewContainerMapper maps the GPUs to the containers of the processes running
+// on them, every ContainerRefreshInterval in the background. The processes are
+// listed with NVML and the containers looked up from the ContainerRuntimeSocket
+// if any.
+func NewContainerMapper(c *Config) (*ContainerMapper, func(), error) {
+	logrus.Infof("Container mapping enabled!")
+
+	if err := nvml.Init(); err != nil {
+		return nil, func() {}, fmt.Errorf("Failed to initialize NVML to list the processes of the GPUs: %v", err)
+	}
+
+	var runtime ContainerRuntime
+	if c.ContainerRuntimeSocket != "" {
+		runtime = NewDockerRuntime(c.ContainerRuntimeSocket)
+	}
+
+	m, cleanup, err := newContainerMapper(c, listGPUProcesses, runtime)
+	if err != nil {
+		nvml.Shutdown()
+		return nil, func() {}, err
+	}
+
+	return m, func() {
+		cleanup()
+		nvml.Shutdown()
+	}, nil
+}
+
+func newContainerMapper(c *Config, processes func() (map[string][]uint, error), runtime ContainerRuntime) (*ContainerMapper, func(), error) {
+	if c.ContainerRefreshInterval <= 0 {
+		return nil, func() {}, fmt.Errorf("The container refresh interval must be positive, got %d", c.ContainerRefreshInterval)
+	}
+
+	m := &ContainerMapper{
+		Config:    c,
+		processes: processes,
+		runtime:   runtime,
+		labels:    attributeNames(containerLabelPrefix, c.ContainerLabels),
+
+		containers:     map[string]ContainerInfo{},
+		failed:         map[string]bool{},
+		gpuToContainer: map[string][]ContainerInfo{},
+	}
+
+	return m, RefreshEvery(time.Duration(c.ContainerRefreshInterval)*time.Millisecond, m.Refresh), nil
+}
+
+func (m *ContainerMapper) Name() string {
+	return "containerMapper"
+}
+
+// Refresh finds the containers of the processes running on the GPUs and
+// replaces the mapping. The last mapping is kept if the processes can't be
+// listed.
+func (m *ContainerMapper) Refresh() {
+	processes, err := m.processes()
+	if err != nil {
+		logrus.Warningf("Failed to list the processes running on the GPUs: %v", err)
+		return
+	}
+
+	m.Lock()
+	known, knownFailed := m.containers, m.failed
+	m.Unlock()
+
+	// The containers found in this refresh, the ones looked up from the runtime
+	// for the next ones, and the ones it didn't know
+	found := map[string]ContainerInfo{}
+	containers := map[string]ContainerInfo{}
+	failed := map[string]bool{}
+	gpuToContainer := map[string][]ContainerInfo{}
+	for gpu, pids := range processes {
+		seen := map[string]bool{}
+		for _, pid := range pids {
+			id := processContainerID(pid)
+			if id == "" || seen[id] {
+				continue
+			}
+			seen[id] = true
+
+			container, ok := found[id]
+			if !ok {
+				container, ok = known[id]
+				if !ok {
+					container, ok = m.lookup(id, knownFailed[id])
+				}
+				if ok {
+					containers[id] = container
+				} else {
+					failed[id] = true
+				}
+				found[id] = container
+			}
+			gpuToContainer[gpu] = append(gpuToContainer[gpu], container)
+		}
+	}
+
+	for _, containers := range gpuToContainer {
+		sort.Slice(containers, func(a, b int) bool {
+			if containers[a].Name != containers[b].Name {
+				return containers[a].Name < containers[b].Name
+			}
+			return containers[a].ID < containers[b].ID
+		})
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	// The containers that stopped are forgotten
+	m.containers = containers
+	m.failed = failed
+	m.gpuToContainer = gpuToContainer
+}
+
+// lookup looks up a container from the runtime, it only has its ID if it
+// can't be looked up and isn't kept for the next refreshes. The failure is
+// only logged as a warning the first time.
+func (m *ContainerMapper) lookup(id string, failed bool) (ContainerInfo, bool) {
+	if m.runtime == nil {
+		return ContainerInfo{ID: id}, true
+	}
+
+	container, err := m.runtime.Inspect(id)
+	if err != nil {
+		log := logrus.Warningf
+		if failed {
+			log = logrus.Debugf
+		}
+		log("Failed to look up the container %s from the runtime: %v", id, err)
+		return ContainerInfo{ID: id}, false
+	}
+
+	return container, true
+}
+
+// Process adds the container attributes, the containers sharing a GPU are
+// joined in the order of their names. The GPU instances get the containers of
+// their GPU.
+func (m *ContainerMapper) Process(metrics [][]Metric, sysInfo SystemInfo) error {
+	m.Lock()
+	gpuToContainer := m.gpuToContainer
+	m.Unlock()
+
+	for i, device := range metrics {
+		for k, metric := range device {
+			containers := gpuToContainer[metric.GPUUUID]
+
+			values := map[string][]string{}
+			for _, container := range containers {
+				values[containerIDAttribute] = append(values[containerIDAttribute], container.ID)
+				values[containerNameAttribute] = append(values[containerNameAttribute], container.Name)
+				values[containerImageAttribute] = append(values[containerImageAttribute], container.Image)
+				for key, name := range m.labels {
+					values[name] = append(values[name], container.Labels[key])
+				}
+			}
+
+			metrics[i][k].Attributes[containerIDAttribute] = strings.Join(values[containerIDAttribute], ",")
+			metrics[i][k].Attributes[containerNameAttribute] = strings.Join(values[containerNameAttribute], ",")
+			metrics[i][k].Attributes[containerImageAttribute] = strings.Join(values[containerImageAttribute], ",")
+			for _, name := range m.labels {
+				metrics[i][k].Attributes[name] = strings.Join(values[name], ",")
+			}
+		}
+	}
+
+	return nil
+}
+
+// processContainerID returns the ID of the container of a process from its
+// cgroup, empty if it isn't in a container or if it exited.
+func processContainerID(pid uint) string {
+	cgroup, err := ioutil.ReadFile(filepath.Join(procDir, fmt.Sprint(pid), "cgroup"))
+	if err != nil {
+		logrus.Debugf("Failed to read the cgroup of the process %d: %v", pid, err)
+		return ""
+	}
+
+	ids := containerCgroup.FindAll(cgroup, -1)
+	if len(ids) == 0 {
+		return ""
+	}
+
+	return string(ids[len(ids)-1])
+}
+
+// listGPUProcesses returns the PIDs of the compute and graphics processes
+// running on each GPU, by GPU UUID. The PIDs are the ones of the host.
+func listGPUProcesses() (map[string][]uint, error) {
+	count, err := nvml.GetDeviceCount()
+	if err != nil {
+		return nil, err
+	}
+
+	processes := map[string][]uint{}
+	for i := uint(0); i < count; i++ {
+		device, err := nvml.NewDeviceLite(i)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get the GPU %d: %v", i, err)
+		}
+
+		infos, err := device.GetAllRunningProcesses()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list the processes of the GPU %s: %v", device.UUID, err)
+		}
+
+		pids := make([]uint, len(infos))
+		for j, info := range infos {
+			pids[j] = info.PID
+		}
+		processes[device.UUID] = pids
+	}
+
+	return processes, nil
+}
+
+// DockerRuntime looks up the containers from the Docker Engine API, also
+// served by Podman.
+type DockerRuntime struct {
+	client *http.Client
+}
+
+func NewDockerRuntime(socket string) *DockerRuntime {
+	return &DockerRuntime{
+		client: &http.Client{
+			Timeout: containerRuntimeTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+func (d *DockerRuntime) Inspect(id string) (ContainerInfo, error) {
+	resp, err := d.client.Get("http://docker/containers/" + id + "/json")
+	if err != nil {
+		return ContainerInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ContainerInfo{}, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+
+	var container struct {
+		Name   string
+		Config struct {
+			Image  string
+			Labels map[string]string
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&container); err != nil {
+		return ContainerInfo{}, fmt.Errorf("Failed to decode the container: %v", err)
+	}
+
+	return ContainerInfo{
+		ID:     id,
+		Name:   strings.TrimPrefix(container.Name, "/"),
+		Image:  container.Config.Image,
+		Labels: container.Config.Labels,
+	}, nil
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testContainerID(i int) string {
+	return strings.Repeat(fmt.Sprintf("%x", i), 64)
+}
+
+// startDockerMockServer serves the inspection of the containers over a unix
+// socket, the unknown containers aren't found. It returns the number of
+// inspections of each container.
+func startDockerMockServer(t *testing.T, socket string, containers map[string]string) (func(id string) int, func()) {
+	var lock sync.Mutex
+	inspections := map[string]int{}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/json")
+
+		lock.Lock()
+		inspections[id]++
+		lock.Unlock()
+
+		name, ok := containers[id]
+		if !ok {
+			http.Error(w, `{"message": "No such container"}`, http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Id":   id,
+			"Name": "/" + name,
+			"Config": map[string]interface{}{
+				"Image":  "registry.example.com/" + name + ":1.0",
+				"Labels": map[string]string{"com.example.team": "team-" + name},
+			},
+		})
+	}))
+
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	server.Listener = listener
+	server.Start()
+
+	return func(id string) int {
+		lock.Lock()
+		defer lock.Unlock()
+
+		return inspections[id]
+	}, server.Close
+}
+
+func TestContainerMapper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcgm-exporter-containers")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, cleanup := testSyntheticCollector(t, sampleCounters, 3)
+	defer cleanup()
+
+	out, err := c.GetMetrics()
+	require.NoError(t, err)
+	gpus := GetGPUUUIDs(out)
+
+	defer func(dir string) { procDir = dir }(procDir)
+	procDir = filepath.Join(dir, "proc")
+
+	writeTestProcess(t, procDir, "100", "0::/system.slice/docker-"+testContainerID(1)+".scope\n")
+	writeTestProcess(t, procDir, "101", "0::/system.slice/docker-"+testContainerID(1)+".scope\n")
+	writeTestProcess(t, procDir, "200", "12:devices:/docker/"+testContainerID(2)+"\n11:memory:/docker/"+testContainerID(2)+"\n")
+	writeTestProcess(t, procDir, "300", "0::/system.slice/containerd.service/default-"+testContainerID(3)+".scope\n")
+	writeTestProcess(t, procDir, "400", "0::/user.slice/user-1000.slice/session-1.scope\n")
+
+	// Container 1 and 2 share GPU 0, container 3 isn't known by the runtime
+	// and the process 500 exited
+	var lock sync.Mutex
+	processes := map[string][]uint{
+		gpus[0]: {100, 101, 200, 400},
+		gpus[1]: {300, 500},
+	}
+	listProcesses := func() (map[string][]uint, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return processes, nil
+	}
+
+	socket := filepath.Join(dir, "docker.sock")
+	inspections, stop := startDockerMockServer(t, socket, map[string]string{
+		testContainerID(1): "triton",
+		testContainerID(2): "llm",
+	})
+	defer stop()
+
+	config := &Config{ContainerLabels: []string{"com.example.team"}, ContainerRefreshInterval: 3600000}
+	containerMapper, cleanup, err := newContainerMapper(config, listProcesses, NewDockerRuntime(socket))
+	require.NoError(t, err)
+	defer cleanup()
+
+	// The first refresh runs before the mapper is returned
+	require.NoError(t, containerMapper.Process(out, c.SysInfo()))
+
+	expected := []map[string]string{
+		{
+			containerIDAttribute:               testContainerID(2) + "," + testContainerID(1),
+			containerNameAttribute:             "llm,triton",
+			containerImageAttribute:            "registry.example.com/llm:1.0,registry.example.com/triton:1.0",
+			"container_label_com_example_team": "team-llm,team-triton",
+		},
+		{
+			containerIDAttribute:               testContainerID(3),
+			containerNameAttribute:             "",
+			containerImageAttribute:            "",
+			"container_label_com_example_team": "",
+		},
+		{
+			containerIDAttribute:               "",
+			containerNameAttribute:             "",
+			containerImageAttribute:            "",
+			"container_label_com_example_team": "",
+		},
+	}
+	for i, device := range out {
+		for _, m := range device {
+			for name, value := range expected[i] {
+				require.Equal(t, value, m.Attributes[name], "GPU %d %s", i, name)
+			}
+		}
+	}
+
+	// The containers are only looked up again if the runtime didn't know them
+	containerMapper.Refresh()
+	require.Equal(t, 1, inspections(testContainerID(1)))
+	require.Equal(t, 2, inspections(testContainerID(3)))
+
+	// The failed lookups are remembered, to only warn once, until the
+	// containers stop
+	containerMapper.Lock()
+	require.Equal(t, map[string]bool{testContainerID(3): true}, containerMapper.failed)
+	containerMapper.Unlock()
+
+	// The containers are forgotten when their processes end
+	lock.Lock()
+	processes = map[string][]uint{gpus[0]: {100}}
+	lock.Unlock()
+	containerMapper.Refresh()
+	require.NoError(t, containerMapper.Process(out, c.SysInfo()))
+	require.Equal(t, "triton", out[0][0].Attributes[containerNameAttribute])
+	require.Equal(t, "", out[1][0].Attributes[containerIDAttribute])
+
+	containerMapper.Lock()
+	require.Empty(t, containerMapper.failed)
+	containerMapper.Unlock()
+}
+
+func TestContainerMapperWithoutRuntime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcgm-exporter-containers")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, cleanup := testSyntheticCollector(t, sampleCounters, 1)
+	defer cleanup()
+
+	out, err := c.GetMetrics()
+	require.NoError(t, err)
+	gpus := GetGPUUUIDs(out)
+
+	defer func(dir string) { procDir = dir }(procDir)
+	procDir = filepath.Join(dir, "proc")
+	writeTestProcess(t, procDir, "100", "0::/system.slice/docker-"+testContainerID(1)+".scope\n")
+
+	listProcesses := func() (map[string][]uint, error) { return map[string][]uint{gpus[0]: {100}}, nil }
+	containerMapper, cleanup, err := newContainerMapper(&Config{ContainerRefreshInterval: 3600000}, listProcesses, nil)
+	require.NoError(t, err)
+	defer cleanup()
+
+	// The first refresh runs before the mapper is returned
+	require.NoError(t, containerMapper.Process(out, c.SysInfo()))
+
+	for _, m := range out[0] {
+		require.Equal(t, testContainerID(1), m.Attributes[containerIDAttribute])
+		require.Equal(t, "", m.Attributes[containerNameAttribute])
+		require.Equal(t, "", m.Attributes[containerImageAttribute])
+	}
+
+	_, _, err = newContainerMapper(&Config{ContainerRefreshInterval: 0}, listProcesses, nil)
+	require.Error(t, err)
+}
@@ -20,8 +20,13 @@ import (
 	"fmt"
 	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
 	"math/rand"
+	"sort"
+	"time"
 )
 
+// Watch frequency of the counters that don't specify an interval
+var defaultUpdateFreq = time.Second
+
 func NewGroup() (dcgm.GroupHandle, func(), error) {
 	group, err := dcgm.NewDefaultGroup(fmt.Sprintf("gpu-collector-group-%d", rand.Uint64()))
 	if err != nil {
@@ -50,8 +55,8 @@ func NewFieldGroup(deviceFields []dcgm.Short) (dcgm.FieldHandle, func(), error)
 	return fieldGroup, func() { dcgm.FieldGroupDestroy(fieldGroup) }, nil
 }
 
-func WatchFieldGroup(group dcgm.GroupHandle, field dcgm.FieldHandle) error {
-	err := dcgm.WatchFieldsWithGroup(field, group)
+func WatchFieldGroup(group dcgm.GroupHandle, field dcgm.FieldHandle, watch FieldWatch) error {
+	err := dcgm.WatchFieldsWithGroupEx(field, group, watch.UpdateFreq.Microseconds(), watch.MaxKeepAge.Seconds(), 0)
 	if err != nil {
 		return err
 	}
@@ -59,38 +64,124 @@ func WatchFieldGroup(group dcgm.GroupHandle, field dcgm.FieldHandle) error {
 	return nil
 }
 
-func SetupDcgmFieldsWatch(deviceFields []dcgm.Short, sysInfo SystemInfo) ([]func(), error) {
-	var err error
-	var cleanups []func()
-	var cleanup func()
-	var group dcgm.GroupHandle
-	var fieldGroup dcgm.FieldHandle
+// NewFieldWatches groups the counters by interval, each group is watched
+// separately so that slow moving fields don't have to be sampled as often as
+// fast moving ones. DCGM keeps the samples of at least two collections.
+func NewFieldWatches(counters []Counter, collectInterval time.Duration) []FieldWatch {
+	fields := make(map[time.Duration][]dcgm.Short)
+	for _, c := range counters {
+		interval := c.Interval
+		if interval == 0 {
+			interval = defaultUpdateFreq
+		}
+
+		fields[interval] = append(fields[interval], c.FieldID)
+	}
 
-	group, cleanup, err = CreateGroupFromSystemInfo(sysInfo)
-	if err != nil {
-		goto fail
+	watches := make([]FieldWatch, 0, len(fields))
+	for interval, f := range fields {
+		keepAge := 2 * interval
+		if keepAge < 2*collectInterval {
+			keepAge = 2 * collectInterval
+		}
+
+		watches = append(watches, FieldWatch{
+			Fields:     f,
+			UpdateFreq: interval,
+			MaxKeepAge: keepAge,
+		})
 	}
 
-	cleanups = append(cleanups, cleanup)
+	sort.Slice(watches, func(i, j int) bool {
+		return watches[i].UpdateFreq < watches[j].UpdateFreq
+	})
 
-	fieldGroup, cleanup, err = NewFieldGroup(deviceFields)
-	if err != nil {
-		goto fail
+	return watches
+}
+
+// NewDistributionFields returns the fields of the histogram and summary counters
+func NewDistributionFields(counters []Counter) []dcgm.Short {
+	var fields []dcgm.Short
+	for i := range counters {
+		if isDistribution(&counters[i]) {
+			fields = append(fields, counters[i].FieldID)
+		}
 	}
 
-	cleanups = append(cleanups, cleanup)
+	return fields
+}
 
-	err = WatchFieldGroup(group, fieldGroup)
-	if err != nil {
-		goto fail
+// WatchFieldGroups creates and watches a field group per watch on the group of
+// entities. The field groups are destroyed if any watch fails.
+func WatchFieldGroups(group dcgm.GroupHandle, watches []FieldWatch) ([]dcgm.FieldHandle, error) {
+	var fieldGroups []dcgm.FieldHandle
+
+	for _, watch := range watches {
+		fieldGroup, _, err := NewFieldGroup(watch.Fields)
+		if err == nil {
+			fieldGroups = append(fieldGroups, fieldGroup)
+			err = WatchFieldGroup(group, fieldGroup, watch)
+		}
+
+		if err != nil {
+			for _, f := range fieldGroups {
+				dcgm.FieldGroupDestroy(f)
+			}
+
+			return nil, err
+		}
+	}
+
+	return fieldGroups, nil
+}
+
+var fieldWatches = NewFieldWatchRegistry(UnwatchDeviceFields)
+
+func NewFieldWatchRegistry(unwatch func(group dcgm.GroupHandle, fields []dcgm.Short) error) *FieldWatchRegistry {
+	return &FieldWatchRegistry{watchers: make(map[dcgm.Short]int), unwatch: unwatch}
+}
+
+// Watch records a collector watching the fields
+func (r *FieldWatchRegistry) Watch(fields []dcgm.Short) {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, f := range fields {
+		r.watchers[f]++
+	}
+}
+
+// Release records a collector no longer watching the fields, and unwatches on
+// the group the ones no other collector still watches.
+func (r *FieldWatchRegistry) Release(group dcgm.GroupHandle, fields []dcgm.Short) error {
+	r.Lock()
+	defer r.Unlock()
+
+	var unwatched []dcgm.Short
+	for _, f := range fields {
+		if r.watchers[f]--; r.watchers[f] <= 0 {
+			delete(r.watchers, f)
+			unwatched = append(unwatched, f)
+		}
 	}
 
-	return cleanups, nil
+	return r.unwatch(group, unwatched)
+}
+
+// UnwatchDeviceFields stops watching the fields on the group. DCGM has a
+// single watch per field and entity, watching a field again through another
+// field group only updates its frequency: the fields still watched must not be
+// unwatched when their previous field group is destroyed.
+func UnwatchDeviceFields(group dcgm.GroupHandle, fields []dcgm.Short) error {
+	if len(fields) == 0 {
+		return nil
+	}
 
-fail:
-	for _, f := range cleanups {
-		f()
+	fieldGroup, cleanup, err := NewFieldGroup(fields)
+	if err != nil {
+		return err
 	}
+	defer cleanup()
 
-	return nil, err
+	return dcgm.UnwatchFields(fieldGroup, group)
 }
@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFieldWatches(t *testing.T) {
+	counters := []Counter{
+		{FieldID: dcgm.DCGM_FI_DEV_RETIRED_SBE, Interval: time.Minute},
+		{FieldID: dcgm.DCGM_FI_DEV_POWER_USAGE, Interval: time.Second},
+		{FieldID: dcgm.DCGM_FI_DEV_GPU_TEMP},
+		{FieldID: dcgm.DCGM_FI_DEV_RETIRED_DBE, Interval: time.Minute},
+	}
+
+	watches := NewFieldWatches(counters, 30*time.Second)
+	require.Len(t, watches, 2)
+
+	require.Equal(t, time.Second, watches[0].UpdateFreq)
+	require.Equal(t, []dcgm.Short{dcgm.DCGM_FI_DEV_POWER_USAGE, dcgm.DCGM_FI_DEV_GPU_TEMP}, watches[0].Fields)
+	require.Equal(t, time.Minute, watches[0].MaxKeepAge)
+
+	require.Equal(t, time.Minute, watches[1].UpdateFreq)
+	require.Equal(t, []dcgm.Short{dcgm.DCGM_FI_DEV_RETIRED_SBE, dcgm.DCGM_FI_DEV_RETIRED_DBE}, watches[1].Fields)
+	require.Equal(t, 2*time.Minute, watches[1].MaxKeepAge)
+}
+
+func TestFieldWatchRegistry(t *testing.T) {
+	var unwatched [][]dcgm.Short
+	registry := NewFieldWatchRegistry(func(_ dcgm.GroupHandle, fields []dcgm.Short) error {
+		unwatched = append(unwatched, fields)
+		return nil
+	})
+
+	defer func(r *FieldWatchRegistry) { fieldWatches = r }(fieldWatches)
+	fieldWatches = registry
+
+	newCollector := func(fields ...dcgm.Short) *DCGMCollector {
+		registry.Watch(fields)
+		return &DCGMCollector{DeviceFields: fields}
+	}
+
+	// A rebuilt pipeline watches its fields before the running one stops
+	running := newCollector(dcgm.DCGM_FI_DEV_GPU_TEMP, dcgm.DCGM_FI_DEV_POWER_USAGE)
+	rebuilt := newCollector(dcgm.DCGM_FI_DEV_POWER_USAGE, dcgm.DCGM_FI_DEV_GPU_UTIL)
+	running.Cleanup()
+	require.Equal(t, [][]dcgm.Short{{dcgm.DCGM_FI_DEV_GPU_TEMP}}, unwatched)
+
+	// A build that fails cleans its collector up while the rebuilt one runs
+	unwatched = nil
+	failed := newCollector(dcgm.DCGM_FI_DEV_POWER_USAGE, dcgm.DCGM_FI_DEV_GPU_UTIL, dcgm.DCGM_FI_DEV_MEM_CLOCK)
+	failed.Cleanup()
+	require.Equal(t, [][]dcgm.Short{{dcgm.DCGM_FI_DEV_MEM_CLOCK}}, unwatched)
+
+	unwatched = nil
+	rebuilt.Cleanup()
+	require.Equal(t, [][]dcgm.Short{{dcgm.DCGM_FI_DEV_POWER_USAGE, dcgm.DCGM_FI_DEV_GPU_UTIL}}, unwatched)
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
+)
+
+var (
+	// Same defaults as the Prometheus client libraries
+	DefaultBuckets   = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	DefaultQuantiles = []float64{.5, .9, .99}
+)
+
+func isDistribution(c *Counter) bool {
+	return c.PromType == "histogram" || c.PromType == "summary"
+}
+
+func NewDistributions() *Distributions {
+	return &Distributions{states: make(map[distributionKey]*distributionState)}
+}
+
+func (d *Distributions) state(entity dcgm.GroupEntityPair, c *Counter) *distributionState {
+	key := distributionKey{entity: entity, fieldID: c.FieldID}
+	if s, ok := d.states[key]; ok {
+		return s
+	}
+
+	s := &distributionState{Distribution: Distribution{Start: time.Now()}}
+	for _, b := range c.Buckets {
+		s.Buckets = append(s.Buckets, Bucket{UpperBound: b})
+	}
+
+	d.states[key] = s
+
+	return s
+}
+
+func (d *Distributions) Observe(entity dcgm.GroupEntityPair, c *Counter, v float64) {
+	s := d.state(entity, c)
+
+	s.Sum += v
+	s.Count++
+
+	for i := range s.Buckets {
+		if v <= s.Buckets[i].UpperBound {
+			s.Buckets[i].Count++
+		}
+	}
+
+	if c.PromType == "summary" {
+		s.window = append(s.window, v)
+	}
+}
+
+// Collect returns a copy of the distribution of the entity's counter. The
+// quantiles are computed over the samples observed since the previous call,
+// they are NaN if there were none.
+func (d *Distributions) Collect(entity dcgm.GroupEntityPair, c *Counter) *Distribution {
+	s := d.state(entity, c)
+
+	dist := &Distribution{
+		Buckets: append([]Bucket(nil), s.Buckets...),
+		Sum:     s.Sum,
+		Count:   s.Count,
+		Start:   s.Start,
+	}
+
+	if c.PromType == "summary" {
+		sort.Float64s(s.window)
+		for _, q := range c.Quantiles {
+			dist.Quantiles = append(dist.Quantiles, Quantile{Quantile: q, Value: quantile(s.window, q)})
+		}
+
+		s.window = s.window[:0]
+	}
+
+	return dist
+}
+
+// Nearest rank quantile of sorted samples
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+
+	return sorted[rank]
+}
+
+// distributionValue returns the numerical value of a sample, blank and
+// non-numerical values are not aggregated.
+func distributionValue(v dcgm.FieldValue_v2) (float64, bool) {
+	s := ToString(dcgm.FieldValue_v1{
+		Version:   v.Version,
+		FieldId:   v.FieldId,
+		FieldType: v.FieldType,
+		Status:    v.Status,
+		Ts:        v.Ts,
+		Value:     v.Value,
+	})
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return f, true
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDistributions(t *testing.T) {
+	histogram := Counter{FieldID: dcgm.DCGM_FI_PROF_SM_OCCUPANCY, FieldName: "DCGM_FI_PROF_SM_OCCUPANCY", PromType: "histogram", Buckets: []float64{0.25, 0.5, 1}}
+	summary := Counter{FieldID: dcgm.DCGM_FI_DEV_POWER_USAGE, FieldName: "DCGM_FI_DEV_POWER_USAGE", PromType: "summary", Quantiles: []float64{0, 0.5, 0.9, 1}}
+
+	gpu0 := dcgm.GroupEntityPair{EntityGroupId: dcgm.FE_GPU, EntityId: 0}
+	gpu1 := dcgm.GroupEntityPair{EntityGroupId: dcgm.FE_GPU, EntityId: 1}
+	d := NewDistributions()
+
+	for _, v := range []float64{0.1, 0.3, 0.6, 0.2, 2} {
+		d.Observe(gpu0, &histogram, v)
+	}
+	d.Observe(gpu1, &histogram, 0.75)
+
+	h := d.Collect(gpu0, &histogram)
+	require.Equal(t, []Bucket{{0.25, 2}, {0.5, 3}, {1, 4}}, h.Buckets)
+	require.Equal(t, uint64(5), h.Count)
+	require.InDelta(t, 3.2, h.Sum, 1e-9)
+	require.Equal(t, []Bucket{{0.25, 0}, {0.5, 0}, {1, 1}}, d.Collect(gpu1, &histogram).Buckets)
+
+	// Histograms are cumulative
+	d.Observe(gpu0, &histogram, 0.5)
+	require.Equal(t, []Bucket{{0.25, 2}, {0.5, 4}, {1, 5}}, d.Collect(gpu0, &histogram).Buckets)
+
+	for _, v := range []float64{70, 50, 60, 80, 90, 100, 40, 30, 20, 10} {
+		d.Observe(gpu0, &summary, v)
+	}
+
+	s := d.Collect(gpu0, &summary)
+	require.Equal(t, []Quantile{{0, 10}, {0.5, 50}, {0.9, 90}, {1, 100}}, s.Quantiles)
+	require.Equal(t, uint64(10), s.Count)
+	require.Equal(t, float64(550), s.Sum)
+
+	// Quantiles are computed over the samples since the previous collection
+	s = d.Collect(gpu0, &summary)
+	require.Equal(t, uint64(10), s.Count)
+	require.True(t, math.IsNaN(s.Quantiles[1].Value))
+}
+
+func TestEncodeDistributions(t *testing.T) {
+	histogram := Counter{FieldID: dcgm.DCGM_FI_PROF_SM_OCCUPANCY, FieldName: "DCGM_FI_PROF_SM_OCCUPANCY", PromType: "histogram", Help: "Occupancy", Buckets: []float64{0.5, 1}}
+	summary := Counter{FieldID: dcgm.DCGM_FI_DEV_POWER_USAGE, FieldName: "DCGM_FI_DEV_POWER_USAGE", PromType: "summary", Help: "Power", Quantiles: []float64{0.5}}
+	raw := Counter{FieldID: dcgm.DCGM_FI_DEV_GPU_TEMP, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "summary", Help: "Temperature"}
+
+	metrics := [][]Metric{{
+		{Counter: &histogram, Value: "0.7", GPU: "0", Distribution: &Distribution{Buckets: []Bucket{{0.5, 1}, {1, 2}}, Sum: 1.2, Count: 3}},
+		{Counter: &summary, Value: "70", GPU: "0", Distribution: &Distribution{Quantiles: []Quantile{{0.5, 65.5}}, Sum: 131, Count: 2}},
+		{Counter: &raw, Value: "42", GPU: "0"},
+	}}
+
+	var out strings.Builder
+	require.NoError(t, EncodeMetrics(&out, TextFormat, metrics))
+	require.Equal(t, `# HELP DCGM_FI_DEV_GPU_TEMP Temperature
+# TYPE DCGM_FI_DEV_GPU_TEMP untyped
+DCGM_FI_DEV_GPU_TEMP{gpu="0"} 42
+# HELP DCGM_FI_DEV_POWER_USAGE Power
+# TYPE DCGM_FI_DEV_POWER_USAGE summary
+DCGM_FI_DEV_POWER_USAGE{gpu="0",quantile="0.5"} 65.5
+DCGM_FI_DEV_POWER_USAGE_sum{gpu="0"} 131
+DCGM_FI_DEV_POWER_USAGE_count{gpu="0"} 2
+# HELP DCGM_FI_PROF_SM_OCCUPANCY Occupancy
+# TYPE DCGM_FI_PROF_SM_OCCUPANCY histogram
+DCGM_FI_PROF_SM_OCCUPANCY_bucket{gpu="0",le="0.5"} 1
+DCGM_FI_PROF_SM_OCCUPANCY_bucket{gpu="0",le="1"} 2
+DCGM_FI_PROF_SM_OCCUPANCY_bucket{gpu="0",le="+Inf"} 3
+DCGM_FI_PROF_SM_OCCUPANCY_sum{gpu="0"} 1.2
+DCGM_FI_PROF_SM_OCCUPANCY_count{gpu="0"} 3
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, EncodeMetrics(&out, OpenMetricsFormat, metrics))
+	require.Contains(t, out.String(), "# TYPE DCGM_FI_DEV_GPU_TEMP unknown\n")
+	require.Contains(t, out.String(), "# TYPE DCGM_FI_PROF_SM_OCCUPANCY histogram\n")
+}
@@ -0,0 +1,335 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+* The encoder writes the following format, families are sorted by name and
+* the attributes of each metric are sorted by key:
+* ```
+* # HELP FIELD_ID HELP_MSG
+* # TYPE FIELD_ID PROM_TYPE
+* FIELD_ID{gpu="GPU_INDEX_0",UUID="GPU_UUID",device="nvidiaN",modelName="MODEL", attr...} VALUE
+* FIELD_ID{gpu="GPU_INDEX_N",UUID="GPU_UUID",device="nvidiaN",modelName="MODEL", attr...} VALUE
+* ...
+* ```
+*
+* Info counters have no numerical value, the value is exposed as a label instead:
+* ```
+* FIELD_ID_info{gpu="GPU_INDEX_0",UUID="GPU_UUID", attr...,value="VALUE"} 1
+* ```
+*
+* Histograms and summaries have one sample per bucket or quantile:
+* ```
+* FIELD_ID_bucket{gpu="GPU_INDEX_0",UUID="GPU_UUID", attr...,le="UPPER_BOUND"} COUNT
+* FIELD_ID_bucket{gpu="GPU_INDEX_0",UUID="GPU_UUID", attr...,le="+Inf"} COUNT
+* FIELD_ID_sum{gpu="GPU_INDEX_0",UUID="GPU_UUID", attr...} SUM
+* FIELD_ID_count{gpu="GPU_INDEX_0",UUID="GPU_UUID", attr...} COUNT
+* FIELD_ID{gpu="GPU_INDEX_0",UUID="GPU_UUID", attr...,quantile="QUANTILE"} VALUE
+* ```
+*
+* The OpenMetrics format adds the UNIT metadata, suffixes the samples of
+* counters and info metrics and terminates the exposition with an EOF marker:
+* ```
+* # HELP FIELD_ID HELP_MSG
+* # TYPE FIELD_ID OPENMETRICS_TYPE
+* # UNIT FIELD_ID UNIT
+* FIELD_ID_total{gpu="GPU_INDEX_0",UUID="GPU_UUID", attr...} VALUE
+* ...
+* # EOF
+* ```
+ */
+
+type metricFamily struct {
+	counter *Counter
+	metrics []Metric
+}
+
+type Encoder struct {
+	w      *bufio.Writer
+	format MetricsFormat
+}
+
+func NewEncoder(w io.Writer, format MetricsFormat) *Encoder {
+	return &Encoder{
+		w:      bufio.NewWriter(w),
+		format: format,
+	}
+}
+
+// EncodeMetrics writes the metrics to w in the requested exposition format
+func EncodeMetrics(w io.Writer, format MetricsFormat, m [][]Metric) error {
+	return NewEncoder(w, format).Encode(m)
+}
+
+func (e *Encoder) Encode(m [][]Metric) error {
+	for _, family := range groupMetrics(m) {
+		e.writeFamily(family)
+	}
+
+	if e.format == OpenMetricsFormat {
+		e.w.WriteString("# EOF\n")
+	}
+
+	return e.w.Flush()
+}
+
+// Group metrics by counter name instead of by device. Metrics keep the
+// order in which they were collected within their family.
+func groupMetrics(m [][]Metric) []metricFamily {
+	var families []metricFamily
+	index := make(map[string]int)
+
+	for _, deviceMetrics := range m {
+		for _, metric := range deviceMetrics {
+			i, ok := index[metric.Counter.FieldName]
+			if !ok {
+				i = len(families)
+				index[metric.Counter.FieldName] = i
+				families = append(families, metricFamily{counter: metric.Counter})
+			}
+
+			families[i].metrics = append(families[i].metrics, metric)
+		}
+	}
+
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].counter.FieldName < families[j].counter.FieldName
+	})
+
+	return families
+}
+
+func (e *Encoder) writeFamily(family metricFamily) {
+	c := family.counter
+	name, sampleName, typ := c.FieldName, c.FieldName, c.PromType
+
+	if e.format == OpenMetricsFormat {
+		switch c.PromType {
+		case "counter":
+			// The name of an OpenMetrics counter family doesn't have the suffix of its samples
+			name = strings.TrimSuffix(name, "_total")
+			sampleName = name + "_total"
+		case "info":
+			sampleName += "_info"
+		}
+	} else if c.PromType == "info" {
+		name += "_info"
+		sampleName = name
+		typ = "gauge"
+	}
+
+	// Histograms and summaries without samples (e.g: a collector that doesn't
+	// aggregate them) are exported as a single sample of unknown type.
+	if isDistribution(c) && family.metrics[0].Distribution == nil {
+		typ = "untyped"
+		if e.format == OpenMetricsFormat {
+			typ = "unknown"
+		}
+	}
+
+	e.w.WriteString("# HELP ")
+	e.w.WriteString(name)
+	e.w.WriteByte(' ')
+	e.writeHelp(c.Help)
+	e.w.WriteString("\n# TYPE ")
+	e.w.WriteString(name)
+	e.w.WriteByte(' ')
+	e.w.WriteString(typ)
+	e.w.WriteByte('\n')
+
+	// OpenMetrics requires the unit to be a suffix of the metric name
+	if e.format == OpenMetricsFormat && c.Unit != "" && strings.HasSuffix(name, "_"+c.Unit) {
+		e.w.WriteString("# UNIT ")
+		e.w.WriteString(name)
+		e.w.WriteByte(' ')
+		e.w.WriteString(c.Unit)
+		e.w.WriteByte('\n')
+	}
+
+	for _, metric := range family.metrics {
+		e.writeMetric(sampleName, metric)
+	}
+}
+
+func (e *Encoder) writeMetric(name string, m Metric) {
+	MetricSamples(name, m, func(name, labelName, labelValue, value string) {
+		e.writeSample(name, m, labelName, labelValue, value)
+	})
+}
+
+// MetricSamples calls fn for each sample of the metric in the Prometheus data
+// model: info metrics have their value as a label, histograms and summaries
+// have one sample per bucket or quantile. The extra label (e.g: the "le" label
+// of the buckets) is empty if there is none.
+func MetricSamples(name string, m Metric, fn func(name, labelName, labelValue, value string)) {
+	d := m.Distribution
+	switch {
+	case m.Counter.PromType == "info":
+		fn(name, "value", m.Value, "1")
+	case m.Counter.PromType == "histogram" && d != nil:
+		for _, b := range d.Buckets {
+			fn(name+"_bucket", "le", formatFloat(b.UpperBound), formatUint(b.Count))
+		}
+		fn(name+"_bucket", "le", "+Inf", formatUint(d.Count))
+		fn(name+"_sum", "", "", formatFloat(d.Sum))
+		fn(name+"_count", "", "", formatUint(d.Count))
+	case m.Counter.PromType == "summary" && d != nil:
+		for _, q := range d.Quantiles {
+			fn(name, "quantile", formatFloat(q.Quantile), formatFloat(q.Value))
+		}
+		fn(name+"_sum", "", "", formatFloat(d.Sum))
+		fn(name+"_count", "", "", formatUint(d.Count))
+	default:
+		fn(name, "", "", m.Value)
+	}
+}
+
+// writeSample writes a sample with the labels of the metric, the extra label
+// is written last (e.g: the "le" label of the buckets), unless its name is empty.
+func (e *Encoder) writeSample(name string, m Metric, extraName, extraValue, value string) {
+	e.w.WriteString(name)
+	e.w.WriteByte('{')
+
+	// Empty labels are equivalent to missing labels, the identification
+	// labels are only empty if they were dropped by the relabeling.
+	first := true
+	for _, l := range [...][2]string{
+		{gpuLabel, m.GPU},
+		{m.UUID, m.GPUUUID},
+		{deviceLabel, m.GPUDevice},
+		{modelNameLabel, m.GPUModelName},
+		{migProfileLabel, m.MigProfile},
+		{gpuInstanceIDLabel, m.GPUInstanceID},
+		{hostnameLabel, m.Hostname},
+	} {
+		if l[1] == "" {
+			continue
+		}
+		e.writeLabel(l[0], l[1], first)
+		first = false
+	}
+
+	keys := make([]string, 0, len(m.Attributes))
+	for k := range m.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		e.writeLabel(k, m.Attributes[k], first)
+		first = false
+	}
+
+	if extraName != "" {
+		e.writeLabel(extraName, extraValue, first)
+	}
+
+	e.w.WriteString("} ")
+	e.w.WriteString(value)
+	e.w.WriteByte('\n')
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func formatUint(u uint64) string {
+	return strconv.FormatUint(u, 10)
+}
+
+func (e *Encoder) writeLabel(name, value string, first bool) {
+	if !first {
+		e.w.WriteByte(',')
+	}
+
+	writeLabelName(e.w, name)
+	e.w.WriteString(`="`)
+	e.writeEscaped(value, true)
+	e.w.WriteByte('"')
+}
+
+// The text format only escapes backslashes and line feeds in help strings,
+// OpenMetrics escapes double quotes as well.
+func (e *Encoder) writeHelp(help string) {
+	e.writeEscaped(help, e.format == OpenMetricsFormat)
+}
+
+func (e *Encoder) writeEscaped(s string, escapeQuotes bool) {
+	start := 0
+	for i := 0; i < len(s); i++ {
+		var escaped string
+		switch s[i] {
+		case '\\':
+			escaped = `\\`
+		case '\n':
+			escaped = `\n`
+		case '"':
+			if !escapeQuotes {
+				continue
+			}
+			escaped = `\"`
+		default:
+			continue
+		}
+
+		e.w.WriteString(s[start:i])
+		e.w.WriteString(escaped)
+		start = i + 1
+	}
+
+	e.w.WriteString(s[start:])
+}
+
+func writeLabelName(w *bufio.Writer, name string) {
+	w.WriteString(SanitizeLabelName(name))
+}
+
+// Label names coming from attributes are not validated upstream, characters
+// that are not allowed by the exposition formats are replaced by '_'.
+func SanitizeLabelName(name string) string {
+	valid := func(i int) bool {
+		b := name[i]
+		return b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (i > 0 && b >= '0' && b <= '9')
+	}
+
+	i := 0
+	for i < len(name) && valid(i) {
+		i++
+	}
+
+	// Most names are valid, they are returned without allocating
+	if i == len(name) {
+		return name
+	}
+
+	sanitized := []byte(name)
+	for ; i < len(name); i++ {
+		if !valid(i) {
+			sanitized[i] = '_'
+		}
+	}
+
+	return string(sanitized)
+}
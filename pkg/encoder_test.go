@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeEscaping(t *testing.T) {
+	counter := Counter{FieldID: dcgm.DCGM_FI_DEV_GPU_TEMP, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge", Help: "Temperature \"in C\"\\ help"}
+	metrics := [][]Metric{{{
+		Counter:      &counter,
+		Value:        "42",
+		UUID:         "UUID",
+		GPU:          "0",
+		GPUUUID:      "GPU-0000",
+		GPUDevice:    "nvidia0",
+		GPUModelName: "Tesla \"T4\"\\",
+		Attributes: map[string]string{
+			"pod":        "line\nbreak",
+			"label.name": "x",
+		},
+	}}}
+
+	var out strings.Builder
+	require.NoError(t, EncodeMetrics(&out, TextFormat, metrics))
+	require.Equal(t, `# HELP DCGM_FI_DEV_GPU_TEMP Temperature "in C"\\ help
+# TYPE DCGM_FI_DEV_GPU_TEMP gauge
+DCGM_FI_DEV_GPU_TEMP{gpu="0",UUID="GPU-0000",device="nvidia0",modelName="Tesla \"T4\"\\",label_name="x",pod="line\nbreak"} 42
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, EncodeMetrics(&out, OpenMetricsFormat, metrics))
+	require.True(t, strings.HasPrefix(out.String(), `# HELP DCGM_FI_DEV_GPU_TEMP Temperature \"in C\"\\ help`+"\n"))
+}
+
+func TestEncodeOrdering(t *testing.T) {
+	counters := []Counter{
+		{FieldID: dcgm.DCGM_FI_DEV_SM_CLOCK, FieldName: "DCGM_FI_DEV_SM_CLOCK", PromType: "gauge", Help: "SM clock"},
+		{FieldID: dcgm.DCGM_FI_DEV_GPU_TEMP, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge", Help: "Temperature"},
+	}
+
+	var metrics [][]Metric
+	for gpu := 0; gpu < 2; gpu++ {
+		var device []Metric
+		for i := range counters {
+			device = append(device, Metric{
+				Counter:    &counters[i],
+				Value:      "1",
+				UUID:       "UUID",
+				GPU:        string(rune('0' + gpu)),
+				Attributes: map[string]string{"b": "2", "a": "1", "c": "3"},
+			})
+		}
+		metrics = append(metrics, device)
+	}
+
+	var first strings.Builder
+	require.NoError(t, EncodeMetrics(&first, TextFormat, metrics))
+
+	lines := strings.Split(strings.TrimSpace(first.String()), "\n")
+	require.Len(t, lines, 8)
+	require.Equal(t, "# HELP DCGM_FI_DEV_GPU_TEMP Temperature", lines[0])
+	require.True(t, strings.HasPrefix(lines[2], `DCGM_FI_DEV_GPU_TEMP{gpu="0"`))
+	require.True(t, strings.HasPrefix(lines[3], `DCGM_FI_DEV_GPU_TEMP{gpu="1"`))
+	require.Equal(t, "# HELP DCGM_FI_DEV_SM_CLOCK SM clock", lines[4])
+	require.Contains(t, lines[2], `,a="1",b="2",c="3"}`)
+
+	for i := 0; i < 10; i++ {
+		var again strings.Builder
+		require.NoError(t, EncodeMetrics(&again, TextFormat, metrics))
+		require.Equal(t, first.String(), again.String())
+	}
+}
+
+func BenchmarkEncodeMetrics(b *testing.B) {
+	counters := make([]Counter, 100)
+	for i := range counters {
+		counters[i] = Counter{FieldID: dcgm.Short(i), FieldName: "DCGM_FI_FIELD_" + string(rune('A'+i%26)) + string(rune('A'+i/26)), PromType: "gauge", Help: "Help"}
+	}
+
+	metrics := make([][]Metric, 8)
+	for gpu := range metrics {
+		for i := range counters {
+			metrics[gpu] = append(metrics[gpu], Metric{
+				Counter:      &counters[i],
+				Value:        "123.456000",
+				UUID:         "UUID",
+				GPU:          string(rune('0' + gpu)),
+				GPUUUID:      "GPU-604ac76c-d9cf-fef3-62e9-d92044ab6e52",
+				GPUDevice:    "nvidia0",
+				GPUModelName: "A100-SXM4-40GB",
+				Hostname:     "node",
+				Attributes:   map[string]string{podAttribute: "pod", namespaceAttribute: "default", containerAttribute: "main"},
+			})
+		}
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var out strings.Builder
+		if err := EncodeMetrics(&out, TextFormat, metrics); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,531 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
+	"github.com/sirupsen/logrus"
+)
+
+const componentStopTimeout = 2 * time.Second
+
+// The components of the exporter, in the order they are started: the outputs
+// are ready before the first collection. Each one is rebuilt when its settings
+// change, the content of the files it reads is part of its settings. The
+// counters file is the exception, the pipeline reloads it (see ReloadCounters).
+var exporterComponents = []exporterComponent{
+	{
+		name: "HTTP server",
+		settings: func(c *Config) interface{} {
+			// The TLS files are reloaded by the server when they change, the
+			// health checks depend on the collect interval
+			return []interface{}{c.NoHTTPServer, c.Address, c.CollectMode, c.CollectInterval, c.ScrapeMinInterval, fileDigest(c.WebConfigFile),
+				c.EnableCountersReload}
+		},
+		build: (*Exporter).newServer,
+	},
+	{
+		name: "remote writer",
+		settings: func(c *Config) interface{} {
+			return []interface{}{c.RemoteWriteURL, fileDigest(c.RemoteWriteBearerTokenFile), c.RemoteWriteUsername,
+				fileDigest(c.RemoteWritePasswordFile), c.RemoteWriteQueueSize}
+		},
+		build: (*Exporter).newRemoteWriter,
+	},
+	{
+		name: "OTLP exporter",
+		settings: func(c *Config) interface{} {
+			return []interface{}{c.OTLPEndpoint, c.OTLPProtocol, c.OTLPInsecure}
+		},
+		build: (*Exporter).newOTLPExporter,
+	},
+	{
+		name: "InfluxDB writer",
+		settings: func(c *Config) interface{} {
+			return []interface{}{c.InfluxDBURL, fileDigest(c.InfluxDBTokenFile)}
+		},
+		build: (*Exporter).newInfluxDBWriter,
+	},
+	{
+		name: "StatsD writer",
+		settings: func(c *Config) interface{} {
+			return []interface{}{c.StatsDAddress, c.StatsDFormat}
+		},
+		build: (*Exporter).newStatsDWriter,
+	},
+	{
+		name: "pipeline",
+		settings: func(c *Config) interface{} {
+			return []interface{}{c.SyntheticGPUs, c.CollectorsFile, c.CollectInterval, c.CollectMode,
+				c.Kubernetes, c.KubernetesGPUIdType, c.KubernetesRefreshInterval, c.UseOldNamespace, c.Devices, c.NoHostname, c.UseFakeGpus,
+				c.KubernetesNodeName, c.KubernetesPodLabels, c.KubernetesPodAnnotations, c.KubernetesPodOwners, c.KubernetesNodeLabels, c.KubernetesSharedGPUs,
+				c.KubernetesGPUResources, c.Slurm, c.SlurmJobMappingDir, c.SlurmRefreshInterval,
+				c.Containers, c.ContainerRuntimeSocket, c.ContainerLabels, c.ContainerRefreshInterval,
+				fileDigest(c.RelabelConfigFile), fileDigest(c.RateConfigFile)}
+		},
+		build: (*Exporter).newPipeline,
+	},
+}
+
+// DCGM is initialized once, the exporter is restarted if these settings change
+func dcgmSettings(c *Config) interface{} {
+	return []interface{}{c.CollectorBackend, c.UseRemoteHE, c.RemoteHEInfo}
+}
+
+// fileDigest returns nil if there is no file, and the error if it can't be
+// read: the settings are compared, the build reports the errors.
+func fileDigest(filename string) interface{} {
+	if filename == "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err.Error()
+	}
+
+	return sha256.Sum256(content)
+}
+
+// StartExporter initializes DCGM, then builds and starts all the components
+func StartExporter(c *Config) (*Exporter, error) {
+	e := &Exporter{
+		components:  map[string]*component{},
+		settings:    map[string]interface{}{},
+		collections: make(chan [][]Metric, 10),
+		stop:        make(chan interface{}),
+	}
+
+	var err error
+	if e.dcgmCleanup, err = initDCGM(c); err != nil {
+		return nil, err
+	}
+
+	e.wg.Add(1)
+	go e.broadcast()
+
+	built, err := e.build(c)
+	if err != nil {
+		e.Stop()
+		return nil, err
+	}
+
+	e.swap(c, built)
+
+	return e, nil
+}
+
+func initDCGM(c *Config) (func(), error) {
+	if c.CollectorBackend != DCGMBackend {
+		logrus.Infof("Using the '%s' collector backend, DCGM is not initialized", c.CollectorBackend)
+		return func() {}, nil
+	}
+
+	var cleanup func()
+	var err error
+	if c.UseRemoteHE {
+		logrus.Info("Attemping to connect to remote hostengine at ", c.RemoteHEInfo)
+		cleanup, err = dcgm.Init(dcgm.Standalone, c.RemoteHEInfo, "0")
+	} else {
+		cleanup, err = dcgm.Init(dcgm.Embedded)
+	}
+	if err != nil {
+		cleanup()
+		return func() {}, err
+	}
+	logrus.Info("DCGM successfully initialized!")
+
+	dcgm.FieldsInit()
+	selfMetrics.SetDCGM(dcgm.Introspect, func() error {
+		_, err := dcgm.GetAllDeviceCount()
+		return err
+	}, time.Duration(c.CollectInterval)*time.Millisecond)
+
+	_, err = dcgm.GetSupportedMetricGroups(0)
+	if err != nil {
+		c.CollectDCP = false
+		logrus.Info("Not collecting DCP metrics: ", err)
+	} else {
+		logrus.Info("Collecting DCP Metrics")
+	}
+
+	return func() {
+		selfMetrics.SetDCGM(nil, nil, 0)
+		dcgm.FieldsTerm()
+		cleanup()
+	}, nil
+}
+
+// Reload applies a new configuration and returns the running exporter. Only
+// the components whose settings changed are rebuilt, they are all built before
+// any is replaced: if one fails, the running exporter is left unchanged.
+//
+// A change of the DCGM settings restarts the whole exporter, with the running
+// configuration if the new one fails to start. An error is returned if that
+// fails too.
+func (e *Exporter) Reload(c *Config) (*Exporter, error) {
+	if !reflect.DeepEqual(dcgmSettings(c), dcgmSettings(e.config)) {
+		logrus.Info("DCGM settings changed, restarting the exporter")
+
+		e.Stop()
+		restarted, err := StartExporter(c)
+		if err == nil {
+			return restarted, nil
+		}
+
+		logrus.Errorf("Failed to apply the new configuration, restarting with the running one: %v", err)
+		restarted, err = StartExporter(e.config)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to restart the exporter: %v", err)
+		}
+
+		return restarted, nil
+	}
+
+	// Detected when DCGM was initialized
+	c.CollectDCP = e.config.CollectDCP
+
+	built, err := e.build(c)
+	if err != nil {
+		logrus.Errorf("Failed to apply the new configuration, keeping the running one: %v", err)
+		return e, nil
+	}
+
+	if len(built) == 0 {
+		logrus.Info("Configuration unchanged")
+	}
+
+	e.swap(c, built)
+
+	// A pipeline that wasn't rebuilt picks up the changes of the counters file
+	if _, ok := built["pipeline"]; !ok {
+		if err := e.reloadCounters(); err != nil {
+			logrus.Errorf("Failed to reload the counters, keeping the current ones: %v", err)
+		}
+	}
+
+	return e, nil
+}
+
+// build returns the components whose settings changed since they were built,
+// nil components are disabled.
+func (e *Exporter) build(c *Config) (map[string]*builtComponent, error) {
+	built := map[string]*builtComponent{}
+
+	for _, ec := range exporterComponents {
+		settings := ec.settings(c)
+		if previous, ok := e.settings[ec.name]; ok && reflect.DeepEqual(settings, previous) {
+			continue
+		}
+
+		comp, err := ec.build(e, c)
+		if err != nil {
+			for _, b := range built {
+				if b.component != nil {
+					b.cleanup()
+				}
+			}
+
+			return nil, fmt.Errorf("Failed to build the %s: %v", ec.name, err)
+		}
+
+		if comp != nil {
+			comp.name = ec.name
+			if comp.cleanup == nil {
+				comp.cleanup = func() {}
+			}
+		}
+		built[ec.name] = &builtComponent{component: comp, settings: settings}
+	}
+
+	return built, nil
+}
+
+// swap stops the components that were rebuilt and starts the new ones
+func (e *Exporter) swap(c *Config, built map[string]*builtComponent) {
+	for _, ec := range exporterComponents {
+		b, ok := built[ec.name]
+		if !ok {
+			continue
+		}
+
+		comp := b.component
+		e.settings[ec.name] = b.settings
+
+		if old := e.components[ec.name]; old != nil {
+			logrus.Infof("Stopping the %s", ec.name)
+			old.shutdown()
+		}
+
+		e.Lock()
+		if comp == nil {
+			delete(e.components, ec.name)
+		} else {
+			e.components[ec.name] = comp
+		}
+		e.Unlock()
+
+		if comp != nil {
+			comp.start()
+		}
+	}
+
+	e.config = c
+}
+
+// Stop stops all the components, the pipeline first, then DCGM
+func (e *Exporter) Stop() {
+	for i := len(exporterComponents) - 1; i >= 0; i-- {
+		name := exporterComponents[i].name
+		if comp := e.components[name]; comp != nil {
+			comp.shutdown()
+
+			e.Lock()
+			delete(e.components, name)
+			e.Unlock()
+		}
+	}
+
+	close(e.stop)
+	e.wg.Wait()
+
+	e.dcgmCleanup()
+}
+
+// broadcast sends the result of each collection to every output (e.g: the
+// HTTP server, the remote writer), an output that can't keep up is skipped.
+func (e *Exporter) broadcast() {
+	defer e.wg.Done()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case m := <-e.collections:
+			e.Lock()
+			e.last = m
+			for _, comp := range e.components {
+				if comp.metrics == nil {
+					continue
+				}
+
+				if len(comp.metrics) == cap(comp.metrics) {
+					logrus.Errorf("Channel is full skipping")
+					selfMetrics.CountDropped(comp.name)
+				} else {
+					comp.metrics <- m
+				}
+			}
+			e.Unlock()
+		}
+	}
+}
+
+// collect runs the current pipeline, in the scrape collect mode
+func (e *Exporter) collect() ([][]Metric, error) {
+	e.Lock()
+	pipeline := e.components["pipeline"]
+	e.Unlock()
+
+	if pipeline == nil || pipeline.collect == nil {
+		return nil, fmt.Errorf("The pipeline isn't running")
+	}
+
+	return pipeline.collect()
+}
+
+// reloadCounters reloads the counters file in the current pipeline
+func (e *Exporter) reloadCounters() error {
+	e.Lock()
+	pipeline := e.components["pipeline"]
+	e.Unlock()
+
+	if pipeline == nil || pipeline.reload == nil {
+		return fmt.Errorf("The pipeline isn't running")
+	}
+
+	return pipeline.reload()
+}
+
+func (e *Exporter) newPipeline(c *Config) (*component, error) {
+	pipeline, cleanup, err := NewMetricsPipeline(c)
+	if err != nil {
+		return nil, err
+	}
+
+	filename := c.CollectorsFile
+	scrape := c.CollectMode == ScrapeCollectMode
+
+	comp := &component{cleanup: cleanup, reload: pipeline.ReloadCounters}
+	if scrape {
+		comp.collect = pipeline.Collect
+	}
+
+	comp.run = func(stop chan interface{}, wg *sync.WaitGroup) {
+		wg.Add(1)
+		go watchCounters(filename, pipeline, stop, wg)
+
+		if scrape {
+			defer wg.Done()
+			<-stop
+			return
+		}
+
+		pipeline.Run([]chan [][]Metric{e.collections}, stop, wg)
+	}
+
+	return comp, nil
+}
+
+// watchCounters reloads the counters when the counters file changes
+func watchCounters(filename string, pipeline *MetricsPipeline, stop chan interface{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	changes := WatchFile(filename, configWatchInterval, stop)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-changes:
+			logrus.Infof("Counters file %s changed, reloading the counters", filename)
+			if err := pipeline.ReloadCounters(); err != nil {
+				logrus.Errorf("Failed to reload the counters, keeping the current ones: %v", err)
+			}
+		}
+	}
+}
+
+func (e *Exporter) newServer(c *Config) (*component, error) {
+	if c.NoHTTPServer {
+		return nil, nil
+	}
+
+	// The cache always collects from the current pipeline
+	var cache *MetricsCache
+	if c.CollectMode == ScrapeCollectMode {
+		cache = NewMetricsCache(e.collect, time.Duration(c.ScrapeMinInterval)*time.Millisecond)
+	}
+
+	ch := make(chan [][]Metric, 10)
+	server, cleanup, err := NewMetricsServer(c, ch, cache)
+	if err != nil {
+		return nil, err
+	}
+
+	// The reload endpoint is only served when enabled, it isn't authenticated
+	// without a web config file
+	if c.EnableCountersReload {
+		server.reloadCounters = e.reloadCounters
+	}
+
+	// A server on a new address fails the build instead of exiting once it
+	// runs. The running server holds its address until it stops.
+	if e.config == nil || e.config.NoHTTPServer || e.config.Address != c.Address {
+		if err := server.Listen(); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+
+	// A rebuilt server doesn't wait for the next collection
+	e.Lock()
+	server.updateMetrics(e.last)
+	e.Unlock()
+
+	return &component{run: server.Run, cleanup: cleanup, metrics: ch}, nil
+}
+
+func (e *Exporter) newRemoteWriter(c *Config) (*component, error) {
+	if c.RemoteWriteURL == "" {
+		return nil, nil
+	}
+
+	writer, err := NewRemoteWriter(c)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan [][]Metric, 10)
+	return &component{run: func(stop chan interface{}, wg *sync.WaitGroup) { writer.Run(ch, stop, wg) }, metrics: ch}, nil
+}
+
+func (e *Exporter) newOTLPExporter(c *Config) (*component, error) {
+	if c.OTLPEndpoint == "" {
+		return nil, nil
+	}
+
+	exporter, cleanup, err := NewOTLPExporter(c)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	ch := make(chan [][]Metric, 10)
+	return &component{run: func(stop chan interface{}, wg *sync.WaitGroup) { exporter.Run(ch, stop, wg) }, cleanup: cleanup, metrics: ch}, nil
+}
+
+func (e *Exporter) newInfluxDBWriter(c *Config) (*component, error) {
+	if c.InfluxDBURL == "" {
+		return nil, nil
+	}
+
+	writer, cleanup, err := NewInfluxDBWriter(c)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	ch := make(chan [][]Metric, 10)
+	return &component{run: func(stop chan interface{}, wg *sync.WaitGroup) { writer.Run(ch, stop, wg) }, cleanup: cleanup, metrics: ch}, nil
+}
+
+func (e *Exporter) newStatsDWriter(c *Config) (*component, error) {
+	if c.StatsDAddress == "" {
+		return nil, nil
+	}
+
+	writer, cleanup, err := NewStatsDWriter(c)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	ch := make(chan [][]Metric, 10)
+	return &component{run: func(stop chan interface{}, wg *sync.WaitGroup) { writer.Run(ch, stop, wg) }, cleanup: cleanup, metrics: ch}, nil
+}
+
+func (c *component) start() {
+	c.stop = make(chan interface{})
+	c.wg.Add(1)
+	go c.run(c.stop, &c.wg)
+}
+
+func (c *component) shutdown() {
+	close(c.stop)
+	if err := WaitWithTimeout(&c.wg, componentStopTimeout); err != nil {
+		logrus.Errorf("Failed to stop the %s: %v", c.name, err)
+	}
+
+	c.cleanup()
+}
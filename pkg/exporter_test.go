@@ -0,0 +1,220 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testExporterConfig(t *testing.T) *Config {
+	return &Config{
+		CollectorBackend: SyntheticBackend,
+		SyntheticGPUs:    1,
+		CollectorsFile:   writeTestFile(t, "DCGM_FI_DEV_GPU_TEMP, gauge, GPU temperature (in C).\n"),
+		Address:          "127.0.0.1:0",
+		CollectInterval:  10,
+		CollectMode:      IntervalCollectMode,
+		Devices:          DeviceOptions{true, []int{-1}, []int{-1}},
+		NoHostname:       true,
+	}
+}
+
+func TestExporterReload(t *testing.T) {
+	config := testExporterConfig(t)
+	e, err := StartExporter(config)
+	require.NoError(t, err)
+	defer func() { e.Stop() }()
+
+	running := func() map[string]*component {
+		e.Lock()
+		defer e.Unlock()
+
+		components := map[string]*component{}
+		for name, c := range e.components {
+			components[name] = c
+		}
+		return components
+	}
+
+	before := running()
+	require.Len(t, before, 2)
+	require.Eventually(t, func() bool {
+		e.Lock()
+		defer e.Unlock()
+		return e.last != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Only the pipeline is rebuilt
+	changed := *config
+	changed.SyntheticGPUs = 2
+	e, err = e.Reload(&changed)
+	require.NoError(t, err)
+
+	after := running()
+	require.Same(t, before["HTTP server"], after["HTTP server"])
+	require.NotSame(t, before["pipeline"], after["pipeline"])
+
+	// The running components read their configuration, it isn't changed in place
+	moved := *e.config
+	moved.Address = "localhost:0"
+	e, err = e.Reload(&moved)
+	require.NoError(t, err)
+	require.NotSame(t, after["HTTP server"], running()["HTTP server"])
+
+	// The health checks of the server depend on the collect interval
+	before = running()
+	slower := *e.config
+	slower.CollectInterval = 20
+	e, err = e.Reload(&slower)
+	require.NoError(t, err)
+	server := running()["HTTP server"]
+	require.NotSame(t, before["HTTP server"], server)
+
+	// A component that fails to build leaves the running ones unchanged
+	valid := e.config
+	invalid := *valid
+	invalid.SyntheticGPUs = 3
+	invalid.CollectorsFile = "/does/not/exist.csv"
+	e, err = e.Reload(&invalid)
+	require.NoError(t, err)
+	require.Same(t, valid, e.config)
+	require.Same(t, server, running()["HTTP server"])
+
+	// Outputs are added and removed
+	withStatsD := *valid
+	withStatsD.StatsDAddress = "127.0.0.1:8125"
+	withStatsD.StatsDFormat = DogStatsDFormat
+	e, err = e.Reload(&withStatsD)
+	require.NoError(t, err)
+	require.Contains(t, running(), "StatsD writer")
+
+	e, err = e.Reload(valid)
+	require.NoError(t, err)
+	require.NotContains(t, running(), "StatsD writer")
+}
+
+func TestExporterReloadAddressInUse(t *testing.T) {
+	config := testExporterConfig(t)
+	e, err := StartExporter(config)
+	require.NoError(t, err)
+	defer func() { e.Stop() }()
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer taken.Close()
+
+	// The server fails to build, the running one is kept
+	server := e.components["HTTP server"]
+	moved := *config
+	moved.Address = taken.Addr().String()
+	e, err = e.Reload(&moved)
+	require.NoError(t, err)
+	require.Same(t, config, e.config)
+	require.Same(t, server, e.components["HTTP server"])
+}
+
+func TestExporterReloadFileContent(t *testing.T) {
+	config := testExporterConfig(t)
+	config.RelabelConfigFile = writeTestFile(t, "relabel_configs: []\n")
+	e, err := StartExporter(config)
+	require.NoError(t, err)
+	defer func() { e.Stop() }()
+
+	pipeline := e.components["pipeline"]
+
+	same := *config
+	e, err = e.Reload(&same)
+	require.NoError(t, err)
+	require.Same(t, pipeline, e.components["pipeline"])
+
+	// The counters are reloaded by the running pipeline
+	require.NoError(t, ioutil.WriteFile(config.CollectorsFile, []byte("DCGM_FI_DEV_POWER_USAGE, gauge, Power draw (in W).\n"), 0644))
+	e, err = e.Reload(&same)
+	require.NoError(t, err)
+	require.Same(t, pipeline, e.components["pipeline"])
+	require.Eventually(t, func() bool {
+		e.Lock()
+		defer e.Unlock()
+		return len(e.last) > 0 && len(e.last[0]) > 0 && e.last[0][0].Counter.FieldName == "DCGM_FI_DEV_POWER_USAGE"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, ioutil.WriteFile(config.RelabelConfigFile, []byte("relabel_configs:\n- action: labeldrop\n  regex: Hostname\n"), 0644))
+	e, err = e.Reload(&same)
+	require.NoError(t, err)
+	require.NotSame(t, pipeline, e.components["pipeline"])
+}
+
+func TestExporterReloadDCGMSettings(t *testing.T) {
+	config := testExporterConfig(t)
+	e, err := StartExporter(config)
+	require.NoError(t, err)
+
+	// The exporter restarts with the running configuration if the new one fails
+	invalid := *config
+	invalid.RemoteHEInfo = "localhost:5555"
+	invalid.CollectorsFile = "/does/not/exist.csv"
+	e, err = e.Reload(&invalid)
+	require.NoError(t, err)
+	require.Same(t, config, e.config)
+	require.Contains(t, e.components, "pipeline")
+
+	// An error is returned if the running configuration fails too
+	require.NoError(t, os.Remove(config.CollectorsFile))
+	e, err = e.Reload(&invalid)
+	require.Error(t, err)
+	require.Nil(t, e)
+}
+
+func TestExporterReloadKubernetesSettings(t *testing.T) {
+	config := testExporterConfig(t)
+	e, err := StartExporter(config)
+	require.NoError(t, err)
+	defer func() { e.Stop() }()
+
+	pipeline := e.components["pipeline"]
+
+	changed := *config
+	changed.KubernetesPodLabels = []string{"app"}
+	e, err = e.Reload(&changed)
+	require.NoError(t, err)
+	require.NotSame(t, pipeline, e.components["pipeline"])
+
+	// The GPU resources are compared by value
+	withResources := changed
+	withResources.KubernetesGPUResources = []GPUResource{{Pattern: "nvidia.com/gpu", IDType: GPUUUIDResourceID}}
+	e, err = e.Reload(&withResources)
+	require.NoError(t, err)
+	pipeline = e.components["pipeline"]
+
+	same := withResources
+	same.KubernetesGPUResources = []GPUResource{{Pattern: "nvidia.com/gpu", IDType: GPUUUIDResourceID}}
+	e, err = e.Reload(&same)
+	require.NoError(t, err)
+	require.Same(t, pipeline, e.components["pipeline"])
+
+	other := withResources
+	other.KubernetesGPUResources = []GPUResource{{Pattern: "nvidia.com/mig-*", IDType: GPUUUIDResourceID}}
+	e, err = e.Reload(&other)
+	require.NoError(t, err)
+	require.NotSame(t, pipeline, e.components["pipeline"])
+}
@@ -19,7 +19,10 @@ package main
 import (
 	"fmt"
 	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
+	"github.com/sirupsen/logrus"
 	"os"
+	"reflect"
+	"time"
 )
 
 func NewDCGMCollector(c []Counter, config *Config) (*DCGMCollector, func(), error) {
@@ -28,44 +31,133 @@ func NewDCGMCollector(c []Counter, config *Config) (*DCGMCollector, func(), erro
 		return nil, func() {}, err
 	}
 
-	hostname := ""
-	if config.NoHostname == false {
-		hostname, err = os.Hostname()
-		if err != nil {
-			return nil, func() {}, err
-		}
+	hostname, err := GetHostname(config)
+	if err != nil {
+		return nil, func() {}, err
 	}
 
 	collector := &DCGMCollector{
-		Counters:        c,
-		DeviceFields:    NewDeviceFields(c),
 		UseOldNamespace: config.UseOldNamespace,
-		SysInfo:         sysInfo,
+		SystemInfo:      sysInfo,
 		Hostname:        hostname,
+		CollectInterval: time.Duration(config.CollectInterval) * time.Millisecond,
 	}
 
-	cleanups, err := SetupDcgmFieldsWatch(collector.DeviceFields, sysInfo)
+	group, cleanup, err := CreateGroupFromSystemInfo(sysInfo)
 	if err != nil {
 		return nil, func() {}, err
 	}
 
-	collector.Cleanups = cleanups
+	collector.Group = group
+	collector.Cleanups = []func(){cleanup}
+
+	if err := collector.watchCounters(c); err != nil {
+		collector.Cleanup()
+		return nil, func() {}, err
+	}
 
 	return collector, func() { collector.Cleanup() }, nil
 }
 
+// UpdateCounters replaces the watched fields, DCGM and the group of entities
+// are kept. The new fields are watched before the previous ones are released:
+// if a watch fails the current fields are kept.
+func (c *DCGMCollector) UpdateCounters(counters []Counter) error {
+	if reflect.DeepEqual(counters, c.Counters) {
+		return nil
+	}
+
+	previous := c.DeviceFields
+	fieldGroups := c.FieldGroups
+	distributionFields := c.DistributionFields
+
+	if err := c.watchCounters(counters); err != nil {
+		return err
+	}
+
+	if err := fieldWatches.Release(c.Group, previous); err != nil {
+		logrus.Errorf("Failed to unwatch the removed fields: %v", err)
+	}
+
+	destroyFieldGroups(fieldGroups, distributionFields)
+
+	return nil
+}
+
+// watchCounters watches the fields of the counters on the group of entities,
+// the collector is only updated once they are all watched.
+func (c *DCGMCollector) watchCounters(counters []Counter) error {
+	fieldGroups, err := WatchFieldGroups(c.Group, NewFieldWatches(counters, c.CollectInterval))
+	if err != nil {
+		return err
+	}
+
+	var distributionFields *dcgm.FieldHandle
+	if fields := NewDistributionFields(counters); len(fields) > 0 {
+		fieldGroup, _, err := NewFieldGroup(fields)
+		if err != nil {
+			destroyFieldGroups(fieldGroups, nil)
+			return err
+		}
+
+		distributionFields = &fieldGroup
+	}
+
+	c.Counters = counters
+	c.DeviceFields = NewDeviceFields(counters)
+	fieldWatches.Watch(c.DeviceFields)
+	c.FieldGroups = fieldGroups
+	c.DistributionFields = distributionFields
+
+	// The buckets and quantiles may have changed, the aggregation starts over
+	c.Distributions = nil
+	if distributionFields != nil {
+		c.Distributions = NewDistributions()
+	}
+
+	return nil
+}
+
+func destroyFieldGroups(fieldGroups []dcgm.FieldHandle, distributionFields *dcgm.FieldHandle) {
+	for _, f := range fieldGroups {
+		dcgm.FieldGroupDestroy(f)
+	}
+
+	if distributionFields != nil {
+		dcgm.FieldGroupDestroy(*distributionFields)
+	}
+}
+
+// Cleanup unwatches the fields no other collector watches and destroys the
+// field groups, then the group
 func (c *DCGMCollector) Cleanup() {
+	if err := fieldWatches.Release(c.Group, c.DeviceFields); err != nil {
+		logrus.Errorf("Failed to unwatch the fields: %v", err)
+	}
+
+	destroyFieldGroups(c.FieldGroups, c.DistributionFields)
+
 	for _, c := range c.Cleanups {
 		c()
 	}
 }
 
+func (c *DCGMCollector) SysInfo() SystemInfo {
+	return c.SystemInfo
+}
+
 func (c *DCGMCollector) GetMetrics() ([][]Metric, error) {
-	monitoringInfo := GetMonitoredEntities(c.SysInfo)
+	monitoringInfo := GetMonitoredEntities(c.SystemInfo)
 	count := len(monitoringInfo)
 
 	metrics := make([][]Metric, count)
 
+	if c.DistributionFields != nil {
+		if err := c.observeDistributions(); err != nil {
+			return nil, err
+		}
+	}
+
 	for i, mi := range monitoringInfo {
 		vals, err := dcgm.EntityGetLatestValues(mi.Entity.EntityGroupId, mi.Entity.EntityId, c.DeviceFields)
 		if err != nil {
@@ -74,11 +166,52 @@ func (c *DCGMCollector) GetMetrics() ([][]Metric, error) {
 
 		// InstanceInfo will be nil for GPUs
 		metrics[i] = ToMetric(vals, c.Counters, mi.DeviceInfo, mi.InstanceInfo, c.UseOldNamespace, c.Hostname)
+
+		if c.Distributions != nil {
+			for j := range metrics[i] {
+				if isDistribution(metrics[i][j].Counter) {
+					metrics[i][j].Distribution = c.Distributions.Collect(mi.Entity, metrics[i][j].Counter)
+				}
+			}
+		}
 	}
 
 	return metrics, nil
 }
 
+// Aggregates all the samples DCGM took since the previous collection
+func (c *DCGMCollector) observeDistributions() error {
+	values, next, err := dcgm.GetValuesSince(c.Group, *c.DistributionFields, c.since)
+	if err != nil {
+		return err
+	}
+	c.since = next
+
+	counters := make(map[dcgm.Short]*Counter)
+	for i := range c.Counters {
+		if isDistribution(&c.Counters[i]) {
+			counters[c.Counters[i].FieldID] = &c.Counters[i]
+		}
+	}
+
+	for _, val := range values {
+		counter, ok := counters[dcgm.Short(val.FieldId)]
+		if !ok {
+			continue
+		}
+
+		v, ok := distributionValue(val)
+		if !ok {
+			continue
+		}
+
+		entity := dcgm.GroupEntityPair{EntityGroupId: val.EntityGroupId, EntityId: val.EntityId}
+		c.Distributions.Observe(entity, counter, v)
+	}
+
+	return nil
+}
+
 func ToMetric(values []dcgm.FieldValue_v1, c []Counter, d dcgm.Device, instanceInfo *GpuInstanceInfo, useOld bool, hostname string) []Metric {
 	var metrics []Metric
 
@@ -88,36 +221,54 @@ func ToMetric(values []dcgm.FieldValue_v1, c []Counter, d dcgm.Device, instanceI
 		if v == SkipDCGMValue {
 			continue
 		}
-		uuid := "UUID"
-		if useOld {
-			uuid = "uuid"
-		}
-		m := Metric{
-			Counter: &c[i],
-			Value:   v,
-
-			UUID:         uuid,
-			GPU:          fmt.Sprintf("%d", d.GPU),
-			GPUUUID:      d.UUID,
-			GPUDevice:    fmt.Sprintf("nvidia%d", d.GPU),
-			GPUModelName: d.Identifiers.Model,
-			Hostname:     hostname,
-
-			Attributes: map[string]string{},
-		}
-		if instanceInfo != nil {
-			m.MigProfile = instanceInfo.ProfileName
-			m.GPUInstanceID = fmt.Sprintf("%d", instanceInfo.Info.NvmlInstanceId)
-		} else {
-			m.MigProfile = ""
-			m.GPUInstanceID = ""
-		}
+
+		m := NewMetric(&c[i], v, d, instanceInfo, useOld, hostname)
+		// DCGM timestamps are in microseconds since the epoch
+		m.Timestamp = time.Unix(0, val.Ts*int64(time.Microsecond))
+
 		metrics = append(metrics, m)
 	}
 
 	return metrics
 }
 
+func NewMetric(c *Counter, value string, d dcgm.Device, instanceInfo *GpuInstanceInfo, useOld bool, hostname string) Metric {
+	uuid := "UUID"
+	if useOld {
+		uuid = "uuid"
+	}
+	m := Metric{
+		Counter: c,
+		Value:   value,
+
+		UUID:         uuid,
+		GPU:          fmt.Sprintf("%d", d.GPU),
+		GPUUUID:      d.UUID,
+		GPUDevice:    fmt.Sprintf("nvidia%d", d.GPU),
+		GPUModelName: d.Identifiers.Model,
+		Hostname:     hostname,
+
+		Attributes: map[string]string{},
+	}
+	if instanceInfo != nil {
+		m.MigProfile = instanceInfo.ProfileName
+		m.GPUInstanceID = fmt.Sprintf("%d", instanceInfo.Info.NvmlInstanceId)
+	} else {
+		m.MigProfile = ""
+		m.GPUInstanceID = ""
+	}
+
+	return m
+}
+
+func GetHostname(config *Config) (string, error) {
+	if config.NoHostname {
+		return "", nil
+	}
+
+	return os.Hostname()
+}
+
 func ToString(value dcgm.FieldValue_v1) string {
 	switch v := value.Int64(); v {
 	case dcgm.DCGM_FT_INT32_BLANK:
@@ -25,9 +25,9 @@ import (
 )
 
 var sampleCounters = []Counter{
-	{dcgm.DCGM_FI_DEV_GPU_TEMP, "DCGM_FI_DEV_GPU_TEMP", "gauge", "Temperature Help info"},
-	{dcgm.DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION, "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION", "gauge", "Energy help info"},
-	{dcgm.DCGM_FI_DEV_POWER_USAGE, "DCGM_FI_DEV_POWER_USAGE", "gauge", "Power help info"},
+	{FieldID: dcgm.DCGM_FI_DEV_GPU_TEMP, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge", Help: "Temperature Help info"},
+	{FieldID: dcgm.DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION, FieldName: "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION", PromType: "gauge", Help: "Energy help info"},
+	{FieldID: dcgm.DCGM_FI_DEV_POWER_USAGE, FieldName: "DCGM_FI_DEV_POWER_USAGE", PromType: "gauge", Help: "Power help info"},
 }
 
 func TestDCGMCollector(t *testing.T) {
@@ -57,7 +57,7 @@ func testDCGMCollector(t *testing.T, counters []Counter) (*DCGMCollector, func()
 
 	for i, dev := range out {
 		for j, metric := range dev {
-			require.Equal(t, metric.Name, counters[j].FieldName)
+			require.Equal(t, metric.Counter.FieldName, counters[j].FieldName)
 			require.Equal(t, metric.GPU, fmt.Sprintf("%d", i))
 
 			require.NotEmpty(t, metric.Value)
@@ -67,3 +67,21 @@ func testDCGMCollector(t *testing.T, counters []Counter) (*DCGMCollector, func()
 
 	return c, cleanup
 }
+
+func TestDCGMCollectorUpdateCounters(t *testing.T) {
+	cleanup, err := dcgm.Init(dcgm.Embedded)
+	require.NoError(t, err)
+	defer cleanup()
+
+	c, cleanup := testDCGMCollector(t, sampleCounters[:1])
+	defer cleanup()
+
+	require.NoError(t, c.UpdateCounters(sampleCounters[1:]))
+
+	out, err := c.GetMetrics()
+	require.NoError(t, err)
+	require.Greater(t, len(out), 0)
+	for _, metric := range out[0] {
+		require.NotEqual(t, sampleCounters[0].FieldName, metric.Counter.FieldName)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// A collection running or missing for wedgedIntervals collect intervals means
+// the exporter is wedged, with a minimum for the short intervals. The metrics
+// are stale when they weren't collected for staleIntervals.
+const (
+	wedgedIntervals = 10
+	minWedgedAfter  = time.Minute
+	staleIntervals  = 3
+)
+
+const (
+	healthCheckOK    = "ok"
+	healthCheckError = "failed"
+)
+
+func NewHealthConfig(c *Config) HealthConfig {
+	interval := time.Duration(c.CollectInterval) * time.Millisecond
+
+	wedgedAfter := wedgedIntervals * interval
+	if wedgedAfter < minWedgedAfter {
+		wedgedAfter = minWedgedAfter
+	}
+
+	return HealthConfig{
+		CollectMode: c.CollectMode,
+		StaleAfter:  staleIntervals * interval,
+		WedgedAfter: wedgedAfter,
+	}
+}
+
+// Livez fails when the collection is wedged: a collection has been running
+// for too long, or in the interval collect mode none started for too long.
+// Restarting the exporter is expected to fix it.
+func (s *MetricsServer) Livez(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, s.livenessChecks())
+}
+
+// Readyz fails when the metrics can't be served: the last successful
+// collection is too old, or DCGM can't be reached. The liveness checks are
+// included.
+func (s *MetricsServer) Readyz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, append(s.livenessChecks(), s.readinessChecks()...))
+}
+
+func (s *MetricsServer) livenessChecks() []HealthCheck {
+	times, now := s.self.Collections()
+
+	var err error
+	if times.Started.After(times.Finished) && now.Sub(times.Started) > s.health.WedgedAfter {
+		err = fmt.Errorf("A collection has been running for %s", roundDuration(now.Sub(times.Started)))
+	} else if s.health.CollectMode == IntervalCollectMode {
+		last := times.Started
+		if last.IsZero() {
+			last = times.Exporter
+		}
+
+		if now.Sub(last) > s.health.WedgedAfter {
+			err = fmt.Errorf("No collection started for %s", roundDuration(now.Sub(last)))
+		}
+	}
+
+	return []HealthCheck{newHealthCheck("collection", err)}
+}
+
+func (s *MetricsServer) readinessChecks() []HealthCheck {
+	var err error
+	if s.health.CollectMode == ScrapeCollectMode {
+		// The collection is cached for the scrape min interval
+		_, err = s.collectMetrics()
+	} else {
+		times, now := s.self.Collections()
+		if times.Succeeded.IsZero() {
+			err = fmt.Errorf("No successful collection yet")
+		} else if now.Sub(times.Succeeded) > s.health.StaleAfter {
+			err = fmt.Errorf("The last successful collection was %s ago, expected every %s",
+				roundDuration(now.Sub(times.Succeeded)), roundDuration(s.health.StaleAfter/staleIntervals))
+		}
+	}
+
+	checks := []HealthCheck{newHealthCheck("freshness", err)}
+
+	if used, err := s.self.PingDCGM(); used {
+		if err != nil {
+			err = fmt.Errorf("Failed to reach DCGM: %v", err)
+		}
+		checks = append(checks, newHealthCheck("dcgm", err))
+	}
+
+	return checks
+}
+
+func newHealthCheck(name string, err error) HealthCheck {
+	if err != nil {
+		return HealthCheck{Name: name, Status: healthCheckError, Error: err.Error()}
+	}
+
+	return HealthCheck{Name: name, Status: healthCheckOK}
+}
+
+func writeHealth(w http.ResponseWriter, checks []HealthCheck) {
+	response := HealthResponse{Status: healthCheckOK, Checks: checks}
+	status := http.StatusOK
+	for _, c := range checks {
+		if c.Status != healthCheckOK {
+			response.Status = healthCheckError
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	// The probes aren't cached, their result may change with every request
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, response)
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	if d < time.Second {
+		return d.Round(time.Millisecond)
+	}
+
+	return d.Round(time.Second)
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func getHealth(t *testing.T, handler http.HandlerFunc) (int, HealthResponse) {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, jsonContentType, w.Header().Get("Content-Type"))
+
+	var response HealthResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+	return w.Code, response
+}
+
+func requireCheck(t *testing.T, response HealthResponse, name, status string) {
+	for _, c := range response.Checks {
+		if c.Name == name {
+			require.Equal(t, status, c.Status, "%+v", c)
+			if status == healthCheckOK {
+				require.Empty(t, c.Error)
+			} else {
+				require.NotEmpty(t, c.Error)
+			}
+			return
+		}
+	}
+
+	require.Failf(t, "Missing check", "%s in %+v", name, response)
+}
+
+func TestHealthIntervalCollectMode(t *testing.T) {
+	s, cleanup, err := NewMetricsServer(&Config{CollectInterval: 10000, CollectMode: IntervalCollectMode}, make(chan [][]Metric), nil)
+	require.NoError(t, err)
+	defer cleanup()
+
+	require.Equal(t, 30*time.Second, s.health.StaleAfter)
+	require.Equal(t, 100*time.Second, s.health.WedgedAfter)
+
+	now := time.Unix(1000, 0)
+	s.self = NewSelfMetrics()
+	s.self.collections.Exporter = now
+	s.self.now = func() time.Time { return now }
+
+	// Alive but not ready before the first collection
+	status, response := getHealth(t, s.Livez)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, healthCheckOK, response.Status)
+
+	status, response = getHealth(t, s.Readyz)
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, healthCheckError, response.Status)
+	requireCheck(t, response, "collection", healthCheckOK)
+	requireCheck(t, response, "freshness", healthCheckError)
+
+	s.self.CollectionStarted()
+	now = now.Add(time.Second)
+	s.self.CollectionFinished(nil)
+
+	status, _ = getHealth(t, s.Readyz)
+	require.Equal(t, http.StatusOK, status)
+
+	// Failed collections are stale after 3 intervals
+	now = now.Add(25 * time.Second)
+	s.self.CollectionStarted()
+	s.self.CollectionFinished(fmt.Errorf("DCGM error"))
+	now = now.Add(10 * time.Second)
+
+	status, response = getHealth(t, s.Readyz)
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	requireCheck(t, response, "freshness", healthCheckError)
+
+	status, _ = getHealth(t, s.Livez)
+	require.Equal(t, http.StatusOK, status)
+
+	// A collection that never returns is wedged
+	s.self.CollectionStarted()
+	now = now.Add(101 * time.Second)
+
+	status, response = getHealth(t, s.Livez)
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	requireCheck(t, response, "collection", healthCheckError)
+	require.Contains(t, response.Checks[0].Error, "running for 1m41s")
+
+	// So are collections that stopped starting
+	s.self.CollectionFinished(nil)
+	status, response = getHealth(t, s.Livez)
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Contains(t, response.Checks[0].Error, "No collection started for 1m41s")
+
+	s.self.CollectionStarted()
+	status, _ = getHealth(t, s.Livez)
+	require.Equal(t, http.StatusOK, status)
+}
+
+func TestHealthDCGM(t *testing.T) {
+	s, cleanup, err := NewMetricsServer(&Config{CollectInterval: 10000, CollectMode: IntervalCollectMode}, make(chan [][]Metric), nil)
+	require.NoError(t, err)
+	defer cleanup()
+
+	s.self = NewSelfMetrics()
+	s.self.CollectionFinished(nil)
+
+	// The DCGM check is only run with the DCGM backend
+	_, response := getHealth(t, s.Readyz)
+	require.Len(t, response.Checks, 2)
+
+	var pingErr error
+	s.self.SetDCGM(nil, func() error { return pingErr }, 0)
+
+	status, response := getHealth(t, s.Readyz)
+	require.Equal(t, http.StatusOK, status)
+	requireCheck(t, response, "dcgm", healthCheckOK)
+
+	pingErr = fmt.Errorf("Connection refused")
+	status, response = getHealth(t, s.Readyz)
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	requireCheck(t, response, "dcgm", healthCheckError)
+
+	// A lost hostengine doesn't restart the exporter
+	status, _ = getHealth(t, s.Livez)
+	require.Equal(t, http.StatusOK, status)
+}
+
+func TestHealthScrapeCollectMode(t *testing.T) {
+	var collectErr error
+	cache := NewMetricsCache(func() ([][]Metric, error) { return sampleMetrics(), collectErr }, 0)
+
+	s, cleanup, err := NewMetricsServer(&Config{CollectInterval: 10000, CollectMode: ScrapeCollectMode}, nil, cache)
+	require.NoError(t, err)
+	defer cleanup()
+
+	// No collection is expected until the metrics are requested
+	now := time.Unix(1000, 0)
+	s.self = NewSelfMetrics()
+	s.self.collections.Exporter = now
+	s.self.now = func() time.Time { return now }
+	now = now.Add(time.Hour)
+
+	status, _ := getHealth(t, s.Livez)
+	require.Equal(t, http.StatusOK, status)
+
+	status, _ = getHealth(t, s.Readyz)
+	require.Equal(t, http.StatusOK, status)
+
+	collectErr = fmt.Errorf("DCGM error")
+	status, response := getHealth(t, s.Readyz)
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	requireCheck(t, response, "freshness", healthCheckError)
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	influxDBTimeout = 30 * time.Second
+
+	// Same default as the Telegraf InfluxDB output, to stay below the MTU
+	influxDBUDPPayloadSize = 512
+)
+
+var (
+	influxDBMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxDBTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	influxDBStringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+func NewInfluxDBWriter(c *Config) (*InfluxDBWriter, func(), error) {
+	u, err := url.Parse(c.InfluxDBURL)
+	if err != nil {
+		return nil, func() {}, err
+	}
+
+	w := &InfluxDBWriter{URL: c.InfluxDBURL}
+
+	switch u.Scheme {
+	case "http", "https":
+		w.Client = &http.Client{Timeout: influxDBTimeout}
+		if c.InfluxDBTokenFile != "" {
+			if w.Token, err = readSecretFile(c.InfluxDBTokenFile); err != nil {
+				return nil, func() {}, err
+			}
+		}
+
+		return w, func() {}, nil
+	case "udp":
+		if c.InfluxDBTokenFile != "" {
+			return nil, func() {}, fmt.Errorf("The InfluxDB UDP protocol doesn't support authentication")
+		}
+
+		if w.conn, err = net.Dial("udp", u.Host); err != nil {
+			return nil, func() {}, err
+		}
+
+		return w, func() { w.conn.Close() }, nil
+	default:
+		return nil, func() {}, fmt.Errorf("Invalid InfluxDB URL '%s', expected an http://, https:// or udp:// URL", c.InfluxDBURL)
+	}
+}
+
+// Run writes every collection received, failed writes are logged and
+// dropped.
+func (w *InfluxDBWriter) Run(in chan [][]Metric, stop chan interface{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	logrus.Infof("Writing metrics to InfluxDB at %s", w.URL)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case m := <-in:
+			if err := w.Write(EncodeLineProtocol(m, time.Now())); err != nil {
+				logrus.Errorf("Failed to write metrics to InfluxDB: %v", err)
+			}
+		}
+	}
+}
+
+func (w *InfluxDBWriter) Write(lines []string) error {
+	if w.conn != nil {
+		return writeDatagrams(w.conn, lines, influxDBUDPPayloadSize)
+	}
+
+	var body bytes.Buffer
+	for _, l := range lines {
+		body.WriteString(l)
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest("POST", w.URL, &body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "dcgm-exporter/"+BuildVersion)
+	if w.Token != "" {
+		req.Header.Set("Authorization", "Token "+w.Token)
+	}
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	return fmt.Errorf("InfluxDB returned HTTP status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// EncodeLineProtocol encodes the metrics as InfluxDB line protocol, one line
+// per Prometheus sample: the measurement is the name of the sample, the tags
+// are the labels of the metric and the float "value" field is the value of the
+// sample. Info metrics have a string "value" field instead.
+//
+// Samples without a numerical value, including NaN and infinite values that
+// InfluxDB rejects, are skipped.
+func EncodeLineProtocol(metrics [][]Metric, ts time.Time) []string {
+	var lines []string
+	var line strings.Builder
+	timestamp := strconv.FormatInt(ts.UnixNano(), 10)
+
+	for _, device := range metrics {
+		for _, m := range device {
+			labels := MetricLabels(m)
+			delete(labels, metricNameLabel)
+
+			write := func(name, field string) {
+				line.Reset()
+				line.WriteString(influxDBMeasurementEscaper.Replace(name))
+				for _, l := range sortedLabels(labels) {
+					line.WriteByte(',')
+					line.WriteString(influxDBTagEscaper.Replace(l[0]))
+					line.WriteByte('=')
+					line.WriteString(influxDBTagEscaper.Replace(l[1]))
+				}
+				line.WriteString(" value=")
+				line.WriteString(field)
+				line.WriteByte(' ')
+				line.WriteString(timestamp)
+
+				lines = append(lines, line.String())
+			}
+
+			if m.Counter.PromType == "info" {
+				write(m.Counter.FieldName+"_info", `"`+influxDBStringEscaper.Replace(m.Value)+`"`)
+				continue
+			}
+
+			MetricSamples(m.Counter.FieldName, m, func(name, labelName, labelValue, value string) {
+				v, err := strconv.ParseFloat(value, 64)
+				if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+					return
+				}
+
+				if labelName != "" {
+					labels[labelName] = labelValue
+					defer delete(labels, labelName)
+				}
+
+				write(name, formatFloat(v))
+			})
+		}
+	}
+
+	return lines
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeLineProtocol(t *testing.T) {
+	histogram := Counter{FieldID: dcgm.DCGM_FI_PROF_SM_OCCUPANCY, FieldName: "DCGM_FI_PROF_SM_OCCUPANCY", PromType: "histogram"}
+	metrics := sampleMetrics()
+	metrics[0][0].Attributes["pod"] = "my pod,1"
+	metrics[0][1].Value = "NaN"
+	metrics[0][2].Value = `"460"`
+	metrics[0] = append(metrics[0], Metric{
+		Counter:      &histogram,
+		GPU:          "0",
+		Distribution: &Distribution{Buckets: []Bucket{{0.5, 1}}, Sum: 0.7, Count: 2},
+	})
+
+	lines := EncodeLineProtocol(metrics, time.Unix(1600000000, 0))
+	require.Equal(t, []string{
+		`DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION,UUID=GPU-0000,device=nvidia0,gpu=0,modelName=Tesla\ T4,pod=my\ pod\,1 value=1000 1600000000000000000`,
+		`DCGM_FI_DRIVER_VERSION_info,UUID=GPU-0000,device=nvidia0,gpu=0,modelName=Tesla\ T4 value="\"460\"" 1600000000000000000`,
+		`DCGM_FI_PROF_SM_OCCUPANCY_bucket,gpu=0,le=0.5 value=1 1600000000000000000`,
+		`DCGM_FI_PROF_SM_OCCUPANCY_bucket,gpu=0,le=+Inf value=2 1600000000000000000`,
+		`DCGM_FI_PROF_SM_OCCUPANCY_sum,gpu=0 value=0.7 1600000000000000000`,
+		`DCGM_FI_PROF_SM_OCCUPANCY_count,gpu=0 value=2 1600000000000000000`,
+	}, lines)
+}
+
+func TestInfluxDBWriterHTTP(t *testing.T) {
+	var body, authorization string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		body = string(b)
+		authorization = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	w, cleanup, err := NewInfluxDBWriter(&Config{InfluxDBURL: receiver.URL + "/api/v2/write?org=org&bucket=gpus", InfluxDBTokenFile: writeTestFile(t, "token\n")})
+	defer cleanup()
+	require.NoError(t, err)
+
+	require.NoError(t, w.Write([]string{"a value=1 1", "b value=2 1"}))
+	require.Equal(t, "a value=1 1\nb value=2 1\n", body)
+	require.Equal(t, "Token token", authorization)
+}
+
+func TestInfluxDBWriterUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	w, cleanup, err := NewInfluxDBWriter(&Config{InfluxDBURL: "udp://" + conn.LocalAddr().String()})
+	defer cleanup()
+	require.NoError(t, err)
+
+	// The lines are split in datagrams of at most 512 bytes
+	long := "a value=1 " + strings.Repeat("1", 300)
+	require.NoError(t, w.Write([]string{long, long, "b value=2 1"}))
+
+	var packets []string
+	buf := make([]byte, 2048)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		packets = append(packets, string(buf[:n]))
+	}
+
+	require.Equal(t, []string{long, long + "\nb value=2 1"}, packets)
+}
+
+func TestNewInfluxDBWriterErrors(t *testing.T) {
+	_, _, err := NewInfluxDBWriter(&Config{InfluxDBURL: "tcp://localhost:8086"})
+	require.Error(t, err)
+
+	_, _, err = NewInfluxDBWriter(&Config{InfluxDBURL: "udp://localhost:8089", InfluxDBTokenFile: writeTestFile(t, "token")})
+	require.Error(t, err)
+
+	_, _, err = NewInfluxDBWriter(&Config{InfluxDBURL: "http://localhost:8086/write", InfluxDBTokenFile: "/does/not/exist"})
+	require.Error(t, err)
+}
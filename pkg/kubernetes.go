@@ -21,12 +21,26 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
-	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1alpha1"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+	podresourcesv1alpha1 "k8s.io/kubelet/pkg/apis/podresources/v1alpha1"
+)
+
+// The versions of the kubelet pod-resources API
+const (
+	podResourcesV1       = "v1"
+	podResourcesV1alpha1 = "v1alpha1"
 )
 
 var (
@@ -34,139 +48,603 @@ var (
 	socketPath = socketDir + "/kubelet.sock"
 
 	connectionTimeout = 10 * time.Second
+
+	// The connection to the kubelet is reestablished with an exponential backoff
+	reconnectBackoff = backoff.Config{
+		BaseDelay:  time.Second,
+		Multiplier: 1.6,
+		Jitter:     0.2,
+		MaxDelay:   30 * time.Second,
+	}
+
+	allocatableCounter = Counter{
+		FieldName: "DCGM_EXP_KUBERNETES_ALLOCATABLE",
+		PromType:  "gauge",
+		Help:      "Whether the kubelet can allocate the GPU or GPU instance to the pods (1 if allocatable).",
+	}
+	allocatedCounter = Counter{
+		FieldName: "DCGM_EXP_KUBERNETES_ALLOCATED",
+		PromType:  "gauge",
+		Help:      "Whether the GPU or GPU instance is allocated to a pod (1 if allocated).",
+	}
+	podsCounter = Counter{
+		FieldName: "DCGM_EXP_KUBERNETES_PODS",
+		PromType:  "gauge",
+		Help:      "Number of pods the GPU or GPU instance is assigned to (more than 1 if it's shared).",
+	}
 )
 
-func NewPodMapper(c *Config) *PodMapper {
+// NewPodMapper keeps a connection to the kubelet and refreshes the mapping of
+// the devices to the pods every KubernetesRefreshInterval in the background,
+// the collections only read the last mapping.
+func NewPodMapper(c *Config, sysInfo SystemInfo) (*PodMapper, func(), error) {
 	logrus.Infof("Kubernetes metrics collection enabled!")
 
-	return &PodMapper{
-		Config: c,
+	if c.KubernetesRefreshInterval <= 0 {
+		return nil, func() {}, fmt.Errorf("The kubernetes refresh interval must be positive, got %d", c.KubernetesRefreshInterval)
+	}
+
+	conn, err := connectToServer(socketPath)
+	if err != nil {
+		return nil, func() {}, err
+	}
+
+	var metadata *PodMetadata
+	metadataCleanup := func() {}
+	if metadataEnabled(c) {
+		metadata, metadataCleanup, err = NewPodMetadata(c)
+		if err != nil {
+			conn.Close()
+			return nil, func() {}, err
+		}
+	}
+
+	p := &PodMapper{
+		Config:      c,
+		socket:      socketPath,
+		conn:        conn,
+		sysInfo:     sysInfo,
+		metadata:    metadata,
+		api:         podResourcesV1,
+		deviceToPod: map[string][]PodInfo{},
+		refreshedAt: time.Now(),
 	}
+
+	// The first collections have the pod attributes
+	stopRefresh := RefreshEvery(time.Duration(c.KubernetesRefreshInterval)*time.Millisecond, p.Refresh)
+
+	return p, func() {
+		stopRefresh()
+		metadataCleanup()
+		conn.Close()
+	}, nil
 }
 
 func (p *PodMapper) Name() string {
 	return "podMapper"
 }
 
-func (p *PodMapper) Process(metrics [][]Metric, sysInfo SystemInfo) error {
-	_, err := os.Stat(socketPath)
-	if os.IsNotExist(err) {
-		logrus.Infof("No Kubelet socket, ignoring")
+// Refresh lists the pods and replaces the mapping, the last mapping is kept if
+// the kubelet can't be reached.
+func (p *PodMapper) Refresh() {
+	p.refreshLock.Lock()
+	defer p.refreshLock.Unlock()
+
+	deviceToPod := map[string][]PodInfo{}
+	var allocatable map[string]bool
+
+	if _, err := os.Stat(p.socket); os.IsNotExist(err) {
+		logrus.Debugf("No Kubelet socket, ignoring")
+	} else {
+		pods, err := p.listPods()
+		if err != nil {
+			if p.conn.GetState() != connectivity.Ready {
+				selfMetrics.CountPodMappingFailure("connect")
+			} else {
+				selfMetrics.CountPodMappingFailure("list")
+			}
+
+			p.refreshFailed(err)
+			return
+		}
+
+		deviceToPod = ToDeviceToPod(pods, p.Config, p.sysInfo)
+		allocatable = p.getAllocatable()
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.failing {
+		logrus.Infof("Listed the pods from the kubelet again")
+	}
+	p.failing = false
+	p.deviceToPod = deviceToPod
+	p.allocatable = allocatable
+	p.refreshedAt = time.Now()
+}
+
+// listPods uses the v1 API, and v1alpha1 with the kubelets that don't serve it
+// (before Kubernetes 1.20). The version is checked again if v1alpha1 goes away.
+func (p *PodMapper) listPods() (*podresourcesapi.ListPodResourcesResponse, error) {
+	if p.api == podResourcesV1 {
+		pods, err := ListPods(p.conn)
+		if status.Code(err) != codes.Unimplemented {
+			return pods, err
+		}
+
+		logrus.Infof("The kubelet doesn't serve the pod-resources %s API, falling back to %s", podResourcesV1, podResourcesV1alpha1)
+		p.api = podResourcesV1alpha1
+	}
+
+	pods, err := ListPodsV1alpha1(p.conn)
+	if status.Code(err) == codes.Unimplemented {
+		p.api = podResourcesV1
+	}
+
+	return pods, err
+}
+
+// getAllocatable returns the devices that the kubelet can allocate, nil if it
+// doesn't report them: with v1alpha1, or before Kubernetes 1.23 without the
+// KubeletPodResourcesGetAllocatable feature gate.
+func (p *PodMapper) getAllocatable() map[string]bool {
+	if p.api != podResourcesV1 {
 		return nil
 	}
 
-	// TODO: This needs to be moved out of the critical path.
-	c, cleanup, err := connectToServer(socketPath)
+	resp, err := GetAllocatableResources(p.conn)
 	if err != nil {
-		return err
+		if !p.noAllocatable {
+			logrus.Infof("The kubelet doesn't report the allocatable devices, %s isn't exported: %v", allocatableCounter.FieldName, err)
+		}
+		p.noAllocatable = true
+		return nil
 	}
-	defer cleanup()
+	p.noAllocatable = false
 
-	pods, err := ListPods(c)
-	if err != nil {
-		return err
+	allocatable := map[string]bool{}
+	for _, device := range resp.GetDevices() {
+		for _, id := range DeviceIDs(device, p.Config, p.sysInfo) {
+			allocatable[id] = true
+		}
+	}
+
+	return allocatable
+}
+
+// refreshFailed logs the first failure, the kubelet may stay unavailable for a
+// while. The failures after staleIntervals are counted as stale.
+func (p *PodMapper) refreshFailed(err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if time.Since(p.refreshedAt) > staleIntervals*time.Duration(p.Config.KubernetesRefreshInterval)*time.Millisecond {
+		selfMetrics.CountPodMappingFailure("stale")
+	}
+
+	if p.failing {
+		logrus.Debugf("Failed to list the pods from the kubelet: %v", err)
+	} else {
+		logrus.Errorf("Failed to list the pods from the kubelet, keeping the current mapping: %v", err)
+	}
+	p.failing = true
+}
+
+// mapping returns the last mapping of the devices to the pods, the allocatable
+// devices (nil if unknown), and whether it wasn't refreshed for staleIntervals
+func (p *PodMapper) mapping() (map[string][]PodInfo, map[string]bool, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	age := time.Since(p.refreshedAt)
+	stale := age > staleIntervals*time.Duration(p.Config.KubernetesRefreshInterval)*time.Millisecond
+	if stale && !p.stale {
+		logrus.Warningf("The pods weren't listed for %s, the mapping may be out of date", roundDuration(age))
 	}
+	p.stale = stale
+
+	return p.deviceToPod, p.allocatable, stale
+}
+
+// Process adds the pod attributes from the last mapping, and whether each GPU
+// or GPU instance is allocatable and allocated. The metrics are still exported
+// when the mapping is stale. The labels, annotations and owner of the pods and
+// the labels of the node are added when they are looked up from the API server.
+//
+// The metrics of the devices shared by several pods get the pods joined in
+// their labels, or are repeated for each pod in the series mode.
+func (p *PodMapper) Process(metrics [][]Metric, sysInfo SystemInfo) error {
+	deviceToPod, allocatable, _ := p.mapping()
 
-	deviceToPod := ToDeviceToPod(pods, sysInfo)
+	var nodeAttributes map[string]string
+	if p.metadata != nil {
+		nodeAttributes = p.metadata.NodeAttributes()
+	}
 
-	// Note: for loop are copies the value, if we want to change the value
-	// and not the copy, we need to use the indexes
 	for i, device := range metrics {
-		for j, val := range device {
-			deviceId, err := val.getIDOfType(p.Config.KubernetesGPUIdType)
-			if err != nil {
-				return err
+		if len(device) == 0 {
+			continue
+		}
+
+		// The metrics of a device all have its ID
+		deviceId, err := device[0].getIDOfType(p.Config.KubernetesGPUIdType)
+		if err != nil {
+			return err
+		}
+
+		pods := deviceToPod[deviceId]
+		podCount := countPods(pods)
+		series := [][]PodInfo{pods}
+		if p.Config.KubernetesSharedGPUs == SeriesSharedGPUMode && len(pods) > 1 {
+			series = make([][]PodInfo, len(pods))
+			for k := range pods {
+				series[k] = pods[k : k+1]
 			}
-			if !p.Config.UseOldNamespace {
-				metrics[i][j].Attributes[podAttribute] = deviceToPod[deviceId].Name
-				metrics[i][j].Attributes[namespaceAttribute] = deviceToPod[deviceId].Namespace
-				metrics[i][j].Attributes[containerAttribute] = deviceToPod[deviceId].Container
-			} else {
-				metrics[i][j].Attributes[oldPodAttribute] = deviceToPod[deviceId].Name
-				metrics[i][j].Attributes[oldNamespaceAttribute] = deviceToPod[deviceId].Namespace
-				metrics[i][j].Attributes[oldContainerAttribute] = deviceToPod[deviceId].Container
+		}
+
+		// The device gauges aren't attributed to one of the pods in the series
+		// mode, they only have the labels of the device and the node
+		gauge := device[0]
+		gauge.Attributes = copyAttributes(gauge.Attributes)
+		for k, v := range nodeAttributes {
+			gauge.Attributes[k] = v
+		}
+
+		processed := make([]Metric, 0, len(device)*len(series)+3)
+		for _, seriesPods := range series {
+			attributes := p.podAttributes(seriesPods, podCount > 1)
+			for k, v := range nodeAttributes {
+				attributes[k] = v
 			}
+
+			for _, m := range device {
+				// The attributes are shared by the copies of the metric
+				if len(series) > 1 {
+					m.Attributes = copyAttributes(m.Attributes)
+				}
+				for k, v := range attributes {
+					m.Attributes[k] = v
+				}
+				processed = append(processed, m)
+			}
+		}
+
+		// In the join mode they have the pods of the single series
+		if p.Config.KubernetesSharedGPUs != SeriesSharedGPUMode {
+			gauge = processed[0]
+		}
+		if allocatable != nil {
+			processed = append(processed, derivedMetric(gauge, &allocatableCounter, boolValue(allocatable[deviceId])))
 		}
+		processed = append(processed, derivedMetric(gauge, &allocatedCounter, boolValue(len(pods) > 0)))
+		processed = append(processed, derivedMetric(gauge, &podsCounter, float64(podCount)))
+
+		metrics[i] = processed
 	}
 
 	return nil
 }
 
-func connectToServer(socket string) (*grpc.ClientConn, func(), error) {
-	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
-	defer cancel()
+// podAttributes returns the attributes of the pods of a series, their values
+// are joined in the order of the pods when there are several.
+func (p *PodMapper) podAttributes(pods []PodInfo, shared bool) map[string]string {
+	names, namespaces, containers := make([]string, len(pods)), make([]string, len(pods)), make([]string, len(pods))
+	for i, pod := range pods {
+		names[i], namespaces[i], containers[i] = pod.Name, pod.Namespace, pod.Container
+	}
+
+	attributes := map[string]string{}
+	if !p.Config.UseOldNamespace {
+		attributes[podAttribute] = strings.Join(names, ",")
+		attributes[namespaceAttribute] = strings.Join(namespaces, ",")
+		attributes[containerAttribute] = strings.Join(containers, ",")
+	} else {
+		attributes[oldPodAttribute] = strings.Join(names, ",")
+		attributes[oldNamespaceAttribute] = strings.Join(namespaces, ",")
+		attributes[oldContainerAttribute] = strings.Join(containers, ",")
+	}
+
+	if p.Config.KubernetesSharedGPUs == SeriesSharedGPUMode {
+		attributes[sharedAttribute] = strconv.FormatBool(shared)
+	}
+
+	if p.metadata == nil {
+		return attributes
+	}
+
+	if len(pods) == 0 {
+		for k, v := range p.metadata.PodAttributes(PodInfo{}) {
+			attributes[k] = v
+		}
+		return attributes
+	}
+
+	values := map[string][]string{}
+	for _, pod := range pods {
+		for k, v := range p.metadata.PodAttributes(pod) {
+			values[k] = append(values[k], v)
+		}
+	}
+	for k, v := range values {
+		attributes[k] = strings.Join(v, ",")
+	}
+
+	return attributes
+}
+
+// countPods returns the number of distinct pods, the containers of a pod are
+// listed separately
+func countPods(pods []PodInfo) int {
+	seen := make(map[string]bool, len(pods))
+	for _, pod := range pods {
+		seen[pod.Namespace+"/"+pod.Name] = true
+	}
+
+	return len(seen)
+}
+
+func copyAttributes(attributes map[string]string) map[string]string {
+	copied := make(map[string]string, len(attributes))
+	for k, v := range attributes {
+		copied[k] = v
+	}
+
+	return copied
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
 
-	conn, err := grpc.DialContext(ctx, socket, grpc.WithInsecure(), grpc.WithBlock(),
-		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
-			return net.DialTimeout("unix", addr, timeout)
+// connectToServer returns without waiting for the kubelet, gRPC connects in
+// the background and reconnects when the connection is lost.
+func connectToServer(socket string) (*grpc.ClientConn, error) {
+	conn, err := grpc.Dial(socket, grpc.WithInsecure(),
+		grpc.WithConnectParams(grpc.ConnectParams{Backoff: reconnectBackoff, MinConnectTimeout: connectionTimeout}),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr)
 		}),
 	)
 
 	if err != nil {
-		return nil, func() {}, fmt.Errorf("failure connecting to %s: %v", socket, err)
+		return nil, fmt.Errorf("failure connecting to %s: %v", socket, err)
 	}
 
-	return conn, func() { conn.Close() }, nil
+	return conn, nil
 }
 
+// ListPods returns the gRPC errors as is, so that their code can be checked
 func ListPods(conn *grpc.ClientConn) (*podresourcesapi.ListPodResourcesResponse, error) {
 	client := podresourcesapi.NewPodResourcesListerClient(conn)
 
 	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
 	defer cancel()
 
-	resp, err := client.List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+	return client.List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+}
+
+func GetAllocatableResources(conn *grpc.ClientConn) (*podresourcesapi.AllocatableResourcesResponse, error) {
+	client := podresourcesapi.NewPodResourcesListerClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
+	defer cancel()
+
+	return client.GetAllocatableResources(ctx, &podresourcesapi.AllocatableResourcesRequest{})
+}
+
+// ListPodsV1alpha1 converts the response to v1, the messages are the same
+func ListPodsV1alpha1(conn *grpc.ClientConn) (*podresourcesapi.ListPodResourcesResponse, error) {
+	client := podresourcesv1alpha1.NewPodResourcesListerClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
+	defer cancel()
+
+	resp, err := client.List(ctx, &podresourcesv1alpha1.ListPodResourcesRequest{})
 	if err != nil {
-		return nil, fmt.Errorf("failure getting pod resources %v", err)
+		return nil, err
+	}
+
+	pods := &podresourcesapi.ListPodResourcesResponse{}
+	for _, pod := range resp.GetPodResources() {
+		podResources := &podresourcesapi.PodResources{Name: pod.GetName(), Namespace: pod.GetNamespace()}
+		for _, container := range pod.GetContainers() {
+			containerResources := &podresourcesapi.ContainerResources{Name: container.GetName()}
+			for _, device := range container.GetDevices() {
+				containerResources.Devices = append(containerResources.Devices, &podresourcesapi.ContainerDevices{
+					ResourceName: device.GetResourceName(),
+					DeviceIds:    device.GetDeviceIds(),
+				})
+			}
+			podResources.Containers = append(podResources.Containers, containerResources)
+		}
+		pods.PodResources = append(pods.PodResources, podResources)
 	}
 
-	return resp, nil
+	return pods, nil
 }
 
-func ToDeviceToPod(devicePods *podresourcesapi.ListPodResourcesResponse, sysInfo SystemInfo) map[string]PodInfo {
-	deviceToPodMap := make(map[string]PodInfo)
+// ToDeviceToPod maps the devices to the pods using them, several pods can
+// share a device, e.g: with time-slicing. They are sorted by namespace, name
+// and container since the kubelet doesn't list them in a stable order.
+func ToDeviceToPod(devicePods *podresourcesapi.ListPodResourcesResponse, c *Config, sysInfo SystemInfo) map[string][]PodInfo {
+	deviceToPodMap := make(map[string][]PodInfo)
 
 	for _, pod := range devicePods.GetPodResources() {
 		for _, container := range pod.GetContainers() {
 			for _, device := range container.GetDevices() {
-
-				resourceName := device.GetResourceName()
-				if resourceName != nvidiaResourceName {
-					// Mig resources appear differently than GPU resources
-					if strings.HasPrefix(resourceName, nvidiaMigResourcePrefix) == false {
-						continue
-					}
-				}
-
 				podInfo := PodInfo{
 					Name:      pod.GetName(),
 					Namespace: pod.GetNamespace(),
 					Container: container.GetName(),
 				}
 
-				for _, uuid := range device.GetDeviceIds() {
-					if strings.HasPrefix(uuid, MIG_UUID_PREFIX) {
-						// MIG uuid for now at least is in the format MIG-GPU-<gpu uuid>/<gpu instance index>/<compute instance index>
-						// Remove the prefix and suffix to get the GPU's uuid
-						gpuUuid := uuid[len(MIG_UUID_PREFIX):]
-						index := strings.Index(gpuUuid, "/")
-						if index > -1 {
-							gIIdStr := gpuUuid[index+1:]
-							index2 := strings.Index(gIIdStr, "/")
-							gIIdStr = gIIdStr[0:index2]
-							gpuUuid = gpuUuid[0:index]
-
-							giIdentifier := GetGpuInstanceIdentifier(sysInfo, gpuUuid, gIIdStr)
-							deviceToPodMap[giIdentifier] = podInfo
-						}
-						deviceToPodMap[gpuUuid] = podInfo
-					} else {
-						deviceToPodMap[uuid] = podInfo
-					}
+				for _, id := range DeviceIDs(device, c, sysInfo) {
+					deviceToPodMap[id] = append(deviceToPodMap[id], podInfo)
 				}
 			}
 		}
 	}
 
+	for id, pods := range deviceToPodMap {
+		sort.Slice(pods, func(i, j int) bool {
+			if pods[i].Namespace != pods[j].Namespace {
+				return pods[i].Namespace < pods[j].Namespace
+			}
+			if pods[i].Name != pods[j].Name {
+				return pods[i].Name < pods[j].Name
+			}
+			return pods[i].Container < pods[j].Container
+		})
+
+		// The GPU of several MIG devices of a container is listed once
+		unique := pods[:1]
+		for _, pod := range pods[1:] {
+			if pod != unique[len(unique)-1] {
+				unique = append(unique, pod)
+			}
+		}
+		deviceToPodMap[id] = unique
+	}
+
 	return deviceToPodMap
 }
+
+// ParseGPUResources parses a comma separated list of resource name patterns
+// and the type of the IDs of their devices, e.g:
+// "nvidia.com/gpu=gpu-uuid,nvidia.com/mig-*=mig-uuid"
+func ParseGPUResources(list string) ([]GPUResource, error) {
+	var resources []GPUResource
+	for _, item := range splitList(list) {
+		index := strings.LastIndex(item, "=")
+		if index < 0 {
+			return nil, fmt.Errorf("Invalid GPU resource '%s', expected '<pattern>=<ID type>'", item)
+		}
+
+		resource := GPUResource{
+			Pattern: strings.TrimSpace(item[:index]),
+			IDType:  GPUResourceIDType(strings.TrimSpace(item[index+1:])),
+		}
+		if _, err := path.Match(resource.Pattern, ""); resource.Pattern == "" || err != nil {
+			return nil, fmt.Errorf("Invalid pattern '%s' of the GPU resource '%s'", resource.Pattern, item)
+		}
+		if resource.IDType != GPUUUIDResourceID && resource.IDType != MIGUUIDResourceID && resource.IDType != DeviceNameResourceID {
+			return nil, fmt.Errorf("Invalid ID type '%s' of the GPU resource '%s', expected '%s', '%s' or '%s'", resource.IDType, item, GPUUUIDResourceID, MIGUUIDResourceID, DeviceNameResourceID)
+		}
+
+		resources = append(resources, resource)
+	}
+
+	if len(resources) == 0 {
+		return nil, fmt.Errorf("No GPU resource is configured")
+	}
+
+	return resources, nil
+}
+
+// gpuResource returns the first GPU resource matching the name, nil if the
+// resource isn't a GPU
+func gpuResource(resources []GPUResource, name string) *GPUResource {
+	for i := range resources {
+		// The patterns are validated by ParseGPUResources
+		if matched, _ := path.Match(resources[i].Pattern, name); matched {
+			return &resources[i]
+		}
+	}
+
+	return nil
+}
+
+// DeviceIDs returns the IDs of the metrics of the devices of a GPU resource:
+// the GPU UUIDs or device names, and for the MIG devices the GPU instance
+// identifier and the ID of its GPU.
+func DeviceIDs(device *podresourcesapi.ContainerDevices, c *Config, sysInfo SystemInfo) []string {
+	resource := gpuResource(c.KubernetesGPUResources, device.GetResourceName())
+	if resource == nil {
+		return nil
+	}
+
+	var ids []string
+	for _, id := range device.GetDeviceIds() {
+		switch {
+		case resource.IDType == DeviceNameResourceID:
+			ids = append(ids, gpuIDOfDeviceName(sysInfo, c.KubernetesGPUIdType, id))
+		case resource.IDType == MIGUUIDResourceID || strings.HasPrefix(id, MIG_UUID_PREFIX):
+			gpuUuid, gpuInstanceId, ok := parseMIGUUID(id, sysInfo)
+			if !ok {
+				logrus.Debugf("Ignoring the device '%s' of the resource %s, it isn't the UUID of a known MIG device", id, device.GetResourceName())
+				continue
+			}
+
+			ids = append(ids, GetGpuInstanceIdentifier(sysInfo, gpuUuid, gpuInstanceId))
+			ids = append(ids, gpuIDOfUUID(sysInfo, c.KubernetesGPUIdType, gpuUuid))
+		default:
+			ids = append(ids, gpuIDOfUUID(sysInfo, c.KubernetesGPUIdType, id))
+		}
+	}
+
+	return ids
+}
+
+// parseMIGUUID returns the UUID of the GPU and the GPU instance index of a MIG
+// device. The older drivers identify them with
+// MIG-GPU-<gpu uuid>/<gpu instance index>/<compute instance index>, the recent
+// ones with MIG-<uuid> which is looked up in the GPU instances.
+func parseMIGUUID(uuid string, sysInfo SystemInfo) (string, string, bool) {
+	if !strings.HasPrefix(uuid, MIG_UUID_PREFIX) {
+		return "", "", false
+	}
+
+	if !strings.Contains(uuid, "/") {
+		gpu, instance := GetGpuInstanceByMigUUID(sysInfo, uuid)
+		if instance == nil {
+			return "", "", false
+		}
+
+		return gpu.DeviceInfo.UUID, fmt.Sprintf("%d", instance.Info.NvmlInstanceId), true
+	}
+
+	parts := strings.Split(uuid[len(MIG_UUID_PREFIX):], "/")
+	if len(parts) != 3 {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// gpuIDOfUUID returns the ID of the metrics of a GPU, the UUID is returned as
+// is if the GPU isn't monitored.
+func gpuIDOfUUID(sysInfo SystemInfo, idType KubernetesGPUIDType, uuid string) string {
+	if idType != DeviceName {
+		return uuid
+	}
+
+	for i := uint(0); i < sysInfo.GpuCount; i++ {
+		if sysInfo.Gpus[i].DeviceInfo.UUID == uuid {
+			return fmt.Sprintf("nvidia%d", sysInfo.Gpus[i].DeviceInfo.GPU)
+		}
+	}
+
+	return uuid
+}
+
+// gpuIDOfDeviceName returns the ID of the metrics of a GPU, the device name is
+// returned as is if the GPU isn't monitored.
+func gpuIDOfDeviceName(sysInfo SystemInfo, idType KubernetesGPUIDType, name string) string {
+	if idType != GPUUID {
+		return name
+	}
+
+	for i := uint(0); i < sysInfo.GpuCount; i++ {
+		if fmt.Sprintf("nvidia%d", sysInfo.Gpus[i].DeviceInfo.GPU) == name {
+			return sysInfo.Gpus[i].DeviceInfo.UUID
+		}
+	}
+
+	return name
+}
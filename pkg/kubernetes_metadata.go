@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	ownerKindAttribute = "owner_kind"
+	ownerNameAttribute = "owner_name"
+
+	podLabelPrefix      = "label_"
+	podAnnotationPrefix = "annotation_"
+	nodeLabelPrefix     = "node_label_"
+)
+
+var (
+	// The informers are resynced from their cache, the watches keep them up to date
+	metadataResyncPeriod = 10 * time.Minute
+	metadataSyncTimeout  = 30 * time.Second
+)
+
+// metadataEnabled returns whether the pods or the node are looked up from the
+// API server
+func metadataEnabled(c *Config) bool {
+	return len(c.KubernetesPodLabels) > 0 || len(c.KubernetesPodAnnotations) > 0 || len(c.KubernetesNodeLabels) > 0 || c.KubernetesPodOwners
+}
+
+// NewPodMetadata watches the pods of the node and the node itself from the API
+// server, with the service account of the exporter.
+func NewPodMetadata(c *Config) (*PodMetadata, func(), error) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, func() {}, fmt.Errorf("Failed to configure the Kubernetes API client: %v", err)
+	}
+
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, func() {}, fmt.Errorf("Failed to create the Kubernetes API client: %v", err)
+	}
+
+	return newPodMetadata(c, client)
+}
+
+// newPodMetadata starts the informers and waits for their first listing, the
+// attributes are empty until then if the API server is slow to answer.
+func newPodMetadata(c *Config, client kubernetes.Interface) (*PodMetadata, func(), error) {
+	logrus.Infof("Looking up the pods and the node %s from the Kubernetes API server", c.KubernetesNodeName)
+
+	pods := informers.NewSharedInformerFactoryWithOptions(client, metadataResyncPeriod,
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", c.KubernetesNodeName).String()
+		}),
+	).Core().V1().Pods().Informer()
+
+	nodes := informers.NewSharedInformerFactoryWithOptions(client, metadataResyncPeriod,
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.FieldSelector = fields.OneTermEqualSelector("metadata.name", c.KubernetesNodeName).String()
+		}),
+	).Core().V1().Nodes().Informer()
+
+	stop := make(chan struct{})
+	go pods.Run(stop)
+	go nodes.Run(stop)
+
+	timeout := make(chan struct{})
+	timer := time.AfterFunc(metadataSyncTimeout, func() { close(timeout) })
+	defer timer.Stop()
+
+	if !cache.WaitForCacheSync(timeout, pods.HasSynced, nodes.HasSynced) {
+		logrus.Warningf("The pods and the node aren't listed from the Kubernetes API server after %s, the metrics won't have their labels until they are", metadataSyncTimeout)
+	}
+
+	return &PodMetadata{
+		Config: c,
+		pods:   pods.GetIndexer(),
+		nodes:  nodes.GetIndexer(),
+
+		podLabels:      attributeNames(podLabelPrefix, c.KubernetesPodLabels),
+		podAnnotations: attributeNames(podAnnotationPrefix, c.KubernetesPodAnnotations),
+		nodeLabels:     attributeNames(nodeLabelPrefix, c.KubernetesNodeLabels),
+	}, func() {
+		close(stop)
+	}, nil
+}
+
+// attributeNames maps the keys to the names of their attributes, e.g:
+// "app.kubernetes.io/name" to "label_app_kubernetes_io_name"
+func attributeNames(prefix string, keys []string) map[string]string {
+	names := make(map[string]string, len(keys))
+	for _, key := range keys {
+		names[key] = SanitizeLabelName(prefix + key)
+	}
+
+	return names
+}
+
+// PodAttributes returns the attributes of a pod, they are all set so that the
+// metrics of every device have the same labels, empty if the pod is unknown.
+func (m *PodMetadata) PodAttributes(pod PodInfo) map[string]string {
+	attributes := map[string]string{}
+	for _, name := range m.podLabels {
+		attributes[name] = ""
+	}
+	for _, name := range m.podAnnotations {
+		attributes[name] = ""
+	}
+	if m.Config.KubernetesPodOwners {
+		attributes[ownerKindAttribute] = ""
+		attributes[ownerNameAttribute] = ""
+	}
+
+	if pod.Name == "" {
+		return attributes
+	}
+
+	obj, exists, err := m.pods.GetByKey(pod.Namespace + "/" + pod.Name)
+	if err != nil || !exists {
+		logrus.Debugf("Pod %s/%s isn't known by the API server yet", pod.Namespace, pod.Name)
+		return attributes
+	}
+	p := obj.(*corev1.Pod)
+
+	for key, name := range m.podLabels {
+		attributes[name] = p.Labels[key]
+	}
+	for key, name := range m.podAnnotations {
+		attributes[name] = p.Annotations[key]
+	}
+	if m.Config.KubernetesPodOwners {
+		attributes[ownerKindAttribute], attributes[ownerNameAttribute] = podOwner(p)
+	}
+
+	return attributes
+}
+
+// NodeAttributes returns the attributes of the node, empty if it isn't known
+func (m *PodMetadata) NodeAttributes() map[string]string {
+	attributes := map[string]string{}
+	for _, name := range m.nodeLabels {
+		attributes[name] = ""
+	}
+
+	obj, exists, err := m.nodes.GetByKey(m.Config.KubernetesNodeName)
+	if err != nil || !exists {
+		return attributes
+	}
+	node := obj.(*corev1.Node)
+
+	for key, name := range m.nodeLabels {
+		attributes[name] = node.Labels[key]
+	}
+
+	return attributes
+}
+
+// podOwner returns the kind and name of the controller of the pod, e.g: a Job
+// or a PyTorchJob. The ReplicaSets of the Deployments are replaced by their
+// Deployment, their name is the name of the Deployment and the hash of the pod
+// template.
+func podOwner(pod *corev1.Pod) (string, string) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return "", ""
+	}
+
+	if owner.Kind == "ReplicaSet" {
+		hash := pod.Labels["pod-template-hash"]
+		if hash != "" && strings.HasSuffix(owner.Name, "-"+hash) {
+			return "Deployment", strings.TrimSuffix(owner.Name, "-"+hash)
+		}
+	}
+
+	return owner.Kind, owner.Name
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	podresourcesv1 "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+func testPod(name string, labels map[string]string, owner *metav1.OwnerReference) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Labels:      labels,
+			Annotations: map[string]string{"example.com/cost-center": "cc-" + name},
+		},
+		Spec: corev1.PodSpec{NodeName: "gpu-node"},
+	}
+	if owner != nil {
+		controller := true
+		owner.Controller = &controller
+		pod.OwnerReferences = []metav1.OwnerReference{*owner}
+	}
+
+	return pod
+}
+
+func TestPodMetadata(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		testPod("web-5d9c7b-x2x4q", map[string]string{"team": "web", "pod-template-hash": "5d9c7b"}, &metav1.OwnerReference{Kind: "ReplicaSet", Name: "web-5d9c7b"}),
+		testPod("train-0", map[string]string{"team": "research"}, &metav1.OwnerReference{Kind: "Job", Name: "train"}),
+		testPod("bert-worker-0", nil, &metav1.OwnerReference{Kind: "PyTorchJob", Name: "bert"}),
+		testPod("standalone", nil, nil),
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "gpu-node", Labels: map[string]string{"nvidia.com/gpu.product": "A100-SXM4-40GB"}}},
+	)
+
+	c := &Config{
+		KubernetesNodeName:       "gpu-node",
+		KubernetesPodLabels:      []string{"team"},
+		KubernetesPodAnnotations: []string{"example.com/cost-center"},
+		KubernetesPodOwners:      true,
+		KubernetesNodeLabels:     []string{"nvidia.com/gpu.product", "missing"},
+	}
+	metadata, cleanup, err := newPodMetadata(c, client)
+	require.NoError(t, err)
+	defer cleanup()
+
+	tests := []struct {
+		pod      string
+		expected map[string]string
+	}{
+		{"web-5d9c7b-x2x4q", map[string]string{"label_team": "web", "annotation_example_com_cost_center": "cc-web-5d9c7b-x2x4q", "owner_kind": "Deployment", "owner_name": "web"}},
+		{"train-0", map[string]string{"label_team": "research", "annotation_example_com_cost_center": "cc-train-0", "owner_kind": "Job", "owner_name": "train"}},
+		{"bert-worker-0", map[string]string{"label_team": "", "annotation_example_com_cost_center": "cc-bert-worker-0", "owner_kind": "PyTorchJob", "owner_name": "bert"}},
+		{"standalone", map[string]string{"label_team": "", "annotation_example_com_cost_center": "cc-standalone", "owner_kind": "", "owner_name": ""}},
+		{"unknown", map[string]string{"label_team": "", "annotation_example_com_cost_center": "", "owner_kind": "", "owner_name": ""}},
+		{"", map[string]string{"label_team": "", "annotation_example_com_cost_center": "", "owner_kind": "", "owner_name": ""}},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.expected, metadata.PodAttributes(PodInfo{Name: tt.pod, Namespace: "default"}), tt.pod)
+	}
+
+	require.Equal(t, map[string]string{"node_label_nvidia_com_gpu_product": "A100-SXM4-40GB", "node_label_missing": ""}, metadata.NodeAttributes())
+
+	// The changes are watched
+	pod := testPod("train-0", map[string]string{"team": "platform"}, nil)
+	_, err = client.CoreV1().Pods("default").Update(context.Background(), pod, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return metadata.PodAttributes(PodInfo{Name: "train-0", Namespace: "default"})["label_team"] == "platform"
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestPodMapperMetadata(t *testing.T) {
+	cleanup := CreateTmpDir(t)
+	defer cleanup()
+
+	c, cleanup := testSyntheticCollector(t, sampleCounters, 2)
+	defer cleanup()
+
+	out, err := c.GetMetrics()
+	require.NoError(t, err)
+	gpus := GetGPUUUIDs(out)
+
+	socketPath = tmpDir + "/kubelet.sock"
+	server := grpc.NewServer()
+	podresourcesv1.RegisterPodResourcesListerServer(server, &PodResourcesV1MockServer{used: gpus[:1]})
+	defer StartMockServer(t, server, socketPath)()
+
+	config := &Config{KubernetesGPUIdType: GPUUID, KubernetesGPUResources: testGPUResources, KubernetesRefreshInterval: 3600000}
+	podMapper, cleanup, err := NewPodMapper(config, c.SysInfo())
+	require.NoError(t, err)
+	defer cleanup()
+
+	client := fake.NewSimpleClientset(
+		testPod("gpu-pod-0", map[string]string{"team": "web"}, nil),
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "gpu-node", Labels: map[string]string{"zone": "a"}}},
+	)
+	config.KubernetesNodeName = "gpu-node"
+	config.KubernetesPodLabels = []string{"team"}
+	config.KubernetesNodeLabels = []string{"zone"}
+	podMapper.metadata, cleanup, err = newPodMetadata(config, client)
+	require.NoError(t, err)
+	defer cleanup()
+
+	podMapper.Refresh()
+	require.NoError(t, podMapper.Process(out, c.SysInfo()))
+
+	// Every metric gets the attributes, including the ones of the free GPUs
+	for _, m := range out[0] {
+		require.Equal(t, "gpu-pod-0", m.Attributes[podAttribute])
+		require.Equal(t, "web", m.Attributes["label_team"])
+		require.Equal(t, "a", m.Attributes["node_label_zone"])
+	}
+	for _, m := range out[1] {
+		require.Equal(t, "", m.Attributes[podAttribute])
+		require.Contains(t, m.Attributes, "label_team")
+		require.Equal(t, "a", m.Attributes["node_label_zone"])
+	}
+}
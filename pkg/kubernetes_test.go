@@ -27,12 +27,18 @@ import (
 	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
-	podresourcesapi "k8s.io/kubernetes/pkg/kubelet/apis/podresources/v1alpha1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	podresourcesv1 "k8s.io/kubelet/pkg/apis/podresources/v1"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1alpha1"
 	"k8s.io/kubernetes/pkg/kubelet/util"
 )
 
 var tmpDir string
 
+// The resources of the NVIDIA device plugin, the default ones
+var testGPUResources = []GPUResource{{nvidiaResourceName, GPUUUIDResourceID}, {nvidiaMigResourcePattern, MIGUUIDResourceID}}
+
 func TestProcessPodMapper(t *testing.T) {
 	cleanup := CreateTmpDir(t)
 	defer cleanup()
@@ -56,8 +62,12 @@ func TestProcessPodMapper(t *testing.T) {
 	cleanup = StartMockServer(t, server, socketPath)
 	defer cleanup()
 
-	podMapper := NewPodMapper(&Config{KubernetesGPUIdType: GPUUID})
 	var sysInfo SystemInfo
+	podMapper, cleanup, err := NewPodMapper(&Config{KubernetesGPUIdType: GPUUID, KubernetesGPUResources: testGPUResources, KubernetesRefreshInterval: 1000}, sysInfo)
+	require.NoError(t, err)
+	defer cleanup()
+
+	podMapper.Refresh()
 	err = podMapper.Process(out, sysInfo)
 	require.NoError(t, err)
 
@@ -77,6 +87,340 @@ func TestProcessPodMapper(t *testing.T) {
 	}
 }
 
+func TestPodMapperRefresh(t *testing.T) {
+	cleanup := CreateTmpDir(t)
+	defer cleanup()
+
+	c, cleanup := testSyntheticCollector(t, sampleCounters, 2)
+	defer cleanup()
+
+	out, err := c.GetMetrics()
+	require.NoError(t, err)
+
+	socketPath = tmpDir + "/kubelet.sock"
+	server := grpc.NewServer()
+	podresourcesapi.RegisterPodResourcesListerServer(server, NewPodResourcesMockServer(GetGPUUUIDs(out)))
+	stopServer := StartMockServer(t, server, socketPath)
+
+	// The first refresh runs before the mapper is returned
+	podMapper, cleanup, err := NewPodMapper(&Config{KubernetesGPUIdType: GPUUID, KubernetesGPUResources: testGPUResources, KubernetesRefreshInterval: 3600000}, c.SysInfo())
+	require.NoError(t, err)
+	defer cleanup()
+
+	require.NoError(t, podMapper.Process(out, c.SysInfo()))
+	require.Equal(t, "gpu-pod-1", out[1][0].Attributes[podAttribute])
+
+	// The mock only serves v1alpha1, the allocatable devices are unknown
+	require.Equal(t, podResourcesV1alpha1, podMapper.api)
+	require.Equal(t, podsCounter.FieldName, out[1][len(out[1])-1].Counter.FieldName)
+	require.Equal(t, allocatedCounter.FieldName, out[1][len(out[1])-2].Counter.FieldName)
+	require.NotEqual(t, allocatableCounter.FieldName, out[1][len(out[1])-3].Counter.FieldName)
+
+	// The last mapping is kept while the kubelet is unavailable
+	stopServer()
+	podMapper.Refresh()
+	require.True(t, podMapper.failing)
+
+	out, err = c.GetMetrics()
+	require.NoError(t, err)
+	require.NoError(t, podMapper.Process(out, c.SysInfo()))
+	require.Equal(t, "gpu-pod-1", out[1][0].Attributes[podAttribute])
+
+	_, _, stale := podMapper.mapping()
+	require.False(t, stale)
+
+	// Stale mappings are still applied, the failed refreshes are counted
+	// rather than the collections
+	podMapper.refreshedAt = podMapper.refreshedAt.Add(-4 * time.Hour)
+	_, _, stale = podMapper.mapping()
+	require.True(t, stale)
+
+	staleFailures := func() uint64 {
+		selfMetrics.Lock()
+		defer selfMetrics.Unlock()
+		return selfMetrics.podMappingFailures["stale"]
+	}
+	failures := staleFailures()
+
+	out, err = c.GetMetrics()
+	require.NoError(t, err)
+	require.NoError(t, podMapper.Process(out, c.SysInfo()))
+	require.NoError(t, podMapper.Process(out, c.SysInfo()))
+	require.Equal(t, "gpu-pod-0", out[0][0].Attributes[podAttribute])
+	require.Equal(t, failures, staleFailures())
+
+	podMapper.Refresh()
+	require.Equal(t, failures+1, staleFailures())
+
+	// The connection is reestablished when the kubelet restarts
+	server = grpc.NewServer()
+	podresourcesapi.RegisterPodResourcesListerServer(server, NewPodResourcesMockServer([]string{out[1][0].GPUUUID}))
+	defer StartMockServer(t, server, socketPath)()
+
+	require.Eventually(t, func() bool {
+		podMapper.Refresh()
+		deviceToPod, _, stale := podMapper.mapping()
+		return !stale && len(deviceToPod) == 1
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func TestPodMapperV1(t *testing.T) {
+	cleanup := CreateTmpDir(t)
+	defer cleanup()
+
+	c, cleanup := testSyntheticCollector(t, sampleCounters, 3)
+	defer cleanup()
+
+	out, err := c.GetMetrics()
+	require.NoError(t, err)
+	gpus := GetGPUUUIDs(out)
+
+	// The first GPU is allocated, the second one is free and the third one isn't allocatable
+	socketPath = tmpDir + "/kubelet.sock"
+	server := grpc.NewServer()
+	podresourcesv1.RegisterPodResourcesListerServer(server, &PodResourcesV1MockServer{
+		allocatable: gpus[:2],
+		used:        gpus[:1],
+	})
+	defer StartMockServer(t, server, socketPath)()
+
+	podMapper, cleanup, err := NewPodMapper(&Config{KubernetesGPUIdType: GPUUID, KubernetesGPUResources: testGPUResources, KubernetesRefreshInterval: 3600000}, c.SysInfo())
+	require.NoError(t, err)
+	defer cleanup()
+
+	podMapper.Refresh()
+	require.Equal(t, podResourcesV1, podMapper.api)
+	require.NoError(t, podMapper.Process(out, c.SysInfo()))
+
+	values := func(device []Metric) map[string]string {
+		v := map[string]string{}
+		for _, m := range device {
+			if m.Counter == &allocatableCounter || m.Counter == &allocatedCounter {
+				v[m.Counter.FieldName] = m.Value
+			}
+		}
+		return v
+	}
+
+	require.Equal(t, "gpu-pod-0", out[0][0].Attributes[podAttribute])
+	require.Equal(t, map[string]string{"DCGM_EXP_KUBERNETES_ALLOCATABLE": "1.000000", "DCGM_EXP_KUBERNETES_ALLOCATED": "1.000000"}, values(out[0]))
+	require.Equal(t, map[string]string{"DCGM_EXP_KUBERNETES_ALLOCATABLE": "1.000000", "DCGM_EXP_KUBERNETES_ALLOCATED": "0.000000"}, values(out[1]))
+	require.Equal(t, map[string]string{"DCGM_EXP_KUBERNETES_ALLOCATABLE": "0.000000", "DCGM_EXP_KUBERNETES_ALLOCATED": "0.000000"}, values(out[2]))
+
+	// The pod attributes are on the allocation metrics too
+	last := out[0][len(out[0])-1]
+	require.Equal(t, "gpu-pod-0", last.Attributes[podAttribute])
+}
+
+func TestPodMapperSharedGPUs(t *testing.T) {
+	cleanup := CreateTmpDir(t)
+	defer cleanup()
+
+	c, cleanup := testSyntheticCollector(t, sampleCounters, 2)
+	defer cleanup()
+
+	original, err := c.GetMetrics()
+	require.NoError(t, err)
+	gpus := GetGPUUUIDs(original)
+
+	// The first GPU is shared by gpu-pod-0 and gpu-pod-1
+	socketPath = tmpDir + "/kubelet.sock"
+	server := grpc.NewServer()
+	podresourcesv1.RegisterPodResourcesListerServer(server, &PodResourcesV1MockServer{used: []string{gpus[0], gpus[0], gpus[1]}})
+	defer StartMockServer(t, server, socketPath)()
+
+	pods := func(device []Metric) string {
+		for _, m := range device {
+			if m.Counter == &podsCounter {
+				return m.Value
+			}
+		}
+		return ""
+	}
+
+	tests := []struct {
+		mode     SharedGPUMode
+		expected [][]map[string]string // pod and shared attributes of the series of each device
+	}{
+		{JoinSharedGPUMode, [][]map[string]string{
+			{{podAttribute: "gpu-pod-0,gpu-pod-1", namespaceAttribute: "default,default"}},
+			{{podAttribute: "gpu-pod-2", namespaceAttribute: "default"}},
+		}},
+		{SeriesSharedGPUMode, [][]map[string]string{
+			{{podAttribute: "gpu-pod-0", namespaceAttribute: "default", sharedAttribute: "true"}, {podAttribute: "gpu-pod-1", namespaceAttribute: "default", sharedAttribute: "true"}},
+			{{podAttribute: "gpu-pod-2", namespaceAttribute: "default", sharedAttribute: "false"}},
+		}},
+	}
+
+	for _, tt := range tests {
+		podMapper, cleanup, err := NewPodMapper(&Config{KubernetesGPUIdType: GPUUID, KubernetesGPUResources: testGPUResources, KubernetesRefreshInterval: 3600000, KubernetesSharedGPUs: tt.mode}, c.SysInfo())
+		require.NoError(t, err)
+		podMapper.Refresh()
+
+		out, err := c.GetMetrics()
+		require.NoError(t, err)
+		require.NoError(t, podMapper.Process(out, c.SysInfo()))
+		cleanup()
+
+		for i, device := range out {
+			require.Equal(t, fmt.Sprintf("%d.000000", []int{2, 1}[i]), pods(device), tt.mode)
+
+			// The series of each pod have all the metrics, followed by the device gauges
+			series := tt.expected[i]
+			require.Len(t, device, len(original[i])*len(series)+2, tt.mode)
+			for j, m := range device {
+				expected := series[0]
+				if j < len(original[i])*len(series) {
+					expected = series[j/len(original[i])]
+				} else if tt.mode == SeriesSharedGPUMode {
+					// The device gauges only have the labels of the device
+					require.NotContains(t, m.Attributes, podAttribute, tt.mode)
+					require.NotContains(t, m.Attributes, sharedAttribute, tt.mode)
+					continue
+				}
+
+				for k, v := range expected {
+					require.Equal(t, v, m.Attributes[k], tt.mode)
+				}
+				if tt.mode == JoinSharedGPUMode {
+					require.NotContains(t, m.Attributes, sharedAttribute)
+				}
+			}
+		}
+	}
+}
+
+func TestCountPods(t *testing.T) {
+	require.Equal(t, 0, countPods(nil))
+	require.Equal(t, 2, countPods([]PodInfo{
+		{Name: "train-0", Namespace: "default", Container: "trainer"},
+		{Name: "train-0", Namespace: "default", Container: "sidecar"},
+		{Name: "train-0", Namespace: "research", Container: "trainer"},
+	}))
+}
+
+func TestToDeviceToPod(t *testing.T) {
+	device := func(ids ...string) []*podresourcesv1.ContainerDevices {
+		return []*podresourcesv1.ContainerDevices{{ResourceName: nvidiaResourceName, DeviceIds: ids}}
+	}
+
+	deviceToPod := ToDeviceToPod(&podresourcesv1.ListPodResourcesResponse{
+		PodResources: []*podresourcesv1.PodResources{
+			{Name: "b", Namespace: "default", Containers: []*podresourcesv1.ContainerResources{{Name: "main", Devices: device("GPU-0")}}},
+			{Name: "a", Namespace: "team", Containers: []*podresourcesv1.ContainerResources{{Name: "main", Devices: device("GPU-0")}}},
+			{Name: "a", Namespace: "default", Containers: []*podresourcesv1.ContainerResources{
+				{Name: "sidecar", Devices: device("GPU-0")},
+				{Name: "main", Devices: append(device("GPU-0"), device("GPU-0", "GPU-1")...)},
+			}},
+		},
+	}, &Config{KubernetesGPUIdType: GPUUID, KubernetesGPUResources: testGPUResources}, SystemInfo{})
+
+	require.Equal(t, map[string][]PodInfo{
+		"GPU-0": {
+			{Name: "a", Namespace: "default", Container: "main"},
+			{Name: "a", Namespace: "default", Container: "sidecar"},
+			{Name: "b", Namespace: "default", Container: "main"},
+			{Name: "a", Namespace: "team", Container: "main"},
+		},
+		"GPU-1": {{Name: "a", Namespace: "default", Container: "main"}},
+	}, deviceToPod)
+}
+
+func TestPodMapperGPUResources(t *testing.T) {
+	cleanup := CreateTmpDir(t)
+	defer cleanup()
+
+	c, cleanup := testSyntheticCollector(t, sampleCounters, 2)
+	defer cleanup()
+
+	out, err := c.GetMetrics()
+	require.NoError(t, err)
+	gpus := GetGPUUUIDs(out)
+
+	tests := []struct {
+		resources    string
+		idType       KubernetesGPUIDType
+		resourceName string
+		used         string
+		expected     []string // The pods of each GPU
+	}{
+		{"nvidia.com/gpu.shared=gpu-uuid", GPUUID, "nvidia.com/gpu.shared", gpus[1], []string{"", "gpu-pod-0"}},
+		{"nvidia.com/gpu.shared=gpu-uuid", GPUUID, nvidiaResourceName, gpus[1], []string{"", ""}},
+		{"nvidia.com/gpu.shared=gpu-uuid", DeviceName, "nvidia.com/gpu.shared", gpus[1], []string{"", "gpu-pod-0"}},
+		{"example.com/*=device-name", GPUUID, "example.com/a100", "nvidia1", []string{"", "gpu-pod-0"}},
+		{"example.com/*=device-name", DeviceName, "example.com/a100", "nvidia1", []string{"", "gpu-pod-0"}},
+		{"example.com/mig-*=mig-uuid,example.com/*=gpu-uuid", GPUUID, "example.com/mig-1g.5gb", gpus[1], []string{"", ""}},
+		{"example.com/mig-*=mig-uuid,example.com/*=gpu-uuid", GPUUID, "example.com/gpu", gpus[1], []string{"", "gpu-pod-0"}},
+	}
+
+	for _, tt := range tests {
+		socketPath = tmpDir + "/kubelet.sock"
+		server := grpc.NewServer()
+		podresourcesv1.RegisterPodResourcesListerServer(server, &PodResourcesV1MockServer{used: []string{tt.used}, resourceName: tt.resourceName})
+		stopServer := StartMockServer(t, server, socketPath)
+
+		resources, err := ParseGPUResources(tt.resources)
+		require.NoError(t, err)
+
+		podMapper, cleanup, err := NewPodMapper(&Config{KubernetesGPUIdType: tt.idType, KubernetesGPUResources: resources, KubernetesRefreshInterval: 3600000}, c.SysInfo())
+		require.NoError(t, err)
+		podMapper.Refresh()
+
+		out, err := c.GetMetrics()
+		require.NoError(t, err)
+		require.NoError(t, podMapper.Process(out, c.SysInfo()))
+		cleanup()
+		stopServer()
+
+		for i, device := range out {
+			require.Equal(t, tt.expected[i], device[0].Attributes[podAttribute], "%+v", tt)
+		}
+	}
+}
+
+func TestDeviceIDs(t *testing.T) {
+	var sysInfo SystemInfo
+	sysInfo.GpuCount = 1
+	sysInfo.Gpus[0].DeviceInfo.GPU = 3
+	sysInfo.Gpus[0].DeviceInfo.UUID = "GPU-abc"
+	sysInfo.Gpus[0].GpuInstances = []GpuInstanceInfo{
+		{Info: dcgm.MigEntityInfo{NvmlInstanceId: 1}, UUID: "MIG-d2b9e6a1-8c5f-5e8a-9b1e-3f2a6c7d8e90"},
+		{Info: dcgm.MigEntityInfo{NvmlInstanceId: 2}},
+	}
+
+	tests := []struct {
+		resourceName string
+		idType       KubernetesGPUIDType
+		id           string
+		expected     []string
+	}{
+		{"nvidia.com/gpu", GPUUID, "GPU-abc", []string{"GPU-abc"}},
+		{"nvidia.com/gpu", DeviceName, "GPU-abc", []string{"nvidia3"}},
+		{"nvidia.com/gpu", DeviceName, "GPU-unknown", []string{"GPU-unknown"}},
+		{"nvidia.com/gpu", GPUUID, "MIG-GPU-abc/1/0", []string{"3-1", "GPU-abc"}}, // Single MIG strategy
+		{"nvidia.com/mig-1g.5gb", GPUUID, "MIG-GPU-abc/1/0", []string{"3-1", "GPU-abc"}},
+		{"nvidia.com/mig-1g.5gb", DeviceName, "MIG-GPU-abc/2/0", []string{"3-2", "nvidia3"}},
+		{"nvidia.com/mig-1g.5gb", GPUUID, "GPU-abc", nil},
+		{"nvidia.com/mig-1g.5gb", GPUUID, "MIG-GPU-abc/1", nil},
+		{"nvidia.com/mig-1g.5gb", GPUUID, "MIG-d2b9e6a1-8c5f-5e8a-9b1e-3f2a6c7d8e90", []string{"3-1", "GPU-abc"}},
+		{"nvidia.com/mig-1g.5gb", DeviceName, "MIG-d2b9e6a1-8c5f-5e8a-9b1e-3f2a6c7d8e90", []string{"3-1", "nvidia3"}},
+		{"nvidia.com/gpu", GPUUID, "MIG-d2b9e6a1-8c5f-5e8a-9b1e-3f2a6c7d8e90", []string{"3-1", "GPU-abc"}}, // Single MIG strategy
+		{"nvidia.com/mig-1g.5gb", GPUUID, "MIG-00000000-0000-0000-0000-000000000000", nil},
+		{"example.com/gpu", GPUUID, "nvidia3", []string{"GPU-abc"}},
+		{"example.com/gpu", DeviceName, "nvidia3", []string{"nvidia3"}},
+		{"amd.com/gpu", GPUUID, "GPU-abc", nil},
+	}
+
+	resources, err := ParseGPUResources("nvidia.com/gpu=gpu-uuid, nvidia.com/mig-*=mig-uuid, example.com/*=device-name")
+	require.NoError(t, err)
+
+	for _, tt := range tests {
+		c := &Config{KubernetesGPUIdType: tt.idType, KubernetesGPUResources: resources}
+		device := &podresourcesv1.ContainerDevices{ResourceName: tt.resourceName, DeviceIds: []string{tt.id}}
+		require.Equal(t, tt.expected, DeviceIDs(device, c, sysInfo), "%+v", tt)
+	}
+}
+
 func GetGPUUUIDs(metrics [][]Metric) []string {
 	gpus := make([]string, len(metrics))
 	for i, dev := range metrics {
@@ -156,3 +500,47 @@ func (s *PodResourcesMockServer) List(ctx context.Context, req *podresourcesapi.
 	}, nil
 
 }
+
+// Serves the pods using the UUIDs with the v1 API
+type PodResourcesV1MockServer struct {
+	allocatable  []string
+	used         []string
+	resourceName string // nvidia.com/gpu if empty
+}
+
+func (s *PodResourcesV1MockServer) resource() string {
+	if s.resourceName == "" {
+		return nvidiaResourceName
+	}
+
+	return s.resourceName
+}
+
+func (s *PodResourcesV1MockServer) List(ctx context.Context, req *podresourcesv1.ListPodResourcesRequest) (*podresourcesv1.ListPodResourcesResponse, error) {
+	podResources := make([]*podresourcesv1.PodResources, len(s.used))
+
+	for i, gpu := range s.used {
+		podResources[i] = &podresourcesv1.PodResources{
+			Name:      fmt.Sprintf("gpu-pod-%d", i),
+			Namespace: "default",
+			Containers: []*podresourcesv1.ContainerResources{
+				{
+					Name:    "default",
+					Devices: []*podresourcesv1.ContainerDevices{{ResourceName: s.resource(), DeviceIds: []string{gpu}}},
+				},
+			},
+		}
+	}
+
+	return &podresourcesv1.ListPodResourcesResponse{PodResources: podResources}, nil
+}
+
+func (s *PodResourcesV1MockServer) GetAllocatableResources(ctx context.Context, req *podresourcesv1.AllocatableResourcesRequest) (*podresourcesv1.AllocatableResourcesResponse, error) {
+	if s.allocatable == nil {
+		return nil, status.Error(codes.Unimplemented, "Pod Resources API GetAllocatableResources disabled")
+	}
+
+	return &podresourcesv1.AllocatableResourcesResponse{
+		Devices: []*podresourcesv1.ContainerDevices{{ResourceName: s.resource(), DeviceIds: s.allocatable}},
+	}, nil
+}
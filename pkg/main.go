@@ -21,11 +21,9 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
-	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
@@ -33,19 +31,71 @@ import (
 var (
 	BuildVersion = "Filled by the build system"
 
-	CLIFieldsFile          = "collectors"
-	CLIAddress             = "address"
-	CLICollectInterval     = "collect-interval"
-	CLIKubernetes          = "kubernetes"
-	CLIKubernetesGPUIDType = "kubernetes-gpu-id-type"
-	CLIUseOldNamespace     = "use-old-namespace"
-	CLIRemoteHEInfo        = "remote-hostengine-info"
-	CLIDevices             = "devices"
-	CLINoHostname          = "no-hostname"
-	CLIUseFakeGpus         = "fake-gpus"
+	CLICollectorBackend          = "collector-backend"
+	CLISyntheticGPUs             = "synthetic-gpus"
+	CLIFieldsFile                = "collectors"
+	CLIAddress                   = "address"
+	CLICollectInterval           = "collect-interval"
+	CLICollectMode               = "collect-mode"
+	CLIScrapeMinInterval         = "scrape-min-interval"
+	CLIKubernetes                = "kubernetes"
+	CLIKubernetesGPUIDType       = "kubernetes-gpu-id-type"
+	CLIKubernetesRefreshInterval = "kubernetes-refresh-interval"
+	CLIKubernetesNodeName        = "kubernetes-node-name"
+	CLIKubernetesPodLabels       = "kubernetes-pod-labels"
+	CLIKubernetesPodAnnotations  = "kubernetes-pod-annotations"
+	CLIKubernetesPodOwners       = "kubernetes-pod-owners"
+	CLIKubernetesNodeLabels      = "kubernetes-node-labels"
+	CLIKubernetesSharedGPUs      = "kubernetes-shared-gpus"
+	CLIKubernetesGPUResources    = "kubernetes-gpu-resources"
+	CLISlurm                     = "slurm"
+	CLISlurmJobMappingDir        = "slurm-job-mapping-dir"
+	CLISlurmRefreshInterval      = "slurm-refresh-interval"
+	CLIContainers                = "containers"
+	CLIContainerRuntimeSocket    = "container-runtime-socket"
+	CLIContainerLabels           = "container-labels"
+	CLIContainerRefreshInterval  = "container-refresh-interval"
+	CLIUseOldNamespace           = "use-old-namespace"
+	CLIRemoteHEInfo              = "remote-hostengine-info"
+	CLIDevices                   = "devices"
+	CLINoHostname                = "no-hostname"
+	CLIUseFakeGpus               = "fake-gpus"
+	CLIRelabelConfigFile         = "relabel-config"
+	CLIRateConfigFile            = "rate-config"
+	CLIConfigFile                = "config"
+
+	CLINoHTTPServer               = "no-http-server"
+	CLIRemoteWriteURL             = "remote-write-url"
+	CLIRemoteWriteBearerTokenFile = "remote-write-bearer-token-file"
+	CLIRemoteWriteUsername        = "remote-write-username"
+	CLIRemoteWritePasswordFile    = "remote-write-password-file"
+	CLIRemoteWriteQueueSize       = "remote-write-queue-size"
+	CLIOTLPEndpoint               = "otlp-endpoint"
+	CLIOTLPProtocol               = "otlp-protocol"
+	CLIOTLPInsecure               = "otlp-insecure"
+	CLIInfluxDBURL                = "influxdb-url"
+	CLIInfluxDBTokenFile          = "influxdb-token-file"
+	CLIStatsDAddress              = "statsd-address"
+	CLIStatsDFormat               = "statsd-format"
+	CLIWebConfigFile              = "web-config-file"
+	CLIEnableCountersReload       = "enable-counters-reload"
 )
 
+// How often the config file is checked for changes
+var configWatchInterval = 5 * time.Second
+
 func main() {
+	c := NewApp()
+	c.Action = func(c *cli.Context) error {
+		return Run(c)
+	}
+
+	if err := c.Run(os.Args); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+func NewApp() *cli.App {
 	c := cli.NewApp()
 	c.Name = "DCGM Exporter"
 	c.Usage = "Generates GPU metrics in the prometheus format"
@@ -61,6 +111,24 @@ func main() {
 		"and therefore reporting must occur at the GPU instance level."
 
 	c.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    CLIConfigFile,
+			Value:   "",
+			Usage:   "Path to a YAML file mapping the names of the other flags to their values, the flags set on the command line or in the environment take precedence. The file is reloaded when it changes and on SIGHUP",
+			EnvVars: []string{"DCGM_EXPORTER_CONFIG"},
+		},
+		&cli.StringFlag{
+			Name:    CLICollectorBackend,
+			Value:   string(DCGMBackend),
+			Usage:   fmt.Sprintf("Backend used to collect metrics. Possible values: '%s', '%s' (deterministic values, no GPU or DCGM required)", DCGMBackend, SyntheticBackend),
+			EnvVars: []string{"DCGM_EXPORTER_COLLECTOR_BACKEND"},
+		},
+		&cli.IntFlag{
+			Name:    CLISyntheticGPUs,
+			Value:   1,
+			Usage:   fmt.Sprintf("Number of GPUs simulated by the '%s' collector backend", SyntheticBackend),
+			EnvVars: []string{"DCGM_EXPORTER_SYNTHETIC_GPUS"},
+		},
 		&cli.StringFlag{
 			Name:    CLIFieldsFile,
 			Aliases: []string{"f"},
@@ -82,6 +150,18 @@ func main() {
 			Usage:   "Interval of time at which point metrics are collected. Unit is milliseconds (ms).",
 			EnvVars: []string{"DCGM_EXPORTER_INTERVAL"},
 		},
+		&cli.StringFlag{
+			Name:    CLICollectMode,
+			Value:   string(IntervalCollectMode),
+			Usage:   fmt.Sprintf("When metrics are collected. Possible values: '%s' (every collect interval), '%s' (when /metrics is requested)", IntervalCollectMode, ScrapeCollectMode),
+			EnvVars: []string{"DCGM_EXPORTER_COLLECT_MODE"},
+		},
+		&cli.IntFlag{
+			Name:    CLIScrapeMinInterval,
+			Value:   1000,
+			Usage:   fmt.Sprintf("Minimum interval between two collections in the '%s' collect mode, requests in between get the cached metrics. Unit is milliseconds (ms).", ScrapeCollectMode),
+			EnvVars: []string{"DCGM_EXPORTER_SCRAPE_MIN_INTERVAL"},
+		},
 		&cli.BoolFlag{
 			Name:    CLIKubernetes,
 			Aliases: []string{"k"},
@@ -109,6 +189,96 @@ func main() {
 			Usage:   fmt.Sprintf("Choose Type of GPU ID to use to map kubernetes resources to pods. Possible values: '%s', '%s'", GPUUID, DeviceName),
 			EnvVars: []string{"DCGM_EXPORTER_KUBERNETES_GPU_ID_TYPE"},
 		},
+		&cli.IntFlag{
+			Name:    CLIKubernetesRefreshInterval,
+			Value:   5000,
+			Usage:   "Interval of time at which point the pods using the GPUs are listed from the kubelet, in the background of the collections. Unit is milliseconds (ms).",
+			EnvVars: []string{"DCGM_EXPORTER_KUBERNETES_REFRESH_INTERVAL"},
+		},
+		&cli.StringFlag{
+			Name:    CLIKubernetesNodeName,
+			Value:   "",
+			Usage:   "Name of the node of the exporter, required to look up the pods and the node from the Kubernetes API server",
+			EnvVars: []string{"NODE_NAME"},
+		},
+		&cli.StringFlag{
+			Name:    CLIKubernetesPodLabels,
+			Value:   "",
+			Usage:   "Comma separated list of the pod labels added to the metrics as 'label_<name>', looked up from the Kubernetes API server",
+			EnvVars: []string{"DCGM_EXPORTER_KUBERNETES_POD_LABELS"},
+		},
+		&cli.StringFlag{
+			Name:    CLIKubernetesPodAnnotations,
+			Value:   "",
+			Usage:   "Comma separated list of the pod annotations added to the metrics as 'annotation_<name>', looked up from the Kubernetes API server",
+			EnvVars: []string{"DCGM_EXPORTER_KUBERNETES_POD_ANNOTATIONS"},
+		},
+		&cli.BoolFlag{
+			Name:    CLIKubernetesPodOwners,
+			Value:   false,
+			Usage:   "Add the kind and name of the controller of the pods to the metrics as 'owner_kind' and 'owner_name', e.g: 'Deployment' or 'Job', looked up from the Kubernetes API server",
+			EnvVars: []string{"DCGM_EXPORTER_KUBERNETES_POD_OWNERS"},
+		},
+		&cli.StringFlag{
+			Name:    CLIKubernetesNodeLabels,
+			Value:   "",
+			Usage:   "Comma separated list of the node labels added to the metrics as 'node_label_<name>', looked up from the Kubernetes API server",
+			EnvVars: []string{"DCGM_EXPORTER_KUBERNETES_NODE_LABELS"},
+		},
+		&cli.StringFlag{
+			Name:    CLIKubernetesSharedGPUs,
+			Value:   string(JoinSharedGPUMode),
+			Usage:   fmt.Sprintf("How the metrics of the GPUs shared by several pods are attributed. Possible values: '%s' (the pods are joined in the labels, in order), '%s' (one series per pod, with a '%s' label)", JoinSharedGPUMode, SeriesSharedGPUMode, sharedAttribute),
+			EnvVars: []string{"DCGM_EXPORTER_KUBERNETES_SHARED_GPUS"},
+		},
+		&cli.StringFlag{
+			Name:    CLIKubernetesGPUResources,
+			Value:   fmt.Sprintf("%s=%s,%s=%s", nvidiaResourceName, GPUUUIDResourceID, nvidiaMigResourcePattern, MIGUUIDResourceID),
+			Usage:   fmt.Sprintf("Comma separated list of the GPU resources mapped to the pods, '<pattern>=<ID type>' where the pattern matches the resource names, e.g: 'nvidia.com/mig-*', and the devices are identified by their ID type. The first matching resource is used. Possible ID types: '%s', '%s', '%s'", GPUUUIDResourceID, MIGUUIDResourceID, DeviceNameResourceID),
+			EnvVars: []string{"DCGM_EXPORTER_KUBERNETES_GPU_RESOURCES"},
+		},
+		&cli.BoolFlag{
+			Name:    CLISlurm,
+			Value:   false,
+			Usage:   "Enable the mapping of the metrics to the Slurm jobs, from the processes in their cgroups (the /proc of the host is needed)",
+			EnvVars: []string{"DCGM_EXPORTER_SLURM"},
+		},
+		&cli.StringFlag{
+			Name:    CLISlurmJobMappingDir,
+			Value:   "",
+			Usage:   "Path to a directory where the prologs write a file per Slurm job, named after its ID and containing its SLURM_* environment variables",
+			EnvVars: []string{"DCGM_EXPORTER_SLURM_JOB_MAPPING_DIR"},
+		},
+		&cli.IntFlag{
+			Name:    CLISlurmRefreshInterval,
+			Value:   5000,
+			Usage:   "Interval of time at which point the Slurm jobs using the GPUs are listed, in the background of the collections. Unit is milliseconds (ms).",
+			EnvVars: []string{"DCGM_EXPORTER_SLURM_REFRESH_INTERVAL"},
+		},
+		&cli.BoolFlag{
+			Name:    CLIContainers,
+			Value:   false,
+			Usage:   "Enable the mapping of the metrics to the containers of the processes running on the GPUs, without Kubernetes (the /proc of the host is needed)",
+			EnvVars: []string{"DCGM_EXPORTER_CONTAINERS"},
+		},
+		&cli.StringFlag{
+			Name:    CLIContainerRuntimeSocket,
+			Value:   "",
+			Usage:   "Path to the socket of a Docker API compatible runtime (e.g: /var/run/docker.sock) to look up the names, images and labels of the containers",
+			EnvVars: []string{"DCGM_EXPORTER_CONTAINER_RUNTIME_SOCKET"},
+		},
+		&cli.StringFlag{
+			Name:    CLIContainerLabels,
+			Value:   "",
+			Usage:   "Comma separated list of the container labels added to the metrics as container_label_<name>",
+			EnvVars: []string{"DCGM_EXPORTER_CONTAINER_LABELS"},
+		},
+		&cli.IntFlag{
+			Name:    CLIContainerRefreshInterval,
+			Value:   5000,
+			Usage:   "Interval of time at which point the containers using the GPUs are listed, in the background of the collections. Unit is milliseconds (ms).",
+			EnvVars: []string{"DCGM_EXPORTER_CONTAINER_REFRESH_INTERVAL"},
+		},
 		&cli.StringFlag{
 			Name:    CLIDevices,
 			Aliases: []string{"d"},
@@ -129,94 +299,157 @@ func main() {
 			Usage:   "Accept GPUs that are fake, for testing purposes only",
 			EnvVars: []string{"DCGM_EXPORTER_USE_FAKE_GPUS"},
 		},
+		&cli.StringFlag{
+			Name:    CLIRelabelConfigFile,
+			Value:   "",
+			Usage:   "Path to a YAML file with Prometheus style 'relabel_configs' applied to every metric",
+			EnvVars: []string{"DCGM_EXPORTER_RELABEL_CONFIG"},
+		},
+		&cli.StringFlag{
+			Name:    CLIRateConfigFile,
+			Value:   "",
+			Usage:   "Path to a YAML file describing the gauges derived from the rate of cumulative counters",
+			EnvVars: []string{"DCGM_EXPORTER_RATE_CONFIG"},
+		},
+		&cli.BoolFlag{
+			Name:    CLINoHTTPServer,
+			Value:   false,
+			Usage:   "Don't serve the metrics over HTTP, e.g: when they are only pushed to a remote write endpoint",
+			EnvVars: []string{"DCGM_EXPORTER_NO_HTTP_SERVER"},
+		},
+		&cli.StringFlag{
+			Name:    CLIRemoteWriteURL,
+			Value:   "",
+			Usage:   "Push the metrics of every collection to this Prometheus remote write endpoint",
+			EnvVars: []string{"DCGM_EXPORTER_REMOTE_WRITE_URL"},
+		},
+		&cli.StringFlag{
+			Name:    CLIRemoteWriteBearerTokenFile,
+			Value:   "",
+			Usage:   "Path to the file containing the bearer token of the remote write endpoint",
+			EnvVars: []string{"DCGM_EXPORTER_REMOTE_WRITE_BEARER_TOKEN_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    CLIRemoteWriteUsername,
+			Value:   "",
+			Usage:   "Basic auth username of the remote write endpoint",
+			EnvVars: []string{"DCGM_EXPORTER_REMOTE_WRITE_USERNAME"},
+		},
+		&cli.StringFlag{
+			Name:    CLIRemoteWritePasswordFile,
+			Value:   "",
+			Usage:   "Path to the file containing the basic auth password of the remote write endpoint",
+			EnvVars: []string{"DCGM_EXPORTER_REMOTE_WRITE_PASSWORD_FILE"},
+		},
+		&cli.IntFlag{
+			Name:    CLIRemoteWriteQueueSize,
+			Value:   100,
+			Usage:   "Number of collections kept in memory while the remote write endpoint is unavailable",
+			EnvVars: []string{"DCGM_EXPORTER_REMOTE_WRITE_QUEUE_SIZE"},
+		},
+		&cli.StringFlag{
+			Name:    CLIOTLPEndpoint,
+			Value:   "",
+			Usage:   fmt.Sprintf("Export the metrics of every collection to this OTLP endpoint, '<host>:<port>' with the '%s' protocol or the URL of the metrics, e.g: 'http://localhost:4318/v1/metrics', with the '%s' protocol", OTLPGRPCProtocol, OTLPHTTPProtocol),
+			EnvVars: []string{"DCGM_EXPORTER_OTLP_ENDPOINT"},
+		},
+		&cli.StringFlag{
+			Name:    CLIOTLPProtocol,
+			Value:   string(OTLPGRPCProtocol),
+			Usage:   fmt.Sprintf("Protocol of the OTLP endpoint. Possible values: '%s', '%s'", OTLPGRPCProtocol, OTLPHTTPProtocol),
+			EnvVars: []string{"DCGM_EXPORTER_OTLP_PROTOCOL"},
+		},
+		&cli.BoolFlag{
+			Name:    CLIOTLPInsecure,
+			Value:   false,
+			Usage:   fmt.Sprintf("Disable TLS for the '%s' OTLP protocol, the scheme of the URL decides with the '%s' protocol", OTLPGRPCProtocol, OTLPHTTPProtocol),
+			EnvVars: []string{"DCGM_EXPORTER_OTLP_INSECURE"},
+		},
+		&cli.StringFlag{
+			Name:    CLIInfluxDBURL,
+			Value:   "",
+			Usage:   "Write the metrics of every collection as InfluxDB line protocol to this write URL, e.g: 'http://localhost:8086/api/v2/write?org=org&bucket=gpus' or 'udp://localhost:8089'",
+			EnvVars: []string{"DCGM_EXPORTER_INFLUXDB_URL"},
+		},
+		&cli.StringFlag{
+			Name:    CLIInfluxDBTokenFile,
+			Value:   "",
+			Usage:   "Path to the file containing the InfluxDB API token",
+			EnvVars: []string{"DCGM_EXPORTER_INFLUXDB_TOKEN_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    CLIStatsDAddress,
+			Value:   "",
+			Usage:   "Send the metrics of every collection as StatsD gauges to this UDP <HOST>:<PORT>",
+			EnvVars: []string{"DCGM_EXPORTER_STATSD_ADDRESS"},
+		},
+		&cli.StringFlag{
+			Name:    CLIStatsDFormat,
+			Value:   string(DogStatsDFormat),
+			Usage:   fmt.Sprintf("How the StatsD gauges are tagged. Possible values: '%s', '%s' (Telegraf)", DogStatsDFormat, InfluxStatsDFormat),
+			EnvVars: []string{"DCGM_EXPORTER_STATSD_FORMAT"},
+		},
+		&cli.StringFlag{
+			Name:    CLIWebConfigFile,
+			Value:   "",
+			Usage:   "Path to the web config file of the HTTP server, to enable TLS and authentication",
+			EnvVars: []string{"DCGM_EXPORTER_WEB_CONFIG_FILE"},
+		},
+		&cli.BoolFlag{
+			Name:    CLIEnableCountersReload,
+			Value:   false,
+			Usage:   "Serve the POST /api/v1/counters/reload endpoint, protect it with the web config file outside of localhost",
+			EnvVars: []string{"DCGM_EXPORTER_ENABLE_COUNTERS_RELOAD"},
+		},
 	}
 
-	c.Action = func(c *cli.Context) error {
-		return Run(c)
-	}
-
-	if err := c.Run(os.Args); err != nil {
-		logrus.Fatal(err)
-	}
+	return c
 }
 
 func Run(c *cli.Context) error {
-restart:
-
 	logrus.Info("Starting dcgm-exporter")
-	config, err := contextToConfig(c)
+	config, err := LoadConfig(c)
 	if err != nil {
 		return err
 	}
 
-	if config.UseRemoteHE {
-		logrus.Info("Attemping to connect to remote hostengine at ", config.RemoteHEInfo)
-		cleanup, err := dcgm.Init(dcgm.Standalone, config.RemoteHEInfo, "0")
-		defer cleanup()
-		if err != nil {
-			logrus.Fatal(err)
-		}
-	} else {
-		cleanup, err := dcgm.Init(dcgm.Embedded)
-		defer cleanup()
-		if err != nil {
-			logrus.Fatal(err)
-		}
-	}
-	logrus.Info("DCGM successfully initialized!")
-
-	dcgm.FieldsInit()
-	defer dcgm.FieldsTerm()
-
-	_, err = dcgm.GetSupportedMetricGroups(0)
-	if err != nil {
-		config.CollectDCP = false
-		logrus.Info("Not collecting DCP metrics: ", err)
-	} else {
-		logrus.Info("Collecting DCP Metrics")
-	}
-
-	ch := make(chan string, 10)
-	pipeline, cleanup, err := NewMetricsPipeline(config)
-	defer cleanup()
-	if err != nil {
-		logrus.Fatal(err)
-	}
-
-	server, cleanup, err := NewMetricsServer(config, ch)
-	defer cleanup()
+	exporter, err := StartExporter(config)
 	if err != nil {
 		return err
 	}
 
-	var wg sync.WaitGroup
-	stop := make(chan interface{})
-
-	wg.Add(1)
-	go pipeline.Run(ch, stop, &wg)
-
-	wg.Add(1)
-	go server.Run(stop, &wg)
+	var changes <-chan struct{}
+	if config.ConfigFile != "" {
+		stop := make(chan interface{})
+		defer close(stop)
+		changes = WatchFile(config.ConfigFile, configWatchInterval, stop)
+	}
 
 	sigs := newOSWatcher(syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
 	for {
 		select {
 		case sig := <-sigs:
-			close(stop)
-			err := WaitWithTimeout(&wg, time.Second*2)
-			if err != nil {
-				logrus.Fatal(err)
+			if sig != syscall.SIGHUP {
+				exporter.Stop()
+				return nil
 			}
 
-			if sig == syscall.SIGHUP {
-				goto restart
-			}
+			logrus.Info("Received SIGHUP, reloading the configuration")
+		case <-changes:
+			logrus.Infof("Config file %s changed, reloading the configuration", config.ConfigFile)
+		}
+
+		// An invalid configuration leaves the running exporter unchanged
+		config, err := LoadConfig(c)
+		if err != nil {
+			logrus.Errorf("Invalid configuration, keeping the running one: %v", err)
+			continue
+		}
 
-			return nil
+		if exporter, err = exporter.Reload(config); err != nil {
+			return err
 		}
 	}
-
-	return nil
 }
 
 func parseDeviceOptionsToken(token string, dOpt *DeviceOptions) error {
@@ -280,7 +513,7 @@ func parseDeviceOptionsToken(token string, dOpt *DeviceOptions) error {
 	return nil
 }
 
-func parseDeviceOptions(c *cli.Context) (DeviceOptions, error) {
+func parseDeviceOptions(c configSource) (DeviceOptions, error) {
 	var dOpt DeviceOptions
 	devices := c.String(CLIDevices)
 
@@ -344,24 +577,155 @@ func parseDeviceOptions(c *cli.Context) (DeviceOptions, error) {
 	return dOpt, nil
 }
 
-func contextToConfig(c *cli.Context) (*Config, error) {
+// splitList returns the non-empty items of a comma separated list
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func contextToConfig(c configSource) (*Config, error) {
 	dOpt, err := parseDeviceOptions(c)
 	if err != nil {
 		return nil, err
 	}
 
+	backend := CollectorBackend(c.String(CLICollectorBackend))
+	if backend != DCGMBackend && backend != SyntheticBackend {
+		return nil, fmt.Errorf("Invalid collector backend '%s', expected '%s' or '%s'", backend, DCGMBackend, SyntheticBackend)
+	}
+
+	mode := CollectMode(c.String(CLICollectMode))
+	if mode != IntervalCollectMode && mode != ScrapeCollectMode {
+		return nil, fmt.Errorf("Invalid collect mode '%s', expected '%s' or '%s'", mode, IntervalCollectMode, ScrapeCollectMode)
+	}
+
+	sharedGPUs := SharedGPUMode(c.String(CLIKubernetesSharedGPUs))
+	if sharedGPUs != JoinSharedGPUMode && sharedGPUs != SeriesSharedGPUMode {
+		return nil, fmt.Errorf("Invalid shared GPUs mode '%s', expected '%s' or '%s'", sharedGPUs, JoinSharedGPUMode, SeriesSharedGPUMode)
+	}
+
+	gpuResources, err := ParseGPUResources(c.String(CLIKubernetesGPUResources))
+	if err != nil {
+		return nil, err
+	}
+
+	otlpProtocol := OTLPProtocol(c.String(CLIOTLPProtocol))
+	if otlpProtocol != OTLPGRPCProtocol && otlpProtocol != OTLPHTTPProtocol {
+		return nil, fmt.Errorf("Invalid OTLP protocol '%s', expected '%s' or '%s'", otlpProtocol, OTLPGRPCProtocol, OTLPHTTPProtocol)
+	}
+
+	statsDFormat := StatsDFormat(c.String(CLIStatsDFormat))
+	if statsDFormat != DogStatsDFormat && statsDFormat != InfluxStatsDFormat {
+		return nil, fmt.Errorf("Invalid StatsD format '%s', expected '%s' or '%s'", statsDFormat, DogStatsDFormat, InfluxStatsDFormat)
+	}
+
+	// The metrics are pushed to these outputs after every collection
+	pushed := false
+	for _, output := range []struct{ name, flag string }{
+		{"Remote write", CLIRemoteWriteURL},
+		{"OTLP export", CLIOTLPEndpoint},
+		{"The InfluxDB output", CLIInfluxDBURL},
+		{"The StatsD output", CLIStatsDAddress},
+	} {
+		if c.String(output.flag) == "" {
+			continue
+		}
+
+		if mode == ScrapeCollectMode {
+			return nil, fmt.Errorf("%s requires the '%s' collect mode", output.name, IntervalCollectMode)
+		}
+		pushed = true
+	}
+
+	if c.Bool(CLINoHTTPServer) && !pushed {
+		return nil, fmt.Errorf("The HTTP server can only be disabled when metrics are pushed elsewhere")
+	}
+
+	podLabels := splitList(c.String(CLIKubernetesPodLabels))
+	podAnnotations := splitList(c.String(CLIKubernetesPodAnnotations))
+	nodeLabels := splitList(c.String(CLIKubernetesNodeLabels))
+	if len(podLabels) > 0 || len(podAnnotations) > 0 || len(nodeLabels) > 0 || c.Bool(CLIKubernetesPodOwners) {
+		if !c.Bool(CLIKubernetes) {
+			return nil, fmt.Errorf("The pod labels, annotations, owners and node labels require the kubernetes mapping")
+		}
+		if c.String(CLIKubernetesNodeName) == "" {
+			return nil, fmt.Errorf("The pod labels, annotations, owners and node labels require the node name")
+		}
+	}
+
+	// The old namespace has the container of the pod as container_name
+	if c.Bool(CLIContainers) && c.Bool(CLIKubernetes) && c.Bool(CLIUseOldNamespace) {
+		return nil, fmt.Errorf("The container mapping can't be used with the kubernetes mapping and the old namespace, both set the %s label", containerNameAttribute)
+	}
+
+	containerLabels := splitList(c.String(CLIContainerLabels))
+	if c.String(CLIContainerRuntimeSocket) != "" || len(containerLabels) > 0 {
+		if !c.Bool(CLIContainers) {
+			return nil, fmt.Errorf("The container runtime socket and labels require the container mapping")
+		}
+		if len(containerLabels) > 0 && c.String(CLIContainerRuntimeSocket) == "" {
+			return nil, fmt.Errorf("The container labels require the container runtime socket")
+		}
+	}
+
 	return &Config{
-		CollectorsFile:      c.String(CLIFieldsFile),
-		Address:             c.String(CLIAddress),
-		CollectInterval:     c.Int(CLICollectInterval),
-		Kubernetes:          c.Bool(CLIKubernetes),
-		KubernetesGPUIdType: KubernetesGPUIDType(c.String(CLIKubernetesGPUIDType)),
-		CollectDCP:          true,
-		UseOldNamespace:     c.Bool(CLIUseOldNamespace),
-		UseRemoteHE:         c.IsSet(CLIRemoteHEInfo),
-		RemoteHEInfo:        c.String(CLIRemoteHEInfo),
-		Devices:             dOpt,
-		NoHostname:          c.Bool(CLINoHostname),
-		UseFakeGpus:         c.Bool(CLIUseFakeGpus),
+		CollectorBackend:          backend,
+		SyntheticGPUs:             c.Int(CLISyntheticGPUs),
+		CollectorsFile:            c.String(CLIFieldsFile),
+		Address:                   c.String(CLIAddress),
+		CollectInterval:           c.Int(CLICollectInterval),
+		CollectMode:               mode,
+		ScrapeMinInterval:         c.Int(CLIScrapeMinInterval),
+		Kubernetes:                c.Bool(CLIKubernetes),
+		KubernetesGPUIdType:       KubernetesGPUIDType(c.String(CLIKubernetesGPUIDType)),
+		KubernetesRefreshInterval: c.Int(CLIKubernetesRefreshInterval),
+		KubernetesNodeName:        c.String(CLIKubernetesNodeName),
+		KubernetesPodLabels:       podLabels,
+		KubernetesPodAnnotations:  podAnnotations,
+		KubernetesPodOwners:       c.Bool(CLIKubernetesPodOwners),
+		KubernetesNodeLabels:      nodeLabels,
+		KubernetesSharedGPUs:      sharedGPUs,
+		KubernetesGPUResources:    gpuResources,
+		Slurm:                     c.Bool(CLISlurm),
+		SlurmJobMappingDir:        c.String(CLISlurmJobMappingDir),
+		SlurmRefreshInterval:      c.Int(CLISlurmRefreshInterval),
+		Containers:                c.Bool(CLIContainers),
+		ContainerRuntimeSocket:    c.String(CLIContainerRuntimeSocket),
+		ContainerLabels:           containerLabels,
+		ContainerRefreshInterval:  c.Int(CLIContainerRefreshInterval),
+		CollectDCP:                true,
+		UseOldNamespace:           c.Bool(CLIUseOldNamespace),
+		UseRemoteHE:               c.IsSet(CLIRemoteHEInfo),
+		RemoteHEInfo:              c.String(CLIRemoteHEInfo),
+		Devices:                   dOpt,
+		NoHostname:                c.Bool(CLINoHostname),
+		UseFakeGpus:               c.Bool(CLIUseFakeGpus),
+		RelabelConfigFile:         c.String(CLIRelabelConfigFile),
+		RateConfigFile:            c.String(CLIRateConfigFile),
+
+		NoHTTPServer:               c.Bool(CLINoHTTPServer),
+		RemoteWriteURL:             c.String(CLIRemoteWriteURL),
+		RemoteWriteBearerTokenFile: c.String(CLIRemoteWriteBearerTokenFile),
+		RemoteWriteUsername:        c.String(CLIRemoteWriteUsername),
+		RemoteWritePasswordFile:    c.String(CLIRemoteWritePasswordFile),
+		RemoteWriteQueueSize:       c.Int(CLIRemoteWriteQueueSize),
+
+		OTLPEndpoint: c.String(CLIOTLPEndpoint),
+		OTLPProtocol: otlpProtocol,
+		OTLPInsecure: c.Bool(CLIOTLPInsecure),
+
+		InfluxDBURL:       c.String(CLIInfluxDBURL),
+		InfluxDBTokenFile: c.String(CLIInfluxDBTokenFile),
+		StatsDAddress:     c.String(CLIStatsDAddress),
+		StatsDFormat:      statsDFormat,
+
+		WebConfigFile:        c.String(CLIWebConfigFile),
+		EnableCountersReload: c.Bool(CLIEnableCountersReload),
 	}, nil
 }
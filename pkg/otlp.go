@@ -0,0 +1,380 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	otlpTimeout = 30 * time.Second
+
+	// OpenTelemetry semantic conventions
+	otlpServiceNameAttribute = "service.name"
+	otlpHostNameAttribute    = "host.name"
+)
+
+func NewOTLPExporter(c *Config) (*OTLPExporter, func(), error) {
+	e := &OTLPExporter{
+		Endpoint: c.OTLPEndpoint,
+		Protocol: c.OTLPProtocol,
+		start:    otlpStart(),
+	}
+
+	switch c.OTLPProtocol {
+	case OTLPGRPCProtocol:
+		creds := grpc.WithInsecure()
+		if !c.OTLPInsecure {
+			creds = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))
+		}
+
+		// The connection is established in the background and re-established
+		// when it is lost, export calls fail in the meantime.
+		conn, err := grpc.Dial(c.OTLPEndpoint, creds)
+		if err != nil {
+			return nil, func() {}, err
+		}
+
+		e.client = colmetricspb.NewMetricsServiceClient(conn)
+		return e, func() { conn.Close() }, nil
+	case OTLPHTTPProtocol:
+		if !strings.HasPrefix(c.OTLPEndpoint, "http://") && !strings.HasPrefix(c.OTLPEndpoint, "https://") {
+			return nil, func() {}, fmt.Errorf("Invalid OTLP HTTP endpoint '%s', expected an http:// or https:// URL", c.OTLPEndpoint)
+		}
+
+		e.Client = &http.Client{Timeout: otlpTimeout}
+		return e, func() {}, nil
+	default:
+		return nil, func() {}, fmt.Errorf("Invalid OTLP protocol '%s', expected '%s' or '%s'", c.OTLPProtocol, OTLPGRPCProtocol, OTLPHTTPProtocol)
+	}
+}
+
+// otlpStart returns the start time of the counters. DCGM counts since the
+// driver was loaded, which isn't known: the start of the process is used so
+// that it doesn't change when the exporter is rebuilt by a reload.
+func otlpStart() time.Time {
+	collections, _ := selfMetrics.Collections()
+	return collections.Exporter
+}
+
+// Run exports every collection received. Failed exports aren't retried, the
+// sums and histograms are cumulative so the next export catches up.
+func (e *OTLPExporter) Run(in chan [][]Metric, stop chan interface{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	logrus.Infof("Exporting metrics to %s over OTLP/%s", e.Endpoint, e.Protocol)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case m := <-in:
+			if err := e.Export(EncodeExportRequest(m, e.start, time.Now())); err != nil {
+				logrus.Errorf("Failed to export metrics over OTLP: %v", err)
+			}
+		}
+	}
+}
+
+func (e *OTLPExporter) Export(req *colmetricspb.ExportMetricsServiceRequest) error {
+	if e.Protocol == OTLPGRPCProtocol {
+		ctx, cancel := context.WithTimeout(context.Background(), otlpTimeout)
+		defer cancel()
+
+		_, err := e.client.Export(ctx, req)
+		return err
+	}
+
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest("POST", e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("User-Agent", "dcgm-exporter/"+BuildVersion)
+
+	resp, err := e.Client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	return fmt.Errorf("OTLP endpoint returned HTTP status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// EncodeExportRequest converts a collection to OTLP metrics. The identity of
+// the GPU, or GPU instance, and the hostname are resource attributes, the
+// metrics of each resource are grouped together. The other attributes of the
+// metric, e.g: the pod attributes, are data point attributes and the data
+// points of a field are grouped in a single metric of the resource.
+//
+// Counters are cumulative monotonic sums that started with the exporter,
+// histograms are cumulative too and start with their aggregation. Gauges and info metrics are gauges, the value
+// of info metrics is the "value" attribute of a data point equal to 1.
+func EncodeExportRequest(metrics [][]Metric, start, ts time.Time) *colmetricspb.ExportMetricsServiceRequest {
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+	resources := map[string]*metricspb.InstrumentationLibraryMetrics{}
+	fields := map[string]map[string]*metricspb.Metric{}
+
+	for _, device := range metrics {
+		for _, m := range device {
+			metric := otlpMetric(m, start, ts)
+			if metric == nil {
+				continue
+			}
+
+			attributes := otlpResourceAttributes(m)
+			key := otlpAttributesKey(attributes)
+
+			lib, ok := resources[key]
+			if !ok {
+				lib = &metricspb.InstrumentationLibraryMetrics{
+					InstrumentationLibrary: &commonpb.InstrumentationLibrary{Name: "dcgm-exporter", Version: BuildVersion},
+				}
+				resources[key] = lib
+				fields[key] = map[string]*metricspb.Metric{}
+
+				req.ResourceMetrics = append(req.ResourceMetrics, &metricspb.ResourceMetrics{
+					Resource:                      &resourcepb.Resource{Attributes: attributes},
+					InstrumentationLibraryMetrics: []*metricspb.InstrumentationLibraryMetrics{lib},
+				})
+			}
+
+			if previous, ok := fields[key][metric.Name]; ok && otlpAppendDataPoints(previous, metric) {
+				continue
+			}
+
+			fields[key][metric.Name] = metric
+			lib.Metrics = append(lib.Metrics, metric)
+		}
+	}
+
+	return req
+}
+
+// otlpAppendDataPoints appends the data points of a metric to the ones of the
+// same field, it returns false if their types differ.
+func otlpAppendDataPoints(dst, src *metricspb.Metric) bool {
+	switch data := src.Data.(type) {
+	case *metricspb.Metric_Gauge:
+		if gauge := dst.GetGauge(); gauge != nil {
+			gauge.DataPoints = append(gauge.DataPoints, data.Gauge.DataPoints...)
+			return true
+		}
+	case *metricspb.Metric_Sum:
+		if sum := dst.GetSum(); sum != nil {
+			sum.DataPoints = append(sum.DataPoints, data.Sum.DataPoints...)
+			return true
+		}
+	case *metricspb.Metric_Histogram:
+		if histogram := dst.GetHistogram(); histogram != nil {
+			histogram.DataPoints = append(histogram.DataPoints, data.Histogram.DataPoints...)
+			return true
+		}
+	case *metricspb.Metric_Summary:
+		if summary := dst.GetSummary(); summary != nil {
+			summary.DataPoints = append(summary.DataPoints, data.Summary.DataPoints...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func otlpResourceAttributes(m Metric) []*commonpb.KeyValue {
+	attributes := []*commonpb.KeyValue{otlpAttribute(otlpServiceNameAttribute, "dcgm-exporter")}
+
+	// Empty labels were either not set or dropped by the relabeling
+	for _, l := range [...][2]string{
+		{otlpHostNameAttribute, m.Hostname},
+		{gpuLabel, m.GPU},
+		{m.UUID, m.GPUUUID},
+		{deviceLabel, m.GPUDevice},
+		{modelNameLabel, m.GPUModelName},
+		{migProfileLabel, m.MigProfile},
+		{gpuInstanceIDLabel, m.GPUInstanceID},
+	} {
+		if l[1] != "" {
+			attributes = append(attributes, otlpAttribute(l[0], l[1]))
+		}
+	}
+
+	return attributes
+}
+
+func otlpAttributesKey(attributes []*commonpb.KeyValue) string {
+	var key strings.Builder
+	for _, a := range attributes {
+		key.WriteString(a.Key)
+		key.WriteByte(0)
+		key.WriteString(a.Value.GetStringValue())
+		key.WriteByte(0)
+	}
+
+	return key.String()
+}
+
+func otlpAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
+
+func otlpDataPointAttributes(m Metric) []*commonpb.KeyValue {
+	keys := make([]string, 0, len(m.Attributes))
+	for k, v := range m.Attributes {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	attributes := make([]*commonpb.KeyValue, 0, len(keys)+1)
+	for _, k := range keys {
+		attributes = append(attributes, otlpAttribute(k, m.Attributes[k]))
+	}
+
+	return attributes
+}
+
+// otlpMetric returns nil for metrics without a numerical value, e.g: when the
+// field is blank.
+func otlpMetric(m Metric, start, ts time.Time) *metricspb.Metric {
+	if !m.Timestamp.IsZero() {
+		ts = m.Timestamp
+	}
+
+	metric := &metricspb.Metric{
+		Name:        m.Counter.FieldName,
+		Description: m.Counter.Help,
+		Unit:        m.Counter.Unit,
+	}
+
+	attributes := otlpDataPointAttributes(m)
+	startNano := uint64(start.UnixNano())
+	tsNano := uint64(ts.UnixNano())
+	d := m.Distribution
+	if d != nil && !d.Start.IsZero() {
+		startNano = uint64(d.Start.UnixNano())
+	}
+
+	switch {
+	case m.Counter.PromType == "info":
+		attributes = append(attributes, otlpAttribute("value", m.Value))
+		metric.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+			DataPoints: []*metricspb.NumberDataPoint{otlpNumberDataPoint(attributes, 0, tsNano, 1)},
+		}}
+	case m.Counter.PromType == "histogram" && d != nil:
+		// OTLP bucket counts aren't cumulative and include the +Inf bucket
+		point := &metricspb.HistogramDataPoint{
+			Attributes:        attributes,
+			StartTimeUnixNano: startNano,
+			TimeUnixNano:      tsNano,
+			Count:             d.Count,
+			Sum:               d.Sum,
+		}
+
+		var previous uint64
+		for _, b := range d.Buckets {
+			point.ExplicitBounds = append(point.ExplicitBounds, b.UpperBound)
+			point.BucketCounts = append(point.BucketCounts, b.Count-previous)
+			previous = b.Count
+		}
+		point.BucketCounts = append(point.BucketCounts, d.Count-previous)
+
+		metric.Data = &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+			DataPoints:             []*metricspb.HistogramDataPoint{point},
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		}}
+	case m.Counter.PromType == "summary" && d != nil:
+		point := &metricspb.SummaryDataPoint{
+			Attributes:        attributes,
+			StartTimeUnixNano: startNano,
+			TimeUnixNano:      tsNano,
+			Count:             d.Count,
+			Sum:               d.Sum,
+		}
+
+		for _, q := range d.Quantiles {
+			point.QuantileValues = append(point.QuantileValues, &metricspb.SummaryDataPoint_ValueAtQuantile{Quantile: q.Quantile, Value: q.Value})
+		}
+
+		metric.Data = &metricspb.Metric_Summary{Summary: &metricspb.Summary{
+			DataPoints: []*metricspb.SummaryDataPoint{point},
+		}}
+	default:
+		v, err := strconv.ParseFloat(m.Value, 64)
+		if err != nil {
+			return nil
+		}
+
+		if m.Counter.PromType == "counter" {
+			metric.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				DataPoints:             []*metricspb.NumberDataPoint{otlpNumberDataPoint(attributes, startNano, tsNano, v)},
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+			}}
+		} else {
+			metric.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+				DataPoints: []*metricspb.NumberDataPoint{otlpNumberDataPoint(attributes, 0, tsNano, v)},
+			}}
+		}
+	}
+
+	return metric
+}
+
+func otlpNumberDataPoint(attributes []*commonpb.KeyValue, start, ts uint64, v float64) *metricspb.NumberDataPoint {
+	return &metricspb.NumberDataPoint{
+		Attributes:        attributes,
+		StartTimeUnixNano: start,
+		TimeUnixNano:      ts,
+		Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: v},
+	}
+}
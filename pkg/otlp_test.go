@@ -0,0 +1,197 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
+	"github.com/stretchr/testify/require"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+type testMetricsService struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+
+	requests chan *colmetricspb.ExportMetricsServiceRequest
+}
+
+func (s *testMetricsService) Export(_ context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	s.requests <- req
+	return &colmetricspb.ExportMetricsServiceResponse{}, nil
+}
+
+func TestEncodeExportRequest(t *testing.T) {
+	histogram := Counter{FieldID: dcgm.DCGM_FI_PROF_SM_OCCUPANCY, FieldName: "DCGM_FI_PROF_SM_OCCUPANCY", PromType: "histogram"}
+	metrics := sampleMetrics()
+	metrics[0][0].Attributes["pod"] = "pod"
+	metrics[0] = append(metrics[0], Metric{
+		Counter:      &histogram,
+		GPU:          "0",
+		Distribution: &Distribution{Buckets: []Bucket{{0.5, 1}, {1, 3}}, Sum: 2.7, Count: 4, Start: time.Unix(1600000030, 0)},
+	})
+	metrics = append(metrics, sampleMetrics()[0][:1])
+	metrics[1][0].GPU = "1"
+
+	// A second data point of the energy of GPU 0, e.g: for another pod
+	energy := metrics[0][0]
+	energy.Attributes = map[string]string{"pod": "other-pod"}
+	energy.Value = "2000"
+	metrics[0] = append(metrics[0], energy)
+
+	start := time.Unix(1600000000, 0)
+	ts := start.Add(time.Minute)
+	req := EncodeExportRequest(metrics, start, ts)
+
+	// The histogram lacks the GPU identity of the others, it's a different resource
+	require.Len(t, req.ResourceMetrics, 3)
+	require.Equal(t, map[string]string{
+		"service.name": "dcgm-exporter",
+		"gpu":          "0",
+		"UUID":         "GPU-0000",
+		"device":       "nvidia0",
+		"modelName":    "Tesla T4",
+	}, testAttributes(req.ResourceMetrics[0].Resource.Attributes))
+	require.Equal(t, "1", testAttributes(req.ResourceMetrics[2].Resource.Attributes)["gpu"])
+
+	gpu0 := req.ResourceMetrics[0].InstrumentationLibraryMetrics[0].Metrics
+	require.Len(t, gpu0, 3)
+
+	sum := gpu0[0]
+	require.Equal(t, "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION", sum.Name)
+	require.Equal(t, "millijoules", sum.Unit)
+	require.Equal(t, metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, sum.GetSum().AggregationTemporality)
+	require.True(t, sum.GetSum().IsMonotonic)
+	require.Len(t, sum.GetSum().DataPoints, 2)
+	point := sum.GetSum().DataPoints[0]
+	require.Equal(t, float64(1000), point.GetAsDouble())
+	require.Equal(t, uint64(start.UnixNano()), point.StartTimeUnixNano)
+	require.Equal(t, uint64(ts.UnixNano()), point.TimeUnixNano)
+	require.Equal(t, map[string]string{"pod": "pod"}, testAttributes(point.Attributes))
+	require.Equal(t, float64(2000), sum.GetSum().DataPoints[1].GetAsDouble())
+	require.Equal(t, map[string]string{"pod": "other-pod"}, testAttributes(sum.GetSum().DataPoints[1].Attributes))
+
+	require.Equal(t, float64(70), gpu0[1].GetGauge().DataPoints[0].GetAsDouble())
+
+	driver := gpu0[2].GetGauge().DataPoints[0]
+	require.Equal(t, float64(1), driver.GetAsDouble())
+	require.Equal(t, map[string]string{"value": "460.32"}, testAttributes(driver.Attributes))
+
+	h := req.ResourceMetrics[1].InstrumentationLibraryMetrics[0].Metrics[0].GetHistogram()
+	require.Equal(t, metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, h.AggregationTemporality)
+	require.Equal(t, []float64{0.5, 1}, h.DataPoints[0].ExplicitBounds)
+	require.Equal(t, []uint64{1, 2, 1}, h.DataPoints[0].BucketCounts)
+	require.Equal(t, uint64(4), h.DataPoints[0].Count)
+	require.Equal(t, 2.7, h.DataPoints[0].Sum)
+
+	// The histograms start with their aggregation
+	require.Equal(t, uint64(time.Unix(1600000030, 0).UnixNano()), h.DataPoints[0].StartTimeUnixNano)
+}
+
+func TestOTLPExporterGRPC(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	service := &testMetricsService{requests: make(chan *colmetricspb.ExportMetricsServiceRequest, 1)}
+	server := grpc.NewServer()
+	colmetricspb.RegisterMetricsServiceServer(server, service)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	exporter, cleanup, err := NewOTLPExporter(&Config{OTLPEndpoint: listener.Addr().String(), OTLPProtocol: OTLPGRPCProtocol, OTLPInsecure: true})
+	defer cleanup()
+	require.NoError(t, err)
+
+	testRunOTLPExporter(t, exporter, service.requests)
+}
+
+func TestOTLPExporterHTTP(t *testing.T) {
+	requests := make(chan *colmetricspb.ExportMetricsServiceRequest, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/metrics", r.URL.Path)
+		require.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		req := &colmetricspb.ExportMetricsServiceRequest{}
+		require.NoError(t, proto.Unmarshal(body, req))
+		requests <- req
+	}))
+	defer receiver.Close()
+
+	config := &Config{OTLPEndpoint: receiver.URL + "/v1/metrics", OTLPProtocol: OTLPHTTPProtocol}
+	exporter, cleanup, err := NewOTLPExporter(config)
+	defer cleanup()
+	require.NoError(t, err)
+
+	testRunOTLPExporter(t, exporter, requests)
+
+	// The counters don't restart when the exporter is rebuilt
+	rebuilt, _, err := NewOTLPExporter(config)
+	require.NoError(t, err)
+	require.Equal(t, exporter.start, rebuilt.start)
+}
+
+func TestNewOTLPExporterErrors(t *testing.T) {
+	_, _, err := NewOTLPExporter(&Config{OTLPEndpoint: "localhost:4318", OTLPProtocol: OTLPHTTPProtocol})
+	require.Error(t, err)
+
+	_, _, err = NewOTLPExporter(&Config{OTLPEndpoint: "localhost:4317", OTLPProtocol: "thrift"})
+	require.Error(t, err)
+}
+
+func testRunOTLPExporter(t *testing.T, exporter *OTLPExporter, requests chan *colmetricspb.ExportMetricsServiceRequest) {
+	var wg sync.WaitGroup
+	in := make(chan [][]Metric)
+	stop := make(chan interface{})
+
+	wg.Add(1)
+	go exporter.Run(in, stop, &wg)
+	defer wg.Wait()
+	defer close(stop)
+
+	in <- sampleMetrics()
+
+	select {
+	case req := <-requests:
+		require.Len(t, req.ResourceMetrics, 1)
+		require.Len(t, req.ResourceMetrics[0].InstrumentationLibraryMetrics[0].Metrics, 3)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the OTLP export")
+	}
+}
+
+func testAttributes(attributes []*commonpb.KeyValue) map[string]string {
+	m := map[string]string{}
+	for _, a := range attributes {
+		m[a.Key] = a.Value.GetStringValue()
+	}
+
+	return m
+}
@@ -20,7 +20,10 @@ import (
 	"encoding/csv"
 	"fmt"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
 	"github.com/sirupsen/logrus"
@@ -50,6 +53,8 @@ func ReadCSVFile(filename string) ([][]string, error) {
 	defer file.Close()
 
 	r := csv.NewReader(file)
+	// The interval column is optional
+	r.FieldsPerRecord = -1
 	records, err := r.ReadAll()
 
 	return records, err
@@ -73,8 +78,17 @@ func extractCounters(records [][]string, dcpAllowed bool) ([]Counter, error) {
 			continue
 		}
 
-		if len(record) != 3 {
-			return nil, fmt.Errorf("Malformed CSV record, failed to parse line %d (`%v`), expected 3 fields", i, record)
+		if len(record) < 3 || len(record) > 5 {
+			return nil, fmt.Errorf("Malformed CSV record, failed to parse line %d (`%v`), expected 3 to 5 fields", i, record)
+		}
+
+		var interval time.Duration
+		if len(record) >= 4 && record[3] != "" {
+			var err error
+			interval, err = time.ParseDuration(record[3])
+			if err != nil || interval <= 0 {
+				return nil, fmt.Errorf("Invalid interval `%s` on line %d, expected a positive duration (e.g: 1s, 500ms, 1m)", record[3], i)
+			}
 		}
 
 		fieldID, ok := dcgm.DCGM_FI[record[0]]
@@ -97,7 +111,14 @@ func extractCounters(records [][]string, dcpAllowed bool) ([]Counter, error) {
 				return nil, fmt.Errorf("Could not find Prometheus metry type %s", record[1])
 			}
 
-			f = append(f, Counter{fieldID, record[0], record[1], record[2]})
+			f = append(f, Counter{
+				FieldID:   fieldID,
+				FieldName: record[0],
+				PromType:  record[1],
+				Help:      record[2],
+				Unit:      unitFromHelp(record[2]),
+				Interval:  interval,
+			})
 		} else {
 			if !dcpAllowed && oldFieldID >= 1000 {
 				logrus.Warnf("Skipping line %d ('%s'): DCP metrics not enabled", i, record[0])
@@ -108,14 +129,76 @@ func extractCounters(records [][]string, dcpAllowed bool) ([]Counter, error) {
 				return nil, fmt.Errorf("Could not find Prometheus metry type %s", record[1])
 			}
 
-			f = append(f, Counter{oldFieldID, record[0], record[1], record[2]})
+			f = append(f, Counter{
+				FieldID:   oldFieldID,
+				FieldName: record[0],
+				PromType:  record[1],
+				Help:      record[2],
+				Unit:      unitFromHelp(record[2]),
+				Interval:  interval,
+			})
+		}
+
+		var distribution string
+		if len(record) == 5 {
+			distribution = record[4]
+		}
 
+		if err := setDistribution(&f[len(f)-1], distribution); err != nil {
+			return nil, fmt.Errorf("Invalid buckets or quantiles `%s` on line %d: %v", distribution, i, err)
 		}
 	}
 
 	return f, nil
 }
 
+// The buckets of a histogram and the quantiles of a summary are space
+// separated values, the defaults are used if there are none.
+func setDistribution(c *Counter, distribution string) error {
+	var values []float64
+	for _, field := range strings.Fields(distribution) {
+		v, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return err
+		}
+
+		values = append(values, v)
+	}
+
+	switch c.PromType {
+	case "histogram":
+		if len(values) == 0 {
+			values = DefaultBuckets
+		}
+
+		for i := 1; i < len(values); i++ {
+			if values[i] <= values[i-1] {
+				return fmt.Errorf("buckets must be in increasing order")
+			}
+		}
+
+		c.Buckets = values
+	case "summary":
+		if len(values) == 0 {
+			values = DefaultQuantiles
+		}
+
+		for _, q := range values {
+			if q < 0 || q > 1 {
+				return fmt.Errorf("quantiles must be between 0 and 1")
+			}
+		}
+
+		c.Quantiles = values
+	default:
+		if len(values) > 0 {
+			return fmt.Errorf("only histograms and summaries have buckets or quantiles")
+		}
+	}
+
+	return nil
+}
+
 func recordIsCommentOrEmpty(s []string) bool {
 	if len(s) == 0 {
 		return true
@@ -127,3 +210,27 @@ func recordIsCommentOrEmpty(s []string) bool {
 
 	return false
 }
+
+// The help messages of the counters files document units as "(in <unit>)"
+var helpUnitRegexp = regexp.MustCompile(`\(in ([^)]+)\)`)
+
+var openMetricsUnits = map[string]string{
+	"%":   "percent",
+	"B/s": "bytes_per_second",
+	"C":   "celsius",
+	"KB":  "kilobytes",
+	"MHz": "megahertz",
+	"MiB": "mebibytes",
+	"W":   "watts",
+	"mJ":  "millijoules",
+	"us":  "microseconds",
+}
+
+func unitFromHelp(help string) string {
+	match := helpUnitRegexp.FindStringSubmatch(help)
+	if match == nil {
+		return ""
+	}
+
+	return openMetricsUnits[match[1]]
+}
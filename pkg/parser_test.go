@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractCounters(t *testing.T) {
+	records := [][]string{
+		{"# Format", "", ""},
+		{"DCGM_FI_DEV_POWER_USAGE", " gauge", " Power draw (in W).", " 1s"},
+		{"DCGM_FI_DEV_GPU_TEMP", "gauge", "GPU temperature (in C)."},
+		{"DCGM_FI_DEV_RETIRED_SBE", "counter", "Total number of retired pages due to single-bit errors.", "1m"},
+		{"DCGM_FI_DEV_MEM_CLOCK", "gauge", "Memory clock frequency (in MHz).", ""},
+		{"DCGM_FI_DEV_GPU_UTIL", "histogram", "GPU utilization (in %).", "", "10 50  90"},
+		{"DCGM_FI_DEV_MEM_COPY_UTIL", "summary", "Memory utilization (in %).", "1s"},
+		{"DCGM_FI_DEV_ENC_UTIL", "histogram", "Encoder utilization (in %).", "100ms", "25 75"},
+	}
+
+	counters, err := extractCounters(records, false)
+	require.NoError(t, err)
+	require.Len(t, counters, 7)
+
+	require.Equal(t, dcgm.Short(dcgm.DCGM_FI_DEV_POWER_USAGE), counters[0].FieldID)
+	require.Equal(t, "watts", counters[0].Unit)
+	require.Equal(t, time.Second, counters[0].Interval)
+	require.Equal(t, "celsius", counters[1].Unit)
+	require.Equal(t, time.Duration(0), counters[1].Interval)
+	require.Equal(t, time.Minute, counters[2].Interval)
+	require.Equal(t, time.Duration(0), counters[3].Interval)
+	require.Equal(t, []float64{10, 50, 90}, counters[4].Buckets)
+	require.Equal(t, DefaultQuantiles, counters[5].Quantiles)
+	require.Equal(t, 100*time.Millisecond, counters[6].Interval)
+	require.Equal(t, []float64{25, 75}, counters[6].Buckets)
+}
+
+func TestExtractCountersErrors(t *testing.T) {
+	invalid := [][][]string{
+		{{"DCGM_FI_DEV_GPU_TEMP", "gauge"}},
+		{{"DCGM_FI_DEV_GPU_TEMP", "gauge", "Help", "1s", "extra"}},
+		{{"DCGM_FI_DEV_GPU_TEMP", "gauge", "Help", "fast"}},
+		{{"DCGM_FI_DEV_GPU_TEMP", "gauge", "Help", "-1s"}},
+		{{"DCGM_FI_DEV_GPU_TEMP", "gaugeish", "Help"}},
+		{{"DCGM_FI_DEV_NOT_A_FIELD", "gauge", "Help"}},
+		{{"DCGM_FI_DEV_GPU_TEMP", "histogram", "Help", "", "10 5"}},
+		{{"DCGM_FI_DEV_GPU_TEMP", "histogram", "Help", "", "ten"}},
+		{{"DCGM_FI_DEV_GPU_TEMP", "summary", "Help", "", "0.5 1.5"}},
+		{{"DCGM_FI_DEV_GPU_TEMP", "histogram", "Help", "", "1", "extra"}},
+		{{"DCGM_FI_DEV_GPU_TEMP", "histogram", "Help", "fast", "10 50"}},
+	}
+
+	for _, records := range invalid {
+		_, err := extractCounters(records, false)
+		require.Error(t, err, "Expected an error for %v", records)
+	}
+}
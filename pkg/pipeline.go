@@ -17,10 +17,9 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
+	"reflect"
 	"sync"
-	"text/template"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -32,44 +31,114 @@ func NewMetricsPipeline(c *Config) (*MetricsPipeline, func(), error) {
 		return nil, func() {}, err
 	}
 
-	gpuCollector, cleanup, err := NewDCGMCollector(counters, c)
+	gpuCollector, cleanup, err := NewCollector(counters, c)
 	if err != nil {
 		return nil, func() {}, err
 	}
 
 	transformations := []Transform{}
-	if c.Kubernetes {
-		transformations = append(transformations, NewPodMapper(c))
+	// Rates are computed first so that the derived metrics get the same labels as their source
+	if c.RateConfigFile != "" {
+		rates, err := NewRateCalculator(c, counters)
+		if err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+
+		transformations = append(transformations, rates)
 	}
 
-	return &MetricsPipeline{
-			config: c,
+	// The mappers refresh their mapping in the background until the pipeline is
+	// cleaned up
+	mappers := []struct {
+		enabled bool
+		build   func() (Transform, func(), error)
+	}{
+		{c.Kubernetes, func() (Transform, func(), error) { return NewPodMapper(c, gpuCollector.SysInfo()) }},
+		{c.Slurm, func() (Transform, func(), error) { return NewJobMapper(c, gpuCollector.SysInfo()) }},
+		{c.Containers, func() (Transform, func(), error) { return NewContainerMapper(c) }},
+	}
+	for _, mapper := range mappers {
+		if !mapper.enabled {
+			continue
+		}
 
-			metricsFormat:    template.Must(template.New("metrics").Parse(metricsFormat)),
-			migMetricsFormat: template.Must(template.New("migMetrics").Parse(migMetricsFormat)),
+		transform, mapperCleanup, err := mapper.build()
+		if err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
 
-			counters:        counters,
-			gpuCollector:    gpuCollector,
-			transformations: transformations,
-		}, func() {
+		collectorCleanup := cleanup
+		cleanup = func() {
+			mapperCleanup()
+			collectorCleanup()
+		}
+		transformations = append(transformations, transform)
+	}
+
+	// Relabeling is applied last so that it can act on the labels added by the other transforms
+	if c.RelabelConfigFile != "" {
+		relabeler, err := NewRelabeler(c)
+		if err != nil {
 			cleanup()
-		}, nil
+			return nil, func() {}, err
+		}
+
+		transformations = append(transformations, relabeler)
+	}
+
+	pipeline := &MetricsPipeline{
+		config: c,
+
+		counters:        counters,
+		gpuCollector:    gpuCollector,
+		transformations: transformations,
+	}
+
+	// The counters may be reloaded while the pipeline is stopped
+	return pipeline, func() {
+		pipeline.Lock()
+		defer pipeline.Unlock()
+
+		pipeline.closed = true
+		cleanup()
+	}, nil
 }
 
 // Primarely for testing, caller expected to cleanup the collector
-func NewMetricsPipelineWithGPUCollector(c *Config, collector *DCGMCollector) (*MetricsPipeline, func(), error) {
+func NewMetricsPipelineWithGPUCollector(c *Config, collector Collector) (*MetricsPipeline, func(), error) {
 	return &MetricsPipeline{
 		config: c,
 
-		metricsFormat:    template.Must(template.New("metrics").Parse(metricsFormat)),
-		migMetricsFormat: template.Must(template.New("migMetrics").Parse(migMetricsFormat)),
-
-		counters:     collector.Counters,
 		gpuCollector: collector,
 	}, func() {}, nil
 }
 
-func (m *MetricsPipeline) Run(out chan string, stop chan interface{}, wg *sync.WaitGroup) {
+func NewCollector(counters []Counter, c *Config) (Collector, func(), error) {
+	switch c.CollectorBackend {
+	case DCGMBackend, "":
+		collector, cleanup, err := NewDCGMCollector(counters, c)
+		if err != nil {
+			return nil, func() {}, err
+		}
+
+		return collector, cleanup, nil
+	case SyntheticBackend:
+		collector, cleanup, err := NewSyntheticCollector(counters, c)
+		if err != nil {
+			return nil, func() {}, err
+		}
+
+		return collector, cleanup, nil
+	}
+
+	return nil, func() {}, fmt.Errorf("unsupported collector backend '%s'", c.CollectorBackend)
+}
+
+// Run sends the result of each collection to every output (e.g: the HTTP
+// server, the remote writer), an output that can't keep up is skipped.
+func (m *MetricsPipeline) Run(outs []chan [][]Metric, stop chan interface{}, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	logrus.Info("Pipeline starting")
@@ -91,92 +160,92 @@ func (m *MetricsPipeline) Run(out chan string, stop chan interface{}, wg *sync.W
 				continue
 			}
 
-			if len(out) == cap(out) {
-				logrus.Errorf("Channel is full skipping")
-			} else {
-				out <- o
+			for _, out := range outs {
+				if len(out) == cap(out) {
+					// The exporter skips the outputs that can't keep up, they
+					// count their dropped collections
+					logrus.Errorf("Channel is full skipping")
+				} else {
+					out <- o
+				}
 			}
 		}
 	}
 }
 
-func (m *MetricsPipeline) run() (string, error) {
-	metrics, err := m.gpuCollector.GetMetrics()
+// Collect runs the pipeline once, it must not be called concurrently (see MetricsCache)
+func (m *MetricsPipeline) Collect() ([][]Metric, error) {
+	return m.run()
+}
+
+// ReloadCounters reads the counters file again and updates the collector and
+// the transforms that depend on the counters. If the file is invalid or the
+// collector can't watch the new fields, the current counters are kept.
+func (m *MetricsPipeline) ReloadCounters() error {
+	counters, err := ExtractCounters(m.config.CollectorsFile, m.config.CollectDCP)
 	if err != nil {
-		return "", fmt.Errorf("Failed to collect metrics with error: %v", err)
+		return err
 	}
 
-	for _, transform := range m.transformations {
-		err := transform.Process(metrics, m.gpuCollector.SysInfo)
-		if err != nil {
-			return "", fmt.Errorf("Failed to transform metrics for transorm %s: %v", err, transform.Name())
-		}
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return fmt.Errorf("The pipeline is stopped")
 	}
 
-	formated, err := FormatMetrics(m.migMetricsFormat, metrics)
-	if err != nil {
-		return "", fmt.Errorf("Failed to format metrics with error: %v", err)
+	if reflect.DeepEqual(counters, m.counters) {
+		return nil
 	}
 
-	return formated, nil
+	if err := m.gpuCollector.UpdateCounters(counters); err != nil {
+		return err
+	}
+
+	// The relabeler keeps a copy of the renamed counters, the rates only
+	// depend on the field names
+	for i, transform := range m.transformations {
+		if r, ok := transform.(*Relabeler); ok {
+			m.transformations[i] = NewRelabelerWithConfigs(r.Configs)
+		}
+	}
+
+	m.counters = counters
+	logrus.Infof("Reloaded %d counters from %s", len(counters), m.config.CollectorsFile)
+
+	return nil
 }
 
-/*
-* The goal here is to get to the following format:
-* ```
-* # HELP FIELD_ID HELP_MSG
-* # TYPE FIELD_ID PROM_TYPE
-* FIELD_ID{gpu="GPU_INDEX_0",uuid="GPU_UUID", attr...} VALUE
-* FIELD_ID{gpu="GPU_INDEX_N",uuid="GPU_UUID", attr...} VALUE
-* ...
-* ```
- */
+// Formatting is left to the consumers of the pipeline (e.g: the HTTP server
+// negotiates the exposition format with each scraper).
+func (m *MetricsPipeline) run() (_ [][]Metric, err error) {
+	m.Lock()
+	defer m.Unlock()
 
-var metricsFormat = `
-{{- range $counter, $metrics := . -}}
-# HELP {{ $counter.FieldName }} {{ $counter.Help }}
-# TYPE {{ $counter.FieldName }} {{ $counter.PromType }}
-{{- range $metric := $metrics }}
-{{ $counter.FieldName }}{gpu="{{ $metric.GPU }}",{{ $metric.UUID }}="{{ $metric.GPUUUID }}",device="{{ $metric.GPUDevice }}",modelName="{{ $metric.GPUModelName }}"
-
-{{- range $k, $v := $metric.Attributes -}}
-	,{{ $k }}="{{ $v }}"
-{{- end -}}
-
-} {{ $metric.Value -}}
-{{- end }}
-{{ end }}`
-
-var migMetricsFormat = `
-{{- range $counter, $metrics := . -}}
-# HELP {{ $counter.FieldName }} {{ $counter.Help }}
-# TYPE {{ $counter.FieldName }} {{ $counter.PromType }}
-{{- range $metric := $metrics }}
-{{ $counter.FieldName }}{gpu="{{ $metric.GPU }}",{{ $metric.UUID }}="{{ $metric.GPUUUID }}",device="{{ $metric.GPUDevice }}",modelName="{{ $metric.GPUModelName }}"{{if $metric.MigProfile}},GPU_I_PROFILE="{{ $metric.MigProfile }}",GPU_I_ID="{{ $metric.GPUInstanceID }}"{{end}}{{if $metric.Hostname }},Hostname="{{ $metric.Hostname }}"{{end}}
-
-{{- range $k, $v := $metric.Attributes -}}
-	,{{ $k }}="{{ $v }}"
-{{- end -}}
-
-} {{ $metric.Value -}}
-{{- end }}
-{{ end }}`
-
-// Template is passed here so that it isn't recompiled at each iteration
-func FormatMetrics(t *template.Template, m [][]Metric) (string, error) {
-	// Group metrics by counter instead of by device
-	groupedMetrics := make(map[*Counter][]Metric)
-	for _, deviceMetrics := range m {
-		for _, deviceMetric := range deviceMetrics {
-			groupedMetrics[deviceMetric.Counter] = append(groupedMetrics[deviceMetric.Counter], deviceMetric)
-		}
+	if m.closed {
+		return nil, fmt.Errorf("The pipeline is stopped")
+	}
+
+	selfMetrics.CollectionStarted()
+	defer func() { selfMetrics.CollectionFinished(err) }()
+
+	start := time.Now()
+	metrics, err := m.gpuCollector.GetMetrics()
+	selfMetrics.ObserveDuration(CollectStage, "", time.Since(start))
+	if err != nil {
+		selfMetrics.CountError(CollectStage, "")
+		return nil, fmt.Errorf("Failed to collect metrics with error: %v", err)
 	}
 
-	// Format metrics
-	var res bytes.Buffer
-	if err := t.Execute(&res, groupedMetrics); err != nil {
-		return "", err
+	for _, transform := range m.transformations {
+		start := time.Now()
+		err := transform.Process(metrics, m.gpuCollector.SysInfo())
+		selfMetrics.ObserveDuration(TransformStage, transform.Name(), time.Since(start))
+		if err != nil {
+			selfMetrics.CountError(TransformStage, transform.Name())
+			return nil, fmt.Errorf("Failed to transform metrics for transorm %s: %v", err, transform.Name())
+		}
 	}
 
-	return res.String(), nil
+	return metrics, nil
 }
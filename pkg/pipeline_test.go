@@ -17,6 +17,8 @@
 package main
 
 import (
+	"io/ioutil"
+	"strings"
 	"testing"
 
 	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
@@ -38,8 +40,70 @@ func TestRun(t *testing.T) {
 	require.NoError(t, err)
 	require.NotEmpty(t, out)
 
+	var formated strings.Builder
+	err = EncodeMetrics(&formated, TextFormat, out)
+	require.NoError(t, err)
+
 	// Note it is pretty difficult to make non superficial tests without
 	// writting a full blown parser, always look at the results
 	// We'll be testing them more throughly in the e2e tests (e.g: by running prometheus).
-	t.Logf("Pipeline result is:\n%v", out)
+	t.Logf("Pipeline result is:\n%v", formated.String())
+}
+
+func TestRunSynthetic(t *testing.T) {
+	c, cleanup := testSyntheticCollector(t, sampleCounters, 2)
+	defer cleanup()
+
+	p, cleanup, err := NewMetricsPipelineWithGPUCollector(&Config{}, c)
+	require.NoError(t, err)
+	defer cleanup()
+
+	out, err := p.run()
+	require.NoError(t, err)
+	require.Len(t, out, 2)
+
+	var formated strings.Builder
+	err = EncodeMetrics(&formated, TextFormat, out)
+	require.NoError(t, err)
+	require.Contains(t, formated.String(), "# TYPE DCGM_FI_DEV_GPU_TEMP gauge")
+}
+
+func TestReloadCounters(t *testing.T) {
+	config := &Config{
+		CollectorBackend: SyntheticBackend,
+		SyntheticGPUs:    1,
+		CollectorsFile:   writeTestFile(t, "DCGM_FI_DEV_GPU_TEMP, gauge, GPU temperature (in C).\n"),
+		Devices:          DeviceOptions{true, []int{-1}, []int{-1}},
+		NoHostname:       true,
+	}
+
+	p, cleanup, err := NewMetricsPipeline(config)
+	require.NoError(t, err)
+	defer cleanup()
+
+	fieldNames := func() []string {
+		out, err := p.run()
+		require.NoError(t, err)
+
+		var names []string
+		for _, m := range out[0] {
+			names = append(names, m.Counter.FieldName)
+		}
+		return names
+	}
+
+	require.Equal(t, []string{"DCGM_FI_DEV_GPU_TEMP"}, fieldNames())
+
+	content := "DCGM_FI_DEV_GPU_TEMP, gauge, GPU temperature (in C).\nDCGM_FI_DEV_POWER_USAGE, gauge, Power draw (in W).\n"
+	require.NoError(t, ioutil.WriteFile(config.CollectorsFile, []byte(content), 0644))
+	require.NoError(t, p.ReloadCounters())
+	require.Equal(t, []string{"DCGM_FI_DEV_GPU_TEMP", "DCGM_FI_DEV_POWER_USAGE"}, fieldNames())
+
+	// An invalid file keeps the current counters
+	require.NoError(t, ioutil.WriteFile(config.CollectorsFile, []byte("DCGM_FI_DEV_NOT_A_FIELD, gauge, Invalid.\n"), 0644))
+	require.Error(t, p.ReloadCounters())
+	require.Equal(t, []string{"DCGM_FI_DEV_GPU_TEMP", "DCGM_FI_DEV_POWER_USAGE"}, fieldNames())
+
+	cleanup()
+	require.Error(t, p.ReloadCounters())
 }
@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+func LoadRateConfigs(filename string) ([]RateConfig, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var file RateConfigFile
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, fmt.Errorf("Failed to parse rate configs %s: %v", filename, err)
+	}
+
+	names := make(map[string]bool)
+	for i, c := range file.Rates {
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("Invalid rate config #%d in %s: %v", i, filename, err)
+		}
+
+		if names[c.Name] {
+			return nil, fmt.Errorf("Invalid rate config #%d in %s: duplicate name '%s'", i, filename, c.Name)
+		}
+		names[c.Name] = true
+	}
+
+	return file.Rates, nil
+}
+
+func (c *RateConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RateConfig
+
+	*c = RateConfig{Scale: 1}
+
+	return unmarshal((*plain)(c))
+}
+
+func (c *RateConfig) validate() error {
+	if c.Source == "" {
+		return fmt.Errorf("'source' is required")
+	}
+
+	if !metricNameRegexp.MatchString(c.Name) {
+		return fmt.Errorf("invalid metric name '%s'", c.Name)
+	}
+
+	if c.Scale <= 0 {
+		return fmt.Errorf("'scale' must be positive, got %f", c.Scale)
+	}
+
+	return nil
+}
+
+func NewRateCalculator(c *Config, counters []Counter) (*RateCalculator, error) {
+	configs, err := LoadRateConfigs(c.RateConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	collected := make(map[string]bool, len(counters))
+	for _, counter := range counters {
+		collected[counter.FieldName] = true
+	}
+
+	for _, rc := range configs {
+		if !collected[rc.Source] {
+			logrus.Warnf("Rate %s will not be exported: its source %s is not collected", rc.Name, rc.Source)
+		}
+	}
+
+	logrus.Infof("Computing %d rates of cumulative counters", len(configs))
+
+	return NewRateCalculatorWithConfigs(configs), nil
+}
+
+func NewRateCalculatorWithConfigs(configs []RateConfig) *RateCalculator {
+	r := &RateCalculator{
+		Configs:  configs,
+		counters: make(map[string][]rateCounter),
+		samples:  make(map[rateKey]rateSample),
+	}
+
+	for _, c := range configs {
+		r.counters[c.Source] = append(r.counters[c.Source], rateCounter{
+			counter: &Counter{
+				FieldName: c.Name,
+				PromType:  "gauge",
+				Help:      c.Help,
+				Unit:      unitFromHelp(c.Help),
+			},
+			scale: c.Scale,
+		})
+	}
+
+	return r
+}
+
+func (r *RateCalculator) Name() string {
+	return "rateCalculator"
+}
+
+// Samples of entities that are not collected anymore are forgotten, only
+// the samples seen during this collection are kept.
+func (r *RateCalculator) Process(metrics [][]Metric, sysInfo SystemInfo) error {
+	now := time.Now()
+	samples := make(map[rateKey]rateSample, len(r.samples))
+
+	for i, device := range metrics {
+		for _, m := range device {
+			rates, ok := r.counters[m.Counter.FieldName]
+			if !ok {
+				continue
+			}
+
+			value, err := strconv.ParseFloat(m.Value, 64)
+			if err != nil {
+				logrus.Debugf("Skipping rates of %s: failed to parse value '%s'", m.Counter.FieldName, m.Value)
+				continue
+			}
+
+			ts := m.Timestamp
+			if ts.IsZero() {
+				ts = now
+			}
+
+			for _, rc := range rates {
+				key := rateKey{name: rc.counter.FieldName, gpu: m.GPU, instance: m.GPUInstanceID}
+				sample := rateSample{value: value, ts: ts}
+
+				if prev, ok := r.samples[key]; ok {
+					sample = NextRateSample(prev, sample, rc.scale)
+				}
+				samples[key] = sample
+
+				if !sample.valid {
+					continue
+				}
+
+				metrics[i] = append(metrics[i], derivedMetric(m, rc.counter, sample.rate))
+			}
+		}
+	}
+
+	r.samples = samples
+
+	return nil
+}
+
+// NextRateSample computes the scaled per second increase of a cumulative
+// counter since the previous sample. A decrease is a counter reset (e.g: the
+// driver was reloaded), the counter is assumed to have restarted from zero.
+// The last rate is kept when DCGM didn't update the field since the previous
+// collection, which happens when the watch frequency is slower than the
+// collection interval.
+func NextRateSample(prev, cur rateSample, scale float64) rateSample {
+	elapsed := cur.ts.Sub(prev.ts).Seconds()
+	if elapsed <= 0 {
+		return prev
+	}
+
+	increase := cur.value - prev.value
+	if increase < 0 {
+		increase = cur.value
+	}
+
+	cur.rate = increase / elapsed * scale
+	cur.valid = true
+
+	return cur
+}
+
+func derivedMetric(m Metric, c *Counter, value float64) Metric {
+	attributes := make(map[string]string, len(m.Attributes))
+	for k, v := range m.Attributes {
+		attributes[k] = v
+	}
+
+	m.Counter = c
+	m.Value = fmt.Sprintf("%f", value)
+	m.Attributes = attributes
+	m.Distribution = nil
+
+	return m
+}
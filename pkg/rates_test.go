@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateCalculator(t *testing.T) {
+	configs, err := LoadRateConfigs(writeTestFile(t, `
+rates:
+  - source: DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION
+    name: DCGM_FI_DEV_AVG_POWER_USAGE
+    help: Average power usage over the collection interval (in W).
+    scale: 0.001
+`))
+	require.NoError(t, err)
+
+	energy := Counter{FieldID: dcgm.DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION, FieldName: "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION", PromType: "counter", Help: "Energy"}
+	start := time.Unix(1600000000, 0)
+	r := NewRateCalculatorWithConfigs(configs)
+
+	tests := []struct {
+		value    string
+		elapsed  time.Duration
+		expected []string
+	}{
+		{"1000000", 0, nil}, // No previous sample
+		{"1600000", 10 * time.Second, []string{"60.000000"}}, // 600J in 10s
+		{"1600000", 10 * time.Second, []string{"60.000000"}}, // Not updated by DCGM since the last collection
+		{"2200000", 20 * time.Second, []string{"60.000000"}},
+		{"300000", 25 * time.Second, []string{"60.000000"}}, // Counter reset
+		{"300000", 30 * time.Second, []string{"0.000000"}},
+	}
+
+	for i, tc := range tests {
+		m := Metric{Counter: &energy, Value: tc.value, GPU: "0", Timestamp: start.Add(tc.elapsed), Attributes: map[string]string{"a": "b"}}
+		metrics := [][]Metric{{m}}
+		require.NoError(t, r.Process(metrics, SystemInfo{}))
+
+		var rates []string
+		for _, m := range metrics[0][1:] {
+			require.Equal(t, "DCGM_FI_DEV_AVG_POWER_USAGE", m.Counter.FieldName)
+			require.Equal(t, "gauge", m.Counter.PromType)
+			require.Equal(t, "watts", m.Counter.Unit)
+			require.Equal(t, map[string]string{"a": "b"}, m.Attributes)
+			rates = append(rates, m.Value)
+		}
+
+		require.Equal(t, tc.expected, rates, "Collection #%d", i)
+	}
+}
+
+func TestRateCalculatorEntities(t *testing.T) {
+	counter := Counter{FieldID: dcgm.DCGM_FI_DEV_PCIE_REPLAY_COUNTER, FieldName: "DCGM_FI_DEV_PCIE_REPLAY_COUNTER", PromType: "counter"}
+	r := NewRateCalculatorWithConfigs([]RateConfig{{Source: counter.FieldName, Name: "DCGM_FI_DEV_PCIE_REPLAY_RATE", Scale: 1}})
+
+	start := time.Unix(1600000000, 0)
+	collect := func(elapsed time.Duration, values ...string) [][]Metric {
+		var metrics [][]Metric
+		for gpu, v := range values {
+			metrics = append(metrics, []Metric{{Counter: &counter, Value: v, GPU: string(rune('0' + gpu)), Timestamp: start.Add(elapsed)}})
+		}
+		require.NoError(t, r.Process(metrics, SystemInfo{}))
+
+		return metrics
+	}
+
+	collect(0, "0", "100")
+	metrics := collect(time.Second, "10", "300")
+	require.Equal(t, "10.000000", metrics[0][1].Value)
+	require.Equal(t, "200.000000", metrics[1][1].Value)
+
+	// GPU 1 disappeared, its previous sample is forgotten
+	collect(2*time.Second, "20")
+	metrics = collect(3*time.Second, "30", "400")
+	require.Len(t, metrics[1], 1)
+}
+
+func TestLoadRateConfigsErrors(t *testing.T) {
+	tests := []string{
+		"rates:\n  - name: RATE\n",
+		"rates:\n  - source: DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION\n    name: invalid-name\n",
+		"rates:\n  - source: DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION\n    name: RATE\n    scale: 0\n",
+		"rates:\n  - source: A\n    name: RATE\n  - source: B\n    name: RATE\n",
+		"rates:\n  - source: A\n    name: RATE\n    unknown: true\n",
+	}
+
+	for _, content := range tests {
+		_, err := LoadRateConfigs(writeTestFile(t, content))
+		require.Error(t, err, content)
+	}
+}
@@ -0,0 +1,304 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	metricNameLabel = "__name__"
+
+	gpuLabel           = "gpu"
+	deviceLabel        = "device"
+	modelNameLabel     = "modelName"
+	migProfileLabel    = "GPU_I_PROFILE"
+	gpuInstanceIDLabel = "GPU_I_ID"
+	hostnameLabel      = "Hostname"
+)
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// The relabel configs follow the format and semantics of Prometheus' relabel_configs
+func LoadRelabelConfigs(filename string) ([]RelabelConfig, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var file RelabelConfigFile
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, fmt.Errorf("Failed to parse relabel configs %s: %v", filename, err)
+	}
+
+	for i := range file.RelabelConfigs {
+		if err := file.RelabelConfigs[i].validate(); err != nil {
+			return nil, fmt.Errorf("Invalid relabel config #%d in %s: %v", i, filename, err)
+		}
+	}
+
+	return file.RelabelConfigs, nil
+}
+
+func (c *RelabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RelabelConfig
+
+	*c = RelabelConfig{
+		Separator:   ";",
+		Regex:       "(.*)",
+		Replacement: "$1",
+		Action:      RelabelReplace,
+	}
+
+	return unmarshal((*plain)(c))
+}
+
+func (c *RelabelConfig) validate() error {
+	regex, err := regexp.Compile("^(?:" + c.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("Invalid regex '%s': %v", c.Regex, err)
+	}
+	c.regex = regex
+
+	switch c.Action {
+	case RelabelReplace:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("'target_label' is required for action '%s'", c.Action)
+		}
+	case RelabelHashMod:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("'target_label' is required for action '%s'", c.Action)
+		}
+		if c.Modulus == 0 {
+			return fmt.Errorf("'modulus' is required for action '%s'", c.Action)
+		}
+	case RelabelKeep, RelabelDrop:
+	case RelabelLabelMap, RelabelLabelDrop, RelabelLabelKeep:
+		if len(c.SourceLabels) > 0 || c.TargetLabel != "" {
+			return fmt.Errorf("'source_labels' and 'target_label' are not allowed for action '%s'", c.Action)
+		}
+	default:
+		return fmt.Errorf("Unknown action '%s'", c.Action)
+	}
+
+	return nil
+}
+
+func NewRelabeler(c *Config) (*Relabeler, error) {
+	configs, err := LoadRelabelConfigs(c.RelabelConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Relabeling enabled with %d relabel configs", len(configs))
+
+	return NewRelabelerWithConfigs(configs), nil
+}
+
+func NewRelabelerWithConfigs(configs []RelabelConfig) *Relabeler {
+	return &Relabeler{
+		Configs:  configs,
+		counters: make(map[renamedCounter]*Counter),
+	}
+}
+
+func (r *Relabeler) Name() string {
+	return "relabeler"
+}
+
+func (r *Relabeler) Process(metrics [][]Metric, sysInfo SystemInfo) error {
+	for i, device := range metrics {
+		// Filter in place, the metrics kept are never ahead of the ones read
+		kept := device[:0]
+		for _, m := range device {
+			labels := MetricLabels(m)
+			if !Relabel(labels, r.Configs) || labels[metricNameLabel] == "" {
+				continue
+			}
+
+			kept = append(kept, r.applyLabels(m, labels))
+		}
+
+		metrics[i] = kept
+	}
+
+	return nil
+}
+
+// MetricLabels returns the labels of a metric as exported, the metric name
+// is under the "__name__" label.
+func MetricLabels(m Metric) map[string]string {
+	labels := make(map[string]string, len(m.Attributes)+8)
+	for k, v := range m.Attributes {
+		labels[k] = v
+	}
+
+	labels[metricNameLabel] = m.Counter.FieldName
+	labels[gpuLabel] = m.GPU
+	labels[m.UUID] = m.GPUUUID
+	labels[deviceLabel] = m.GPUDevice
+	labels[modelNameLabel] = m.GPUModelName
+
+	if m.MigProfile != "" {
+		labels[migProfileLabel] = m.MigProfile
+		labels[gpuInstanceIDLabel] = m.GPUInstanceID
+	}
+
+	if m.Hostname != "" {
+		labels[hostnameLabel] = m.Hostname
+	}
+
+	return labels
+}
+
+func (r *Relabeler) applyLabels(m Metric, labels map[string]string) Metric {
+	if name := labels[metricNameLabel]; name != m.Counter.FieldName {
+		m.Counter = r.renamed(m.Counter, name)
+	}
+
+	// Labels that were dropped are left empty and aren't exported
+	m.GPU = labels[gpuLabel]
+	m.GPUUUID = labels[m.UUID]
+	m.GPUDevice = labels[deviceLabel]
+	m.GPUModelName = labels[modelNameLabel]
+	m.MigProfile = labels[migProfileLabel]
+	m.GPUInstanceID = labels[gpuInstanceIDLabel]
+	m.Hostname = labels[hostnameLabel]
+
+	for _, k := range []string{gpuLabel, m.UUID, deviceLabel, modelNameLabel, migProfileLabel, gpuInstanceIDLabel, hostnameLabel} {
+		delete(labels, k)
+	}
+
+	m.Attributes = make(map[string]string, len(labels))
+	for k, v := range labels {
+		// Labels starting with "__" are internal to the relabeling
+		if strings.HasPrefix(k, "__") {
+			continue
+		}
+		m.Attributes[k] = v
+	}
+
+	return m
+}
+
+// Renamed counters are shared by all the metrics with the same name so that
+// they are still exported as a single family.
+func (r *Relabeler) renamed(c *Counter, name string) *Counter {
+	key := renamedCounter{c, name}
+	if renamed, ok := r.counters[key]; ok {
+		return renamed
+	}
+
+	renamed := *c
+	renamed.FieldName = name
+	r.counters[key] = &renamed
+
+	return &renamed
+}
+
+// Relabel applies the relabel configs to the labels in place, it returns
+// false if the metric should be dropped.
+func Relabel(labels map[string]string, configs []RelabelConfig) bool {
+	for _, c := range configs {
+		if !relabel(labels, &c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func relabel(labels map[string]string, c *RelabelConfig) bool {
+	values := make([]string, 0, len(c.SourceLabels))
+	for _, name := range c.SourceLabels {
+		values = append(values, labels[name])
+	}
+	val := strings.Join(values, c.Separator)
+
+	switch c.Action {
+	case RelabelDrop:
+		if c.regex.MatchString(val) {
+			return false
+		}
+	case RelabelKeep:
+		if !c.regex.MatchString(val) {
+			return false
+		}
+	case RelabelReplace:
+		indexes := c.regex.FindStringSubmatchIndex(val)
+		if indexes == nil {
+			break
+		}
+
+		target := string(c.regex.ExpandString(nil, c.TargetLabel, val, indexes))
+		if !labelNameRegexp.MatchString(target) {
+			break
+		}
+
+		res := string(c.regex.ExpandString(nil, c.Replacement, val, indexes))
+		if res == "" {
+			delete(labels, target)
+			break
+		}
+		labels[target] = res
+	case RelabelHashMod:
+		labels[c.TargetLabel] = fmt.Sprintf("%d", sum64(md5.Sum([]byte(val)))%c.Modulus)
+	case RelabelLabelMap:
+		mapped := make(map[string]string)
+		for name, value := range labels {
+			if c.regex.MatchString(name) {
+				mapped[c.regex.ReplaceAllString(name, c.Replacement)] = value
+			}
+		}
+		for name, value := range mapped {
+			labels[name] = value
+		}
+	case RelabelLabelDrop:
+		for name := range labels {
+			if name != metricNameLabel && c.regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	case RelabelLabelKeep:
+		for name := range labels {
+			if name != metricNameLabel && !c.regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	}
+
+	return true
+}
+
+// Same as Prometheus, only the last 8 bytes of the hash are used
+func sum64(hash [md5.Size]byte) uint64 {
+	var s uint64
+
+	for i, b := range hash {
+		shift := uint64((md5.Size - i - 1) * 8)
+		s |= uint64(b) << shift
+	}
+
+	return s
+}
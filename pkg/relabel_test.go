@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelabelKeepAndRename(t *testing.T) {
+	configs := loadTestRelabelConfigs(t, `
+relabel_configs:
+  - source_labels: [__name__]
+    regex: DCGM_FI_DEV_POWER_USAGE.*
+    action: keep
+  - source_labels: [__name__]
+    regex: DCGM_FI_DEV_POWER_USAGE_(.*)
+    target_label: __name__
+    replacement: gpu_power_usage_$1
+  - regex: modelName|Hostname
+    action: labeldrop
+`)
+
+	metrics := relabelSampleMetrics()
+	second := make([]Metric, len(metrics[0]))
+	for i, m := range metrics[0] {
+		m.GPU = "1"
+		second[i] = m
+	}
+	metrics = append(metrics, second)
+
+	r := NewRelabelerWithConfigs(configs)
+	require.NoError(t, r.Process(metrics, SystemInfo{}))
+
+	require.Len(t, metrics[0], 1)
+	require.Len(t, metrics[1], 1)
+	require.Equal(t, "gpu_power_usage_watts", metrics[0][0].Counter.FieldName)
+	require.Equal(t, "", metrics[0][0].GPUModelName)
+	require.Equal(t, "", metrics[0][0].Hostname)
+
+	// Renamed metrics of every device belong to the same family
+	require.True(t, metrics[0][0].Counter == metrics[1][0].Counter)
+
+	var out strings.Builder
+	require.NoError(t, EncodeMetrics(&out, TextFormat, metrics))
+	require.Equal(t, `# HELP gpu_power_usage_watts Power help info
+# TYPE gpu_power_usage_watts gauge
+gpu_power_usage_watts{gpu="0",UUID="GPU-0000",device="nvidia0"} 70.000000
+gpu_power_usage_watts{gpu="1",UUID="GPU-0000",device="nvidia0"} 70.000000
+`, out.String())
+}
+
+func TestRelabelDropAndReplace(t *testing.T) {
+	configs := loadTestRelabelConfigs(t, `
+relabel_configs:
+  - source_labels: [__name__]
+    regex: .*(ENERGY|VERSION).*
+    action: drop
+  - source_labels: [gpu, device]
+    separator: "-"
+    target_label: gpu_id
+  - regex: (model)Name
+    replacement: ${1}
+    action: labelmap
+  - source_labels: [UUID]
+    modulus: 4
+    target_label: shard
+    action: hashmod
+`)
+
+	metrics := relabelSampleMetrics()
+	require.NoError(t, NewRelabelerWithConfigs(configs).Process(metrics, SystemInfo{}))
+	require.Len(t, metrics[0], 1)
+
+	m := metrics[0][0]
+	require.Equal(t, "DCGM_FI_DEV_POWER_USAGE_watts", m.Counter.FieldName)
+	require.Equal(t, "0-nvidia0", m.Attributes["gpu_id"])
+	require.Equal(t, "Tesla T4", m.Attributes["model"])
+	require.Equal(t, "Tesla T4", m.GPUModelName)
+	require.Contains(t, []string{"0", "1", "2", "3"}, m.Attributes["shard"])
+	require.Equal(t, "node", m.Hostname)
+}
+
+func TestLoadRelabelConfigsErrors(t *testing.T) {
+	tests := []string{
+		"relabel_configs:\n  - action: unknown\n",
+		"relabel_configs:\n  - regex: \"(\"\n    action: keep\n",
+		"relabel_configs:\n  - source_labels: [gpu]\n",
+		"relabel_configs:\n  - target_label: shard\n    action: hashmod\n",
+		"relabel_configs:\n  - source_labels: [gpu]\n    action: labeldrop\n",
+		"relabel_configs:\n  - unknown_field: true\n",
+	}
+
+	for _, content := range tests {
+		_, err := LoadRelabelConfigs(writeTestFile(t, content))
+		require.Error(t, err, content)
+	}
+}
+
+func loadTestRelabelConfigs(t *testing.T, content string) []RelabelConfig {
+	configs, err := LoadRelabelConfigs(writeTestFile(t, content))
+	require.NoError(t, err)
+
+	return configs
+}
+
+func writeTestFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "dcgm-exporter")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	filename := filepath.Join(dir, "config.yaml")
+	require.NoError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+
+	return filename
+}
+
+func relabelSampleMetrics() [][]Metric {
+	metrics := sampleMetrics()
+	for i := range metrics[0] {
+		metrics[0][i].Hostname = "node"
+	}
+
+	return metrics
+}
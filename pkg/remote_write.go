@@ -0,0 +1,327 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	remoteWriteTimeout    = 30 * time.Second
+	remoteWriteMinBackoff = 500 * time.Millisecond
+	remoteWriteMaxBackoff = 30 * time.Second
+)
+
+func NewRemoteWriter(c *Config) (*RemoteWriter, error) {
+	if c.RemoteWriteQueueSize < 1 {
+		return nil, fmt.Errorf("Invalid remote write queue size %d, expected a positive value", c.RemoteWriteQueueSize)
+	}
+
+	w := &RemoteWriter{
+		URL:      c.RemoteWriteURL,
+		Client:   &http.Client{Timeout: remoteWriteTimeout},
+		Username: c.RemoteWriteUsername,
+
+		queue:      newRequestQueue(c.RemoteWriteQueueSize),
+		minBackoff: remoteWriteMinBackoff,
+		maxBackoff: remoteWriteMaxBackoff,
+	}
+
+	var err error
+	if c.RemoteWriteBearerTokenFile != "" {
+		if w.BearerToken, err = readSecretFile(c.RemoteWriteBearerTokenFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.RemoteWritePasswordFile != "" {
+		if w.Password, err = readSecretFile(c.RemoteWritePasswordFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if w.BearerToken != "" && w.Username != "" {
+		return nil, fmt.Errorf("Remote write bearer token and basic auth are mutually exclusive")
+	}
+
+	return w, nil
+}
+
+func readSecretFile(filename string) (string, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+// Run pushes every collection received to the remote write endpoint. The
+// requests are queued in memory while the endpoint is unavailable, the oldest
+// ones are dropped when the queue is full. The write in progress is cancelled
+// when it stops.
+func (w *RemoteWriter) Run(in chan [][]Metric, stop chan interface{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	logrus.Infof("Pushing metrics to %s", w.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var senderwg sync.WaitGroup
+	senderwg.Add(1)
+	go func() {
+		defer senderwg.Done()
+		w.send(ctx)
+	}()
+
+	for {
+		select {
+		case <-stop:
+			cancel()
+			senderwg.Wait()
+			return
+		case m := <-in:
+			req := snappy.Encode(nil, EncodeWriteRequest(m, time.Now()))
+			if w.queue.push(req) {
+				logrus.Warnf("Remote write queue is full, dropping the oldest collection")
+			}
+		}
+	}
+}
+
+func (w *RemoteWriter) send(ctx context.Context) {
+	for {
+		req, ok := w.queue.pop()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.queue.notify:
+			}
+			continue
+		}
+
+		// Recoverable errors are retried until they succeed, the queue keeps
+		// filling up in the meantime.
+		backoff := w.minBackoff
+		for {
+			err := w.Write(ctx, req)
+			if err == nil {
+				break
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			if _, ok := err.(recoverableError); !ok {
+				logrus.Errorf("Dropping remote write request: %v", err)
+				break
+			}
+
+			logrus.Warnf("Failed to push metrics, retrying in %v: %v", backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+
+			backoff *= 2
+			if backoff > w.maxBackoff {
+				backoff = w.maxBackoff
+			}
+		}
+	}
+}
+
+// Write sends a snappy compressed WriteRequest, server errors, throttling and
+// network errors are recoverable.
+func (w *RemoteWriter) Write(ctx context.Context, req []byte) error {
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", w.URL, bytes.NewReader(req))
+	if err != nil {
+		return err
+	}
+
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("User-Agent", "dcgm-exporter/"+BuildVersion)
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	if w.BearerToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+w.BearerToken)
+	} else if w.Username != "" {
+		httpReq.SetBasicAuth(w.Username, w.Password)
+	}
+
+	resp, err := w.Client.Do(httpReq)
+	if err != nil {
+		return recoverableError{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	err = fmt.Errorf("Remote write endpoint returned HTTP status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return recoverableError{err}
+	}
+
+	return err
+}
+
+// EncodeWriteRequest encodes the metrics as a Prometheus remote write
+// WriteRequest protobuf message, all the samples share the collection time.
+//
+// message WriteRequest { repeated TimeSeries timeseries = 1; }
+// message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+// message Label { string name = 1; string value = 2; }
+// message Sample { double value = 1; int64 timestamp = 2; }
+func EncodeWriteRequest(metrics [][]Metric, ts time.Time) []byte {
+	var req, series, sample, label []byte
+	timestamp := ts.UnixNano() / int64(time.Millisecond)
+
+	for _, device := range metrics {
+		for _, m := range device {
+			labels := MetricLabels(m)
+
+			name := m.Counter.FieldName
+			if m.Counter.PromType == "info" {
+				name += "_info"
+			}
+
+			MetricSamples(name, m, func(name, labelName, labelValue, value string) {
+				v, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return
+				}
+
+				labels[metricNameLabel] = name
+				if labelName != "" {
+					labels[labelName] = labelValue
+				}
+
+				series = series[:0]
+				for _, l := range sortedLabels(labels) {
+					label = protowire.AppendTag(label[:0], 1, protowire.BytesType)
+					label = protowire.AppendString(label, l[0])
+					label = protowire.AppendTag(label, 2, protowire.BytesType)
+					label = protowire.AppendString(label, l[1])
+
+					series = protowire.AppendTag(series, 1, protowire.BytesType)
+					series = protowire.AppendBytes(series, label)
+				}
+
+				sample = protowire.AppendTag(sample[:0], 1, protowire.Fixed64Type)
+				sample = protowire.AppendFixed64(sample, math.Float64bits(v))
+				sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+				sample = protowire.AppendVarint(sample, uint64(timestamp))
+
+				series = protowire.AppendTag(series, 2, protowire.BytesType)
+				series = protowire.AppendBytes(series, sample)
+
+				req = protowire.AppendTag(req, 1, protowire.BytesType)
+				req = protowire.AppendBytes(req, series)
+
+				if labelName != "" {
+					delete(labels, labelName)
+				}
+			})
+		}
+	}
+
+	return req
+}
+
+// Remote write requires the labels to be sorted by name, empty labels are
+// the same as missing ones and are omitted.
+func sortedLabels(labels map[string]string) [][2]string {
+	sorted := make([][2]string, 0, len(labels))
+	for k, v := range labels {
+		if v == "" {
+			continue
+		}
+
+		sorted = append(sorted, [2]string{SanitizeLabelName(k), v})
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i][0] < sorted[j][0]
+	})
+
+	return sorted
+}
+
+func newRequestQueue(capacity int) *requestQueue {
+	return &requestQueue{
+		capacity: capacity,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// push returns true if the oldest request was dropped to make room
+func (q *requestQueue) push(req []byte) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	dropped := false
+	if len(q.requests) >= q.capacity {
+		q.requests = q.requests[1:]
+		dropped = true
+	}
+	q.requests = append(q.requests, req)
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+
+	return dropped
+}
+
+func (q *requestQueue) pop() ([]byte, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.requests) == 0 {
+		return nil, false
+	}
+
+	req := q.requests[0]
+	q.requests = q.requests[1:]
+
+	return req, true
+}
@@ -0,0 +1,285 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type testSeries struct {
+	Labels    map[string]string
+	Value     float64
+	Timestamp int64
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	histogram := Counter{FieldID: dcgm.DCGM_FI_PROF_SM_OCCUPANCY, FieldName: "DCGM_FI_PROF_SM_OCCUPANCY", PromType: "histogram"}
+	metrics := sampleMetrics()
+	metrics[0][0].Attributes["pod.name"] = "pod"
+	metrics[0] = append(metrics[0], Metric{
+		Counter:      &histogram,
+		GPU:          "0",
+		Distribution: &Distribution{Buckets: []Bucket{{0.5, 1}}, Sum: 0.7, Count: 2},
+	})
+
+	ts := time.Unix(1600000000, 0)
+	series := decodeWriteRequest(t, EncodeWriteRequest(metrics, ts))
+	require.Len(t, series, 7)
+
+	require.Equal(t, testSeries{
+		Labels: map[string]string{
+			"__name__":  "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION",
+			"gpu":       "0",
+			"UUID":      "GPU-0000",
+			"device":    "nvidia0",
+			"modelName": "Tesla T4",
+			"pod_name":  "pod",
+		},
+		Value:     1000,
+		Timestamp: 1600000000000,
+	}, series[0])
+
+	require.Equal(t, "DCGM_FI_DRIVER_VERSION_info", series[2].Labels["__name__"])
+	require.Equal(t, "460.32", series[2].Labels["value"])
+	require.Equal(t, float64(1), series[2].Value)
+
+	require.Equal(t, map[string]string{"__name__": "DCGM_FI_PROF_SM_OCCUPANCY_bucket", "gpu": "0", "le": "0.5"}, series[3].Labels)
+	require.Equal(t, "+Inf", series[4].Labels["le"])
+	require.Equal(t, float64(2), series[4].Value)
+	require.Equal(t, "DCGM_FI_PROF_SM_OCCUPANCY_sum", series[5].Labels["__name__"])
+	require.Equal(t, 0.7, series[5].Value)
+	require.Equal(t, "DCGM_FI_PROF_SM_OCCUPANCY_count", series[6].Labels["__name__"])
+}
+
+func TestRemoteWriterRetries(t *testing.T) {
+	var lock sync.Mutex
+	var statuses = []int{http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusBadRequest, http.StatusNoContent}
+	var received [][]testSeries
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		user, password, ok := r.BasicAuth()
+		require.True(t, ok)
+		require.Equal(t, "user", user)
+		require.Equal(t, "secret", password)
+		require.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		require.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+
+		compressed, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		req, err := snappy.Decode(nil, compressed)
+		require.NoError(t, err)
+
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+
+		if status/100 == 2 {
+			received = append(received, decodeWriteRequest(t, req))
+		}
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	writer, err := NewRemoteWriter(&Config{
+		RemoteWriteURL:          receiver.URL,
+		RemoteWriteUsername:     "user",
+		RemoteWritePasswordFile: writeTestFile(t, "secret\n"),
+		RemoteWriteQueueSize:    10,
+	})
+	require.NoError(t, err)
+	writer.minBackoff = time.Millisecond
+
+	var wg sync.WaitGroup
+	in := make(chan [][]Metric)
+	stop := make(chan interface{})
+
+	wg.Add(1)
+	go writer.Run(in, stop, &wg)
+
+	// The first collection is retried after the 500 and 429 and dropped after the 400
+	in <- sampleMetrics()
+	in <- sampleMetrics()
+
+	require.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(received) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	close(stop)
+	wg.Wait()
+
+	require.Len(t, received[0], 3)
+}
+
+func TestRemoteWriterStopCancelsWrite(t *testing.T) {
+	writing := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writing <- struct{}{}
+		select {
+		case <-unblock:
+		case <-r.Context().Done():
+		}
+	}))
+	defer receiver.Close()
+	defer close(unblock)
+
+	writer, err := NewRemoteWriter(&Config{RemoteWriteURL: receiver.URL, RemoteWriteQueueSize: 10})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	in := make(chan [][]Metric)
+	stop := make(chan interface{})
+
+	wg.Add(1)
+	go writer.Run(in, stop, &wg)
+	in <- sampleMetrics()
+	<-writing
+
+	// The write in progress doesn't outlive the component
+	close(stop)
+	require.NoError(t, WaitWithTimeout(&wg, componentStopTimeout))
+}
+
+func TestRequestQueue(t *testing.T) {
+	q := newRequestQueue(2)
+	require.False(t, q.push([]byte("1")))
+	require.False(t, q.push([]byte("2")))
+	require.True(t, q.push([]byte("3")))
+
+	req, ok := q.pop()
+	require.True(t, ok)
+	require.Equal(t, "2", string(req))
+
+	req, ok = q.pop()
+	require.True(t, ok)
+	require.Equal(t, "3", string(req))
+
+	_, ok = q.pop()
+	require.False(t, ok)
+}
+
+func TestNewRemoteWriterErrors(t *testing.T) {
+	_, err := NewRemoteWriter(&Config{RemoteWriteURL: "http://localhost", RemoteWriteQueueSize: 0})
+	require.Error(t, err)
+
+	_, err = NewRemoteWriter(&Config{RemoteWriteURL: "http://localhost", RemoteWriteQueueSize: 1, RemoteWriteBearerTokenFile: "/does/not/exist"})
+	require.Error(t, err)
+
+	_, err = NewRemoteWriter(&Config{
+		RemoteWriteURL:             "http://localhost",
+		RemoteWriteQueueSize:       1,
+		RemoteWriteBearerTokenFile: writeTestFile(t, "token"),
+		RemoteWriteUsername:        "user",
+	})
+	require.Error(t, err)
+}
+
+// Minimal decoder of the WriteRequest messages, for the test receivers
+func decodeWriteRequest(t *testing.T, b []byte) []testSeries {
+	var series []testSeries
+
+	forEachField(t, b, func(num protowire.Number, v []byte, _ uint64) {
+		require.Equal(t, protowire.Number(1), num)
+
+		s := testSeries{Labels: map[string]string{}}
+		var names []string
+		forEachField(t, v, func(num protowire.Number, v []byte, _ uint64) {
+			switch num {
+			case 1:
+				var name, value string
+				forEachField(t, v, func(num protowire.Number, v []byte, _ uint64) {
+					if num == 1 {
+						name = string(v)
+					} else {
+						value = string(v)
+					}
+				})
+				s.Labels[name] = value
+				names = append(names, name)
+			case 2:
+				forEachField(t, v, func(num protowire.Number, _ []byte, n uint64) {
+					if num == 1 {
+						s.Value = math.Float64frombits(n)
+					} else {
+						s.Timestamp = int64(n)
+					}
+				})
+			}
+		})
+
+		require.True(t, sortedStrings(names), "Labels are not sorted: %s", strings.Join(names, ","))
+		series = append(series, s)
+	})
+
+	return series
+}
+
+func forEachField(t *testing.T, b []byte, fn func(num protowire.Number, v []byte, n uint64)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		require.True(t, n > 0)
+		b = b[n:]
+
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			require.True(t, n > 0)
+			fn(num, v, 0)
+			b = b[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			require.True(t, n > 0)
+			fn(num, nil, v)
+			b = b[n:]
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			require.True(t, n > 0)
+			fn(num, nil, v)
+			b = b[n:]
+		default:
+			t.Fatalf("Unexpected wire type %v", typ)
+		}
+	}
+}
+
+func sortedStrings(s []string) bool {
+	for i := 1; i < len(s); i++ {
+		if s[i] < s[i-1] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,311 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
+	"github.com/sirupsen/logrus"
+)
+
+// The stages of the pipeline
+const (
+	CollectStage   = "collect"
+	TransformStage = "transform"
+	FormatStage    = "format"
+)
+
+// The metrics of the exporter itself, exposed on /metrics after the GPU metrics.
+// The health checks are based on the same state.
+var selfMetrics = NewSelfMetrics()
+
+var (
+	stageDurationCounter = Counter{
+		FieldName: "dcgm_exporter_stage_duration_seconds",
+		PromType:  "histogram",
+		Help:      "Duration of the stages of the pipeline: the collection, each transform and the formatting (in s).",
+		Unit:      "seconds",
+		Buckets:   DefaultBuckets,
+	}
+	collectionErrorsCounter = Counter{
+		FieldName: "dcgm_exporter_collection_errors_total",
+		PromType:  "counter",
+		Help:      "Number of failed collections by stage.",
+	}
+	droppedCollectionsCounter = Counter{
+		FieldName: "dcgm_exporter_dropped_collections_total",
+		PromType:  "counter",
+		Help:      "Number of collections dropped because an output couldn't keep up.",
+	}
+	lastCollectionAgeCounter = Counter{
+		FieldName: "dcgm_exporter_last_collection_age_seconds",
+		PromType:  "gauge",
+		Help:      "Time since the last successful collection (in s).",
+		Unit:      "seconds",
+	}
+	podMappingFailuresCounter = Counter{
+		FieldName: "dcgm_exporter_pod_mapping_failures_total",
+		PromType:  "counter",
+		Help:      "Number of failures to map the GPUs to the pods with the kubelet, by reason.",
+	}
+	hostengineMemoryCounter = Counter{
+		FieldName: "dcgm_exporter_hostengine_memory_bytes",
+		PromType:  "gauge",
+		Help:      "Memory used by the DCGM hostengine (in B).",
+		Unit:      "bytes",
+	}
+	hostengineCPUCounter = Counter{
+		FieldName: "dcgm_exporter_hostengine_cpu_utilization_percent",
+		PromType:  "gauge",
+		Help:      "CPU utilization of the DCGM hostengine (in %).",
+		Unit:      "percent",
+	}
+)
+
+func NewSelfMetrics() *SelfMetrics {
+	return &SelfMetrics{
+		durations:          map[stageKey]*Distribution{},
+		errors:             map[stageKey]uint64{},
+		dropped:            map[string]uint64{},
+		podMappingFailures: map[string]uint64{},
+		collections:        CollectionTimes{Exporter: time.Now()},
+		now:                time.Now,
+	}
+}
+
+// ObserveDuration records the duration of a stage, the name of the transform
+// is empty for the other stages
+func (s *SelfMetrics) ObserveDuration(stage, transform string, d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := stageKey{stage: stage, transform: transform}
+	dist, ok := s.durations[key]
+	if !ok {
+		dist = &Distribution{}
+		for _, b := range stageDurationCounter.Buckets {
+			dist.Buckets = append(dist.Buckets, Bucket{UpperBound: b})
+		}
+		s.durations[key] = dist
+	}
+
+	v := d.Seconds()
+	dist.Sum += v
+	dist.Count++
+	for i := range dist.Buckets {
+		if v <= dist.Buckets[i].UpperBound {
+			dist.Buckets[i].Count++
+		}
+	}
+}
+
+func (s *SelfMetrics) CountError(stage, transform string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.errors[stageKey{stage: stage, transform: transform}]++
+}
+
+func (s *SelfMetrics) CountDropped(output string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.dropped[output]++
+}
+
+func (s *SelfMetrics) CountPodMappingFailure(reason string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.podMappingFailures[reason]++
+}
+
+func (s *SelfMetrics) CollectionStarted() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.collections.Started = s.now()
+}
+
+func (s *SelfMetrics) CollectionFinished(err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.collections.Finished = s.now()
+	if err == nil {
+		s.collections.Succeeded = s.now()
+	}
+}
+
+// Collections returns the times of the last collections and the current time
+func (s *SelfMetrics) Collections() (CollectionTimes, time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.collections, s.now()
+}
+
+// SetDCGM sets the functions reading the status of the hostengine and checking
+// that it's reachable, nil when DCGM isn't initialized. The status is read in
+// the background every interval. It waits for the calls in progress, so that
+// DCGM can be shut down afterwards.
+func (s *SelfMetrics) SetDCGM(introspect func() (dcgm.DcgmStatus, error), ping func() error, interval time.Duration) {
+	if s.stopIntrospection != nil {
+		s.stopIntrospection()
+		s.stopIntrospection = nil
+	}
+
+	s.dcgmLock.Lock()
+	s.introspect = introspect
+	s.ping = ping
+	s.dcgmLock.Unlock()
+
+	s.Lock()
+	s.hostengine = nil
+	s.Unlock()
+
+	if introspect == nil {
+		return
+	}
+
+	if interval <= 0 {
+		s.refreshHostengine()
+		return
+	}
+
+	s.stopIntrospection = RefreshEvery(interval, s.refreshHostengine)
+}
+
+// refreshHostengine reads the status of the hostengine, the last one is
+// dropped if it can't be read.
+func (s *SelfMetrics) refreshHostengine() {
+	// The hostengine may take a while to answer, the stages aren't blocked
+	s.dcgmLock.Lock()
+	var status *dcgm.DcgmStatus
+	if s.introspect != nil {
+		st, err := s.introspect()
+		if err != nil {
+			logrus.Debugf("Failed to introspect the hostengine: %v", err)
+		} else {
+			status = &st
+		}
+	}
+	s.dcgmLock.Unlock()
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.hostengine = status
+}
+
+// PingDCGM returns false if DCGM isn't used, and whether it's reachable
+func (s *SelfMetrics) PingDCGM() (bool, error) {
+	s.dcgmLock.Lock()
+	defer s.dcgmLock.Unlock()
+
+	if s.ping == nil {
+		return false, nil
+	}
+
+	return true, s.ping()
+}
+
+// Collect returns the current values, in the order of the exposition
+func (s *SelfMetrics) Collect() []Metric {
+	return s.collect()
+}
+
+func (s *SelfMetrics) collect() []Metric {
+	s.Lock()
+	defer s.Unlock()
+
+	var metrics []Metric
+	add := func(c *Counter, value string, attributes map[string]string) {
+		metrics = append(metrics, Metric{Counter: c, Value: value, Attributes: attributes})
+	}
+
+	durations := make([]stageKey, 0, len(s.durations))
+	for key := range s.durations {
+		durations = append(durations, key)
+	}
+	for _, key := range sortStageKeys(durations) {
+		d := *s.durations[key]
+		d.Buckets = append([]Bucket(nil), d.Buckets...)
+
+		metrics = append(metrics, Metric{Counter: &stageDurationCounter, Attributes: key.attributes(), Distribution: &d})
+	}
+
+	errors := make([]stageKey, 0, len(s.errors))
+	for key := range s.errors {
+		errors = append(errors, key)
+	}
+	for _, key := range sortStageKeys(errors) {
+		add(&collectionErrorsCounter, formatUint(s.errors[key]), key.attributes())
+	}
+
+	for _, output := range sortedKeys(s.dropped) {
+		add(&droppedCollectionsCounter, formatUint(s.dropped[output]), map[string]string{"output": output})
+	}
+
+	for _, reason := range sortedKeys(s.podMappingFailures) {
+		add(&podMappingFailuresCounter, formatUint(s.podMappingFailures[reason]), map[string]string{"reason": reason})
+	}
+
+	if !s.collections.Succeeded.IsZero() {
+		add(&lastCollectionAgeCounter, formatFloat(s.now().Sub(s.collections.Succeeded).Seconds()), map[string]string{})
+	}
+
+	// Introspect returns KB and a percentage
+	if s.hostengine != nil {
+		add(&hostengineMemoryCounter, formatUint(uint64(s.hostengine.Memory)*1024), map[string]string{})
+		add(&hostengineCPUCounter, formatFloat(s.hostengine.CPU), map[string]string{})
+	}
+
+	return metrics
+}
+
+func (k stageKey) attributes() map[string]string {
+	attributes := map[string]string{"stage": k.stage}
+	if k.transform != "" {
+		attributes["transform"] = k.transform
+	}
+
+	return attributes
+}
+
+func sortStageKeys(keys []stageKey) []stageKey {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].stage != keys[j].stage {
+			return keys[i].stage < keys[j].stage
+		}
+		return keys[i].transform < keys[j].transform
+	})
+
+	return keys
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
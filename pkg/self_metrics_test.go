@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfMetrics(t *testing.T) {
+	s := NewSelfMetrics()
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+
+	// Nothing is exported before the first collection
+	require.Empty(t, s.Collect())
+
+	s.ObserveDuration(CollectStage, "", 20*time.Millisecond)
+	s.ObserveDuration(CollectStage, "", 2*time.Second)
+	s.ObserveDuration(TransformStage, "podMapper", 3*time.Millisecond)
+	s.CountError(TransformStage, "podMapper")
+	s.CountDropped("HTTP server")
+	s.CountPodMappingFailure("connect")
+	s.CollectionFinished(nil)
+	now = now.Add(1500 * time.Millisecond)
+
+	// The hostengine is introspected in the background, not by Collect
+	s.SetDCGM(func() (dcgm.DcgmStatus, error) {
+		return dcgm.DcgmStatus{Memory: 2048, CPU: 1.5}, nil
+	}, nil, time.Hour)
+	defer s.SetDCGM(nil, nil, 0)
+	require.Eventually(t, func() bool {
+		s.Lock()
+		defer s.Unlock()
+		return s.hostengine != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var text strings.Builder
+	require.NoError(t, EncodeMetrics(&text, TextFormat, [][]Metric{s.Collect()}))
+	for _, line := range []string{
+		`dcgm_exporter_stage_duration_seconds_bucket{stage="collect",le="0.025"} 1`,
+		`dcgm_exporter_stage_duration_seconds_bucket{stage="collect",le="+Inf"} 2`,
+		`dcgm_exporter_stage_duration_seconds_sum{stage="collect"} 2.02`,
+		`dcgm_exporter_stage_duration_seconds_count{stage="transform",transform="podMapper"} 1`,
+		`dcgm_exporter_collection_errors_total{stage="transform",transform="podMapper"} 1`,
+		`dcgm_exporter_dropped_collections_total{output="HTTP server"} 1`,
+		`dcgm_exporter_pod_mapping_failures_total{reason="connect"} 1`,
+		`dcgm_exporter_last_collection_age_seconds{} 1.5`,
+		`dcgm_exporter_hostengine_memory_bytes{} 2097152`,
+		`dcgm_exporter_hostengine_cpu_utilization_percent{} 1.5`,
+	} {
+		require.Contains(t, text.String(), line+"\n")
+	}
+
+	// OpenMetrics counter families don't have the suffix of their samples
+	var openMetrics strings.Builder
+	require.NoError(t, EncodeMetrics(&openMetrics, OpenMetricsFormat, [][]Metric{s.Collect()}))
+	require.Contains(t, openMetrics.String(), "# TYPE dcgm_exporter_collection_errors counter\n")
+	require.Contains(t, openMetrics.String(), `dcgm_exporter_collection_errors_total{stage="transform",transform="podMapper"} 1`)
+	require.Contains(t, openMetrics.String(), "# UNIT dcgm_exporter_stage_duration_seconds seconds\n")
+
+	// The hostengine metrics are omitted if it can't be introspected
+	s.SetDCGM(func() (dcgm.DcgmStatus, error) { return dcgm.DcgmStatus{}, fmt.Errorf("Not connected") }, nil, time.Hour)
+	for _, m := range s.Collect() {
+		require.NotEqual(t, hostengineMemoryCounter.FieldName, m.Counter.FieldName)
+	}
+}
@@ -18,7 +18,11 @@ package main
 
 import (
 	"context"
+	"mime"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -26,7 +30,14 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func NewMetricsServer(c *Config, metrics chan string) (*MetricsServer, func(), error) {
+const (
+	textContentType        = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// The metrics are either received on the channel or collected through the
+// cache when they are requested, if the cache isn't nil.
+func NewMetricsServer(c *Config, metrics chan [][]Metric, cache *MetricsCache) (*MetricsServer, func(), error) {
 	router := mux.NewRouter()
 	serverv1 := &MetricsServer{
 		server: http.Server{
@@ -36,7 +47,10 @@ func NewMetricsServer(c *Config, metrics chan string) (*MetricsServer, func(), e
 			WriteTimeout: 10 * time.Second,
 		},
 		metricsChan: metrics,
-		metrics:     "",
+		metrics:     nil,
+		cache:       cache,
+		health:      NewHealthConfig(c),
+		self:        selfMetrics,
 	}
 
 	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -45,28 +59,84 @@ func NewMetricsServer(c *Config, metrics chan string) (*MetricsServer, func(), e
 			<body>
 			<h1>GPU Exporter</h1>
 			<p><a href="./metrics">Metrics</a></p>
+			<p><a href="./api/v1/metrics">Metrics (JSON)</a></p>
 			</body>
 			</html>`))
 	})
 
 	router.HandleFunc("/health", serverv1.Health)
+	router.HandleFunc("/livez", serverv1.Livez)
+	router.HandleFunc("/readyz", serverv1.Readyz)
 	router.HandleFunc("/metrics", serverv1.Metrics)
+	router.HandleFunc("/api/v1/metrics", serverv1.APIMetrics)
+	router.HandleFunc("/api/v1/counters/reload", serverv1.ReloadCounters).Methods(http.MethodPost)
+
+	if c.WebConfigFile != "" {
+		webConfig, err := LoadWebConfig(c.WebConfigFile)
+		if err != nil {
+			return nil, func() {}, err
+		}
+
+		if webConfig.TLSConfig != nil {
+			serverv1.server.TLSConfig, err = NewTLSConfig(webConfig.TLSConfig)
+			if err != nil {
+				return nil, func() {}, err
+			}
+		}
+
+		serverv1.server.Handler = NewAuthHandler(webConfig, router)
+	}
+
+	// The listener of a server that never started is closed as well
+	return serverv1, func() {
+		if serverv1.listener != nil {
+			serverv1.listener.Close()
+		}
+	}, nil
+}
+
+// Listen binds the address of the server before it starts, the errors are
+// returned to the caller instead of the running server.
+func (s *MetricsServer) Listen() error {
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
 
-	return serverv1, func() {}, nil
+	s.listener = listener
+	return nil
 }
 
 func (s *MetricsServer) Run(stop chan interface{}, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	var httpwg sync.WaitGroup
-	httpwg.Add(1)
-	go func() {
-		defer httpwg.Done()
-		logrus.Info("Starting webserver")
-		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logrus.Fatalf("Failed to Listen and Server HTTP server with err: `%v`", err)
+	// The address is still held by the previous server when the server is built
+	if s.listener == nil {
+		if err := s.Listen(); err != nil {
+			logrus.Errorf("Failed to listen on %s: %v", s.server.Addr, err)
 		}
-	}()
+	}
+
+	var httpwg sync.WaitGroup
+	if s.listener != nil {
+		httpwg.Add(1)
+		go func() {
+			defer httpwg.Done()
+			var err error
+			if s.server.TLSConfig != nil {
+				logrus.Info("Starting webserver with TLS")
+				// The certificate is set by the TLS config
+				err = s.server.ServeTLS(s.listener, "", "")
+			} else {
+				logrus.Info("Starting webserver")
+				err = s.server.Serve(s.listener)
+			}
+
+			if err != nil && err != http.ErrServerClosed {
+				logrus.Errorf("Failed to serve HTTP with err: `%v`", err)
+			}
+		}()
+	}
 
 	httpwg.Add(1)
 	go func() {
@@ -83,21 +153,42 @@ func (s *MetricsServer) Run(stop chan interface{}, wg *sync.WaitGroup) {
 
 	<-stop
 	if err := s.server.Shutdown(context.Background()); err != nil {
-		logrus.Fatalf("Failed to shutdown HTTP server, with err: `%v`", err)
+		logrus.Errorf("Failed to shutdown HTTP server, with err: `%v`", err)
 	}
 
 	if err := WaitWithTimeout(&httpwg, 3*time.Second); err != nil {
-		logrus.Fatalf("Failed waiting for HTTP server to shutdown, with err: `%v`", err)
+		logrus.Errorf("Failed waiting for HTTP server to shutdown, with err: `%v`", err)
 	}
 }
 
 func (s *MetricsServer) Metrics(w http.ResponseWriter, r *http.Request) {
+	format := NegotiateFormat(r.Header)
+
+	metrics, err := s.collectMetrics()
+	if err != nil {
+		logrus.Errorf("Failed to collect metrics with error: %v", err)
+		http.Error(w, "Failed to collect metrics", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.ContentType())
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(s.getMetrics()))
+
+	// The metrics of the exporter come after the ones of the GPUs, the collection is shared
+	all := make([][]Metric, len(metrics), len(metrics)+1)
+	copy(all, metrics)
+	all = append(all, s.self.Collect())
+
+	// The status is already sent, failures are most likely a client that went away
+	start := time.Now()
+	if err := EncodeMetrics(w, format, all); err != nil {
+		logrus.Errorf("Failed to write metrics with error: %v", err)
+	}
+	s.self.ObserveDuration(FormatStage, "", time.Since(start))
 }
 
 func (s *MetricsServer) Health(w http.ResponseWriter, r *http.Request) {
-	if s.getMetrics() == "" {
+	if metrics, err := s.collectMetrics(); err != nil || metrics == nil {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		w.Write([]byte("KO"))
 	} else {
@@ -106,16 +197,73 @@ func (s *MetricsServer) Health(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *MetricsServer) updateMetrics(m string) {
+func (s *MetricsServer) updateMetrics(m [][]Metric) {
 	s.Lock()
 	defer s.Unlock()
 
 	s.metrics = m
 }
 
-func (s *MetricsServer) getMetrics() string {
+// collectMetrics returns the last metrics received from the pipeline, or
+// collects them in the scrape collect mode.
+func (s *MetricsServer) collectMetrics() ([][]Metric, error) {
+	if s.cache != nil {
+		return s.cache.Get()
+	}
+
+	return s.getMetrics(), nil
+}
+
+func (s *MetricsServer) getMetrics() [][]Metric {
 	s.Lock()
 	defer s.Unlock()
 
 	return s.metrics
 }
+
+func (f MetricsFormat) ContentType() string {
+	if f == OpenMetricsFormat {
+		return openMetricsContentType
+	}
+
+	return textContentType
+}
+
+// NegotiateFormat picks the exposition format preferred by the Accept header,
+// falling back to the Prometheus text format.
+func NegotiateFormat(h http.Header) MetricsFormat {
+	format, weight := TextFormat, 0.0
+
+	for _, accept := range h.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil {
+				continue
+			}
+
+			q := 1.0
+			if v, ok := params["q"]; ok {
+				q, err = strconv.ParseFloat(v, 64)
+				if err != nil {
+					continue
+				}
+			}
+
+			if q <= weight {
+				continue
+			}
+
+			switch mediaType {
+			case "application/openmetrics-text":
+				if v, ok := params["version"]; ok && v != "1.0.0" && v != "0.0.1" {
+					continue
+				}
+				format, weight = OpenMetricsFormat, q
+			case "text/plain", "text/*", "*/*":
+				format, weight = TextFormat, q
+			}
+		}
+	}
+
+	return format
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2020, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept   string
+		expected MetricsFormat
+	}{
+		{"", TextFormat},
+		{"text/plain", TextFormat},
+		{"application/openmetrics-text", OpenMetricsFormat},
+		{"application/openmetrics-text;version=2.0.0", TextFormat},
+		{"application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1", OpenMetricsFormat},
+		{"application/openmetrics-text;q=0.2,text/plain;q=0.5", TextFormat},
+		{"application/json", TextFormat},
+	}
+
+	for _, tc := range tests {
+		h := http.Header{}
+		if tc.accept != "" {
+			h.Set("Accept", tc.accept)
+		}
+
+		require.Equal(t, tc.expected, NegotiateFormat(h), "Accept: %q", tc.accept)
+	}
+}
+
+func TestMetricsContentNegotiation(t *testing.T) {
+	s, cleanup, err := NewMetricsServer(&Config{}, make(chan [][]Metric), nil)
+	require.NoError(t, err)
+	defer cleanup()
+
+	s.updateMetrics(sampleMetrics())
+	s.self = NewSelfMetrics()
+	s.self.CountDropped("HTTP server")
+
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	s.Metrics(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, textContentType, w.Header().Get("Content-Type"))
+	require.Contains(t, w.Body.String(), "# TYPE DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION counter\n")
+	require.Contains(t, w.Body.String(), "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION{gpu=\"0\"")
+	require.Contains(t, w.Body.String(), "DCGM_FI_DRIVER_VERSION_info{gpu=\"0\"")
+	require.NotContains(t, w.Body.String(), "# EOF")
+
+	r = httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("Accept", "application/openmetrics-text;version=1.0.0")
+	w = httptest.NewRecorder()
+	s.Metrics(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, openMetricsContentType, w.Header().Get("Content-Type"))
+
+	body := w.Body.String()
+	require.True(t, strings.HasSuffix(body, "\n# EOF\n"), "Expected EOF marker, got:\n%s", body)
+	require.Contains(t, body, "# TYPE DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION counter\n")
+	require.Contains(t, body, "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION_total{gpu=\"0\"")
+	require.Contains(t, body, "# UNIT DCGM_FI_DEV_POWER_USAGE_watts watts\n")
+	require.Contains(t, body, "# TYPE DCGM_FI_DRIVER_VERSION info\n")
+	require.Contains(t, body, "DCGM_FI_DRIVER_VERSION_info{gpu=\"0\",UUID=\"GPU-0000\",device=\"nvidia0\",modelName=\"Tesla T4\",value=\"460.32\"} 1")
+
+	// The metrics of the exporter itself follow the ones of the GPUs
+	require.Contains(t, body, "# TYPE dcgm_exporter_stage_duration_seconds histogram\n")
+	require.Contains(t, body, "dcgm_exporter_stage_duration_seconds_count{stage=\"format\"} 1\n")
+	require.Contains(t, body, "dcgm_exporter_dropped_collections_total{output=\"HTTP server\"} 1\n")
+}
+
+func sampleMetrics() [][]Metric {
+	counters := []Counter{
+		{FieldID: dcgm.DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION, FieldName: "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION", PromType: "counter", Help: "Energy help info", Unit: "millijoules"},
+		{FieldID: dcgm.DCGM_FI_DEV_POWER_USAGE, FieldName: "DCGM_FI_DEV_POWER_USAGE_watts", PromType: "gauge", Help: "Power help info", Unit: "watts"},
+		{FieldID: dcgm.DCGM_FI_DRIVER_VERSION, FieldName: "DCGM_FI_DRIVER_VERSION", PromType: "info", Help: "Driver version"},
+	}
+	values := []string{"1000", "70.000000", "460.32"}
+
+	var metrics []Metric
+	for i := range counters {
+		metrics = append(metrics, Metric{
+			Counter:      &counters[i],
+			Value:        values[i],
+			UUID:         "UUID",
+			GPU:          "0",
+			GPUUUID:      "GPU-0000",
+			GPUDevice:    "nvidia0",
+			GPUModelName: "Tesla T4",
+			Attributes:   map[string]string{},
+		})
+	}
+
+	return [][]Metric{metrics}
+}
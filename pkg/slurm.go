@@ -0,0 +1,326 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	jobIDAttribute     = "job_id"
+	userAttribute      = "user"
+	partitionAttribute = "partition"
+)
+
+var (
+	// The processes of the node, /proc of the host in a container
+	procDir = "/proc"
+
+	// The cgroups of the Slurm jobs, e.g: "/slurm/uid_1000/job_42/step_0" with
+	// cgroup v1 or "/system.slice/slurmstepd.scope/job_42/step_0/user/task_0"
+	// with cgroup v2
+	slurmJobCgroup = regexp.MustCompile(`/job_([0-9]+)(/|$)`)
+)
+
+// NewJobMapper maps the GPUs to the Slurm jobs using them, every
+// SlurmRefreshInterval in the background. The jobs are found from the cgroups
+// and the environment of the processes running on the GPUs, listed with NVML,
+// and from the files of the SlurmJobMappingDir.
+func NewJobMapper(c *Config, sysInfo SystemInfo) (*JobMapper, func(), error) {
+	logrus.Infof("Slurm job mapping enabled!")
+
+	if err := nvml.Init(); err != nil {
+		return nil, func() {}, fmt.Errorf("Failed to initialize NVML to list the processes of the GPUs: %v", err)
+	}
+
+	j, cleanup, err := newJobMapper(c, sysInfo, listGPUProcesses)
+	if err != nil {
+		nvml.Shutdown()
+		return nil, func() {}, err
+	}
+
+	return j, func() {
+		cleanup()
+		nvml.Shutdown()
+	}, nil
+}
+
+func newJobMapper(c *Config, sysInfo SystemInfo, processes func() (map[string][]uint, error)) (*JobMapper, func(), error) {
+	if c.SlurmRefreshInterval <= 0 {
+		return nil, func() {}, fmt.Errorf("The Slurm refresh interval must be positive, got %d", c.SlurmRefreshInterval)
+	}
+
+	if c.SlurmJobMappingDir != "" {
+		if info, err := os.Stat(c.SlurmJobMappingDir); err != nil || !info.IsDir() {
+			return nil, func() {}, fmt.Errorf("Invalid Slurm job mapping directory %s: it must be an existing directory", c.SlurmJobMappingDir)
+		}
+	}
+
+	j := &JobMapper{
+		Config:    c,
+		sysInfo:   sysInfo,
+		processes: processes,
+		gpuToJob:  map[string][]JobInfo{},
+	}
+
+	return j, RefreshEvery(time.Duration(c.SlurmRefreshInterval)*time.Millisecond, j.Refresh), nil
+}
+
+func (j *JobMapper) Name() string {
+	return "jobMapper"
+}
+
+// Refresh finds the jobs and replaces the mapping. The last mapping is kept if
+// the processes can't be listed.
+func (j *JobMapper) Refresh() {
+	processes, err := j.processes()
+	if err != nil {
+		logrus.Warningf("Failed to list the processes running on the GPUs: %v", err)
+		return
+	}
+
+	// The GPUs of the processes are the ones NVML reports: with
+	// ConstrainDevices, CUDA_VISIBLE_DEVICES is renumbered from 0 in each job
+	jobs := map[string]jobGPUs{}
+	for gpu, pids := range processes {
+		for _, pid := range pids {
+			job, ok := processJob(pid)
+			if !ok {
+				continue
+			}
+
+			job.gpus = append(job.gpus, gpu)
+			jobs[job.ID] = mergeJobGPUs(jobs[job.ID], job)
+		}
+	}
+
+	if j.Config.SlurmJobMappingDir != "" {
+		for _, job := range listMappingFileJobs(j.Config.SlurmJobMappingDir) {
+			jobs[job.ID] = mergeJobGPUs(jobs[job.ID], job)
+		}
+	}
+
+	gpuToJob := map[string][]JobInfo{}
+	for _, job := range jobs {
+		seen := map[string]bool{}
+		for _, gpu := range job.gpus {
+			id := j.gpuID(gpu)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+
+			gpuToJob[id] = append(gpuToJob[id], job.JobInfo)
+		}
+	}
+
+	for _, jobs := range gpuToJob {
+		sort.Slice(jobs, func(a, b int) bool { return jobs[a].ID < jobs[b].ID })
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	j.gpuToJob = gpuToJob
+}
+
+// Process adds the job attributes, the jobs sharing a GPU are joined in the
+// order of their IDs. The GPU instances get the jobs of their GPU if no job is
+// using them in particular.
+func (j *JobMapper) Process(metrics [][]Metric, sysInfo SystemInfo) error {
+	j.Lock()
+	gpuToJob := j.gpuToJob
+	j.Unlock()
+
+	for i, device := range metrics {
+		for k, m := range device {
+			jobs := gpuToJob[m.GPU]
+			if m.MigProfile != "" {
+				if instanceJobs, ok := gpuToJob[fmt.Sprintf("%s-%s", m.GPU, m.GPUInstanceID)]; ok {
+					jobs = instanceJobs
+				}
+			}
+
+			ids, users, partitions := make([]string, len(jobs)), make([]string, len(jobs)), make([]string, len(jobs))
+			for l, job := range jobs {
+				ids[l], users[l], partitions[l] = job.ID, job.User, job.Partition
+			}
+
+			metrics[i][k].Attributes[jobIDAttribute] = strings.Join(ids, ",")
+			metrics[i][k].Attributes[userAttribute] = strings.Join(users, ",")
+			metrics[i][k].Attributes[partitionAttribute] = strings.Join(partitions, ",")
+		}
+	}
+
+	return nil
+}
+
+// gpuID returns the key of the mapping of a GPU of a job: the GPU index, or
+// the GPU instance identifier of a MIG device. The UUIDs are returned as is if
+// the device isn't monitored.
+func (j *JobMapper) gpuID(gpu string) string {
+	if strings.HasPrefix(gpu, MIG_UUID_PREFIX) {
+		gpuUuid, gpuInstanceId, ok := parseMIGUUID(gpu, j.sysInfo)
+		if !ok {
+			return gpu
+		}
+
+		if id := GetGpuInstanceIdentifier(j.sysInfo, gpuUuid, gpuInstanceId); id != "" {
+			return id
+		}
+		return gpu
+	}
+
+	for i := uint(0); i < j.sysInfo.GpuCount; i++ {
+		if j.sysInfo.Gpus[i].DeviceInfo.UUID == gpu {
+			return fmt.Sprintf("%d", j.sysInfo.Gpus[i].DeviceInfo.GPU)
+		}
+	}
+
+	return gpu
+}
+
+// A job and the GPUs allocated to it
+type jobGPUs struct {
+	JobInfo
+	gpus []string
+}
+
+// mergeJobGPUs completes a job with what's known by another of its processes
+// or its mapping file, the job uses the GPUs of both.
+func mergeJobGPUs(job jobGPUs, other jobGPUs) jobGPUs {
+	job.ID = other.ID
+	if job.User == "" {
+		job.User = other.User
+	}
+	if job.Partition == "" {
+		job.Partition = other.Partition
+	}
+	job.gpus = append(job.gpus, other.gpus...)
+
+	return job
+}
+
+// processJob returns the job of a process in the cgroup of a Slurm job, false
+// if it isn't in a job or if it exited. The user and the partition are empty
+// if its environment can't be read.
+func processJob(pid uint) (jobGPUs, bool) {
+	cgroup, err := ioutil.ReadFile(filepath.Join(procDir, fmt.Sprint(pid), "cgroup"))
+	if err != nil {
+		logrus.Debugf("Failed to read the cgroup of the process %d: %v", pid, err)
+		return jobGPUs{}, false
+	}
+
+	match := slurmJobCgroup.FindSubmatch(cgroup)
+	if match == nil {
+		return jobGPUs{}, false
+	}
+
+	var job jobGPUs
+	environ, err := ioutil.ReadFile(filepath.Join(procDir, fmt.Sprint(pid), "environ"))
+	if err != nil {
+		logrus.Debugf("Failed to read the environment of the process %d of the Slurm job %s: %v", pid, match[1], err)
+	} else {
+		job = parseJobEnviron(environ)
+	}
+
+	job.ID = string(match[1])
+	return job, true
+}
+
+// listMappingFileJobs returns the jobs of the files written by the prologs,
+// their name is the ID of the job and they contain the Slurm variables of the
+// job, e.g: "env | grep ^SLURM_ > $dir/$SLURM_JOB_ID".
+func listMappingFileJobs(dir string) []jobGPUs {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logrus.Warningf("Failed to list the Slurm job mapping directory %s: %v", dir, err)
+		return nil
+	}
+
+	var jobs []jobGPUs
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			// The epilog may have removed it
+			logrus.Debugf("Failed to read the Slurm job mapping file %s: %v", entry.Name(), err)
+			continue
+		}
+
+		job := parseJobEnviron(content)
+		if job.ID == "" {
+			job.ID = entry.Name()
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs
+}
+
+// parseJobEnviron reads the job from its environment variables, separated by
+// NUL in /proc/<pid>/environ or by new lines in the mapping files. The GPUs
+// are the indexes or UUIDs of SLURM_JOB_GPUS, or of SLURM_STEP_GPUS without
+// it. CUDA_VISIBLE_DEVICES is only used when it has UUIDs, its indexes are
+// renumbered from 0 in the jobs with ConstrainDevices.
+func parseJobEnviron(environ []byte) jobGPUs {
+	env := map[string]string{}
+	for _, variable := range strings.FieldsFunc(string(environ), func(r rune) bool { return r == 0 || r == '\n' }) {
+		if index := strings.Index(variable, "="); index > 0 {
+			env[variable[:index]] = strings.TrimSpace(variable[index+1:])
+		}
+	}
+
+	job := jobGPUs{
+		JobInfo: JobInfo{
+			ID:        env["SLURM_JOB_ID"],
+			User:      env["SLURM_JOB_USER"],
+			Partition: env["SLURM_JOB_PARTITION"],
+		},
+	}
+
+	for _, name := range []string{"SLURM_JOB_GPUS", "SLURM_STEP_GPUS"} {
+		if gpus := splitList(env[name]); len(gpus) > 0 {
+			job.gpus = gpus
+			return job
+		}
+	}
+
+	// Slurm sets it to NoDevFiles when the job has no GPU
+	gpus := splitList(env["CUDA_VISIBLE_DEVICES"])
+	for _, gpu := range gpus {
+		if !strings.HasPrefix(gpu, GPU_UUID_PREFIX) && !strings.HasPrefix(gpu, MIG_UUID_PREFIX) {
+			return job
+		}
+	}
+	job.gpus = gpus
+
+	return job
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestProcess writes the cgroup and the environment of a process in a
+// fake /proc
+func writeTestProcess(t *testing.T, dir string, pid string, cgroup string, environ ...string) {
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, pid), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, pid, "cgroup"), []byte(cgroup), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, pid, "environ"), []byte(strings.Join(environ, "\x00")+"\x00"), 0644))
+}
+
+func TestJobMapper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcgm-exporter-slurm")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, cleanup := testSyntheticCollector(t, sampleCounters, 3)
+	defer cleanup()
+
+	out, err := c.GetMetrics()
+	require.NoError(t, err)
+	gpus := GetGPUUUIDs(out)
+
+	defer func(dir string) { procDir = dir }(procDir)
+	procDir = filepath.Join(dir, "proc")
+
+	// Job 42 runs on GPU 1, ConstrainDevices renumbered its CUDA_VISIBLE_DEVICES
+	// from 0. Only one of its processes has the variables of the job.
+	writeTestProcess(t, procDir, "100", "0::/system.slice/slurmstepd.scope/job_42/step_0/user/task_0\n",
+		"SLURM_JOB_ID=42", "SLURM_JOB_USER=alice", "SLURM_JOB_PARTITION=gpu", "CUDA_VISIBLE_DEVICES=0")
+	writeTestProcess(t, procDir, "101", "12:devices:/slurm/uid_1000/job_42/step_batch\n", "HOME=/home/alice")
+
+	// A process outside of the jobs, and the process 300 exited
+	writeTestProcess(t, procDir, "200", "0::/user.slice/user-1000.slice/session-1.scope\n", "CUDA_VISIBLE_DEVICES=0")
+
+	var lock sync.Mutex
+	processes := map[string][]uint{
+		gpus[1]: {100, 101},
+		gpus[2]: {200, 300},
+	}
+	listProcesses := func() (map[string][]uint, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return processes, nil
+	}
+
+	// Job 43 uses GPU 0 and 1, it's only known from its mapping file
+	mappingDir := filepath.Join(dir, "jobs")
+	require.NoError(t, os.MkdirAll(mappingDir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mappingDir, "43"),
+		[]byte("SLURM_JOB_USER=bob\nSLURM_JOB_PARTITION=debug\nSLURM_JOB_GPUS="+gpus[0]+","+gpus[1]+"\n"), 0644))
+
+	config := &Config{SlurmJobMappingDir: mappingDir, SlurmRefreshInterval: 3600000}
+	jobMapper, cleanup, err := newJobMapper(config, c.SysInfo(), listProcesses)
+	require.NoError(t, err)
+	defer cleanup()
+
+	// The first refresh runs before the mapper is returned
+	require.NoError(t, jobMapper.Process(out, c.SysInfo()))
+
+	expected := []map[string]string{
+		{jobIDAttribute: "43", userAttribute: "bob", partitionAttribute: "debug"},
+		{jobIDAttribute: "42,43", userAttribute: "alice,bob", partitionAttribute: "gpu,debug"},
+		{jobIDAttribute: "", userAttribute: "", partitionAttribute: ""},
+	}
+	for i, device := range out {
+		for _, m := range device {
+			for name, value := range expected[i] {
+				require.Equal(t, value, m.Attributes[name], "GPU %d %s", i, name)
+			}
+		}
+	}
+
+	// The jobs are forgotten when their processes end
+	lock.Lock()
+	processes = map[string][]uint{}
+	lock.Unlock()
+	jobMapper.Refresh()
+	require.NoError(t, jobMapper.Process(out, c.SysInfo()))
+	require.Equal(t, "43", out[1][0].Attributes[jobIDAttribute])
+}
+
+func TestParseJobEnviron(t *testing.T) {
+	for environ, gpus := range map[string][]string{
+		"SLURM_JOB_GPUS=0,1\nCUDA_VISIBLE_DEVICES=0,1":                {"0", "1"},
+		"SLURM_STEP_GPUS=2\nCUDA_VISIBLE_DEVICES=0":                   {"2"},
+		"CUDA_VISIBLE_DEVICES=0,1":                                    nil,
+		"CUDA_VISIBLE_DEVICES=NoDevFiles":                             nil,
+		"CUDA_VISIBLE_DEVICES=GPU-0000,MIG-1111":                      {"GPU-0000", "MIG-1111"},
+		"SLURM_JOB_ID=42\x00SLURM_JOB_USER=alice\x00SLURM_JOB_GPUS=3": {"3"},
+	} {
+		require.Equal(t, gpus, parseJobEnviron([]byte(environ)).gpus, environ)
+	}
+}
+
+func TestNewJobMapperErrors(t *testing.T) {
+	var sysInfo SystemInfo
+	listProcesses := func() (map[string][]uint, error) { return nil, nil }
+
+	_, _, err := newJobMapper(&Config{SlurmRefreshInterval: 0}, sysInfo, listProcesses)
+	require.Error(t, err)
+
+	_, _, err = newJobMapper(&Config{SlurmJobMappingDir: "/nonexistent", SlurmRefreshInterval: 1000}, sysInfo, listProcesses)
+	require.Error(t, err)
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Default maximum payload of the DogStatsD clients over UDP
+const statsDPayloadSize = 1432
+
+// The separators of both formats aren't allowed in names and tags
+var statsDEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", ",", "_", "#", "_", "=", "_", " ", "_")
+
+func NewStatsDWriter(c *Config) (*StatsDWriter, func(), error) {
+	if c.StatsDFormat != DogStatsDFormat && c.StatsDFormat != InfluxStatsDFormat {
+		return nil, func() {}, fmt.Errorf("Invalid StatsD format '%s', expected '%s' or '%s'", c.StatsDFormat, DogStatsDFormat, InfluxStatsDFormat)
+	}
+
+	conn, err := net.Dial("udp", c.StatsDAddress)
+	if err != nil {
+		return nil, func() {}, err
+	}
+
+	w := &StatsDWriter{
+		Address: c.StatsDAddress,
+		Format:  c.StatsDFormat,
+		conn:    conn,
+	}
+
+	return w, func() { conn.Close() }, nil
+}
+
+// Run sends the samples of every collection received as StatsD gauges
+func (w *StatsDWriter) Run(in chan [][]Metric, stop chan interface{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	logrus.Infof("Sending metrics to StatsD at %s in the '%s' format", w.Address, w.Format)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case m := <-in:
+			if err := writeDatagrams(w.conn, EncodeStatsD(m, w.Format), statsDPayloadSize); err != nil {
+				logrus.Errorf("Failed to send metrics to StatsD: %v", err)
+			}
+		}
+	}
+}
+
+// EncodeStatsD encodes every Prometheus sample of the metrics as a StatsD
+// gauge, whatever the type of the metric. The labels of the metric are tags,
+// appended after the value by DogStatsD ("name:1|g|#tag:value") and after the
+// name by the Influx StatsD format of Telegraf ("name,tag=value:1|g").
+//
+// StatsD reads a gauge starting with a sign as a change of the previous value,
+// negative values are set by resetting the gauge to zero first in the Influx
+// format. DogStatsD gauges don't have this ambiguity.
+func EncodeStatsD(metrics [][]Metric, format StatsDFormat) []string {
+	var lines []string
+	var line strings.Builder
+
+	for _, device := range metrics {
+		for _, m := range device {
+			labels := MetricLabels(m)
+			delete(labels, metricNameLabel)
+
+			name := m.Counter.FieldName
+			if m.Counter.PromType == "info" {
+				name += "_info"
+			}
+
+			MetricSamples(name, m, func(name, labelName, labelValue, value string) {
+				v, err := strconv.ParseFloat(value, 64)
+				if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+					return
+				}
+
+				if labelName != "" {
+					labels[labelName] = labelValue
+					defer delete(labels, labelName)
+				}
+
+				tags := sortedLabels(labels)
+				name = statsDEscaper.Replace(name)
+
+				if format == InfluxStatsDFormat {
+					line.Reset()
+					line.WriteString(name)
+					for _, t := range tags {
+						line.WriteByte(',')
+						line.WriteString(statsDEscaper.Replace(t[0]))
+						line.WriteByte('=')
+						line.WriteString(statsDEscaper.Replace(t[1]))
+					}
+					prefix := line.String()
+
+					if v < 0 {
+						lines = append(lines, prefix+":0|g")
+					}
+					lines = append(lines, prefix+":"+formatFloat(v)+"|g")
+					return
+				}
+
+				line.Reset()
+				line.WriteString(name)
+				line.WriteByte(':')
+				line.WriteString(formatFloat(v))
+				line.WriteString("|g")
+				for i, t := range tags {
+					if i == 0 {
+						line.WriteString("|#")
+					} else {
+						line.WriteByte(',')
+					}
+					line.WriteString(statsDEscaper.Replace(t[0]))
+					line.WriteByte(':')
+					line.WriteString(statsDEscaper.Replace(t[1]))
+				}
+
+				lines = append(lines, line.String())
+			})
+		}
+	}
+
+	return lines
+}
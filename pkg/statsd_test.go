@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeStatsD(t *testing.T) {
+	metrics := sampleMetrics()
+	metrics[0][0].Attributes["pod"] = "pod|1"
+	metrics[0][1].Value = "-1.5"
+
+	require.Equal(t, []string{
+		"DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION:1000|g|#UUID:GPU-0000,device:nvidia0,gpu:0,modelName:Tesla_T4,pod:pod_1",
+		"DCGM_FI_DEV_POWER_USAGE_watts:-1.5|g|#UUID:GPU-0000,device:nvidia0,gpu:0,modelName:Tesla_T4",
+		"DCGM_FI_DRIVER_VERSION_info:1|g|#UUID:GPU-0000,device:nvidia0,gpu:0,modelName:Tesla_T4,value:460.32",
+	}, EncodeStatsD(metrics, DogStatsDFormat))
+
+	require.Equal(t, []string{
+		"DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION,UUID=GPU-0000,device=nvidia0,gpu=0,modelName=Tesla_T4,pod=pod_1:1000|g",
+		"DCGM_FI_DEV_POWER_USAGE_watts,UUID=GPU-0000,device=nvidia0,gpu=0,modelName=Tesla_T4:0|g",
+		"DCGM_FI_DEV_POWER_USAGE_watts,UUID=GPU-0000,device=nvidia0,gpu=0,modelName=Tesla_T4:-1.5|g",
+		"DCGM_FI_DRIVER_VERSION_info,UUID=GPU-0000,device=nvidia0,gpu=0,modelName=Tesla_T4,value=460.32:1|g",
+	}, EncodeStatsD(metrics, InfluxStatsDFormat))
+}
+
+func TestStatsDWriter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	w, cleanup, err := NewStatsDWriter(&Config{StatsDAddress: conn.LocalAddr().String(), StatsDFormat: DogStatsDFormat})
+	defer cleanup()
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	in := make(chan [][]Metric)
+	stop := make(chan interface{})
+
+	wg.Add(1)
+	go w.Run(in, stop, &wg)
+	defer wg.Wait()
+	defer close(stop)
+
+	in <- sampleMetrics()
+
+	buf := make([]byte, 2048)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+
+	lines := strings.Split(string(buf[:n]), "\n")
+	require.Len(t, lines, 3)
+	require.True(t, strings.HasPrefix(lines[0], "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION:1000|g|#"))
+}
+
+func TestNewStatsDWriterErrors(t *testing.T) {
+	_, _, err := NewStatsDWriter(&Config{StatsDAddress: "localhost:8125", StatsDFormat: "graphite"})
+	require.Error(t, err)
+}
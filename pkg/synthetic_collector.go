@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
+)
+
+const syntheticModelName = "Synthetic GPU"
+
+// The synthetic collector doesn't need libdcgm or a GPU, it generates
+// deterministic values so that the pipeline can be tested and demoed in CI.
+func NewSyntheticCollector(c []Counter, config *Config) (*SyntheticCollector, func(), error) {
+	sysInfo, err := NewSyntheticSystemInfo(config.SyntheticGPUs, config.Devices)
+	if err != nil {
+		return nil, func() {}, err
+	}
+
+	hostname, err := GetHostname(config)
+	if err != nil {
+		return nil, func() {}, err
+	}
+
+	collector := &SyntheticCollector{
+		Counters:        c,
+		UseOldNamespace: config.UseOldNamespace,
+		SystemInfo:      sysInfo,
+		Hostname:        hostname,
+		Distributions:   NewDistributions(),
+	}
+
+	return collector, func() {}, nil
+}
+
+func NewSyntheticSystemInfo(gpuCount int, dOpt DeviceOptions) (SystemInfo, error) {
+	sysInfo := SystemInfo{}
+	if gpuCount < 1 || uint(gpuCount) > dcgm.MAX_NUM_DEVICES {
+		return sysInfo, fmt.Errorf("Invalid synthetic GPU count %d, expected a value between 1 and %d", gpuCount, dcgm.MAX_NUM_DEVICES)
+	}
+
+	sysInfo.GpuCount = uint(gpuCount)
+	for i := uint(0); i < sysInfo.GpuCount; i++ {
+		sysInfo.Gpus[i].DeviceInfo.GPU = i
+		sysInfo.Gpus[i].DeviceInfo.UUID = fmt.Sprintf("GPU-00000000-0000-0000-0000-%012d", i)
+		sysInfo.Gpus[i].DeviceInfo.Identifiers.Model = syntheticModelName
+	}
+
+	sysInfo.dOpt = dOpt
+	if err := VerifyDevicePresence(&sysInfo, dOpt); err != nil {
+		return sysInfo, err
+	}
+
+	return sysInfo, nil
+}
+
+func (c *SyntheticCollector) SysInfo() SystemInfo {
+	return c.SystemInfo
+}
+
+// UpdateCounters replaces the counters, the histograms and summaries start over
+func (c *SyntheticCollector) UpdateCounters(counters []Counter) error {
+	if reflect.DeepEqual(counters, c.Counters) {
+		return nil
+	}
+
+	c.Counters = counters
+	c.Distributions = NewDistributions()
+
+	return nil
+}
+
+func (c *SyntheticCollector) GetMetrics() ([][]Metric, error) {
+	tick := atomic.AddInt64(&c.tick, 1)
+	monitoringInfo := GetMonitoredEntities(c.SystemInfo)
+
+	metrics := make([][]Metric, len(monitoringInfo))
+	for i, mi := range monitoringInfo {
+		for j := range c.Counters {
+			v := SyntheticValue(c.Counters[j], mi.Entity.EntityId, tick)
+			m := NewMetric(&c.Counters[j], v, mi.DeviceInfo, mi.InstanceInfo, c.UseOldNamespace, c.Hostname)
+
+			// A single sample is aggregated at every collection
+			if isDistribution(m.Counter) {
+				f, _ := strconv.ParseFloat(v, 64)
+				c.Distributions.Observe(mi.Entity, m.Counter, f)
+				m.Distribution = c.Distributions.Collect(mi.Entity, m.Counter)
+			}
+
+			metrics[i] = append(metrics[i], m)
+		}
+	}
+
+	return metrics, nil
+}
+
+// SyntheticValue is a pure function of the counter, the entity and the
+// collection count: counters increase at every collection, gauges cycle
+// between 0 and 99.
+func SyntheticValue(c Counter, entityId uint, tick int64) string {
+	switch c.PromType {
+	case "counter":
+		return fmt.Sprintf("%d", int64(c.FieldID)*1000+int64(entityId)*100+tick*int64(c.FieldID+1))
+	case "info":
+		return fmt.Sprintf("synthetic-%d", entityId)
+	default:
+		return fmt.Sprintf("%d", (int64(c.FieldID)+int64(entityId)*13+tick)%100)
+	}
+}
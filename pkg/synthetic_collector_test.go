@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testSyntheticCollector(t *testing.T, counters []Counter, gpus int) (*SyntheticCollector, func()) {
+	cfg := Config{
+		CollectorBackend: SyntheticBackend,
+		SyntheticGPUs:    gpus,
+		Devices:          DeviceOptions{true, []int{-1}, []int{-1}},
+		NoHostname:       true,
+	}
+	c, cleanup, err := NewSyntheticCollector(counters, &cfg)
+	require.NoError(t, err)
+
+	return c, cleanup
+}
+
+func TestSyntheticCollector(t *testing.T) {
+	c, cleanup := testSyntheticCollector(t, sampleCounters, 2)
+	defer cleanup()
+
+	out, err := c.GetMetrics()
+	require.NoError(t, err)
+	require.Len(t, out, 2)
+
+	for i, dev := range out {
+		require.Len(t, dev, len(sampleCounters))
+		for j, metric := range dev {
+			require.Equal(t, sampleCounters[j].FieldName, metric.Counter.FieldName)
+			require.Equal(t, fmt.Sprintf("%d", i), metric.GPU)
+			require.Equal(t, syntheticModelName, metric.GPUModelName)
+			require.Equal(t, SyntheticValue(sampleCounters[j], uint(i), 1), metric.Value)
+		}
+	}
+
+	// A second collector generates the same sequence of values
+	other, cleanup := testSyntheticCollector(t, sampleCounters, 2)
+	defer cleanup()
+
+	again, err := other.GetMetrics()
+	require.NoError(t, err)
+	require.Equal(t, out, again)
+}
+
+func TestSyntheticCollectorInvalidGPUCount(t *testing.T) {
+	_, _, err := NewSyntheticCollector(sampleCounters, &Config{SyntheticGPUs: 0, Devices: DeviceOptions{Flex: true}})
+	require.Error(t, err)
+
+	_, _, err = NewSyntheticCollector(sampleCounters, &Config{SyntheticGPUs: 1, Devices: DeviceOptions{GpuRange: []int{3}}})
+	require.Error(t, err)
+}
+
+func TestSyntheticCollectorUpdateCounters(t *testing.T) {
+	c, cleanup := testSyntheticCollector(t, sampleCounters, 1)
+	defer cleanup()
+
+	require.NoError(t, c.UpdateCounters(sampleCounters[:1]))
+
+	out, err := c.GetMetrics()
+	require.NoError(t, err)
+	require.Len(t, out[0], 1)
+	require.Equal(t, sampleCounters[0].FieldName, out[0][0].Counter.FieldName)
+}
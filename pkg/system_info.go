@@ -19,7 +19,9 @@ package main
 import (
 	"fmt"
 	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
+	"github.com/sirupsen/logrus"
 	"math/rand"
+	"strings"
 )
 
 type ComputeInstanceInfo struct {
@@ -33,6 +35,7 @@ type GpuInstanceInfo struct {
 	ProfileName      string
 	EntityId         uint
 	ComputeInstances []ComputeInstanceInfo
+	UUID             string // MIG-<uuid> of the MIG device, empty if DCGM doesn't report it
 }
 
 type GpuInfo struct {
@@ -102,6 +105,73 @@ func PopulateMigProfileNames(sysInfo *SystemInfo, entities []dcgm.GroupEntityPai
 	return SetMigProfileNames(sysInfo, values)
 }
 
+func SetGpuInstanceUUID(sysInfo *SystemInfo, entityId uint, uuid string) bool {
+	for i := uint(0); i < sysInfo.GpuCount; i++ {
+		for j := range sysInfo.Gpus[i].GpuInstances {
+			if sysInfo.Gpus[i].GpuInstances[j].EntityId == entityId {
+				sysInfo.Gpus[i].GpuInstances[j].UUID = uuid
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func SetMigUUIDs(sysInfo *SystemInfo, values []dcgm.FieldValue_v2) error {
+	notFound := false
+	err := fmt.Errorf("Cannot find match for entities:")
+	for _, v := range values {
+		// The older drivers don't have UUIDs for the MIG devices
+		uuid := dcgm.Fv2_String(v)
+		if !strings.HasPrefix(uuid, MIG_UUID_PREFIX) {
+			continue
+		}
+
+		found := SetGpuInstanceUUID(sysInfo, v.EntityId, uuid)
+		if found == false {
+			err = fmt.Errorf("%s group %d, id %d", err, v.EntityGroupId, v.EntityId)
+			notFound = true
+		}
+	}
+
+	if notFound {
+		return err
+	}
+
+	return nil
+}
+
+// PopulateMigUUIDs gets the UUIDs of the MIG devices, the kubelet identifies
+// them with these UUIDs with the recent device plugins.
+func PopulateMigUUIDs(sysInfo *SystemInfo, entities []dcgm.GroupEntityPair) error {
+	if len(entities) == 0 {
+		return nil
+	}
+
+	fields := []dcgm.Short{dcgm.DCGM_FI_DEV_UUID}
+	values, err := dcgm.EntitiesGetLatestValues(entities, fields, dcgm.DCGM_FV_FLAG_LIVE_DATA)
+	if err != nil {
+		return err
+	}
+
+	return SetMigUUIDs(sysInfo, values)
+}
+
+// GetGpuInstanceByMigUUID returns the GPU and the GPU instance of a MIG
+// device, nil if it isn't known
+func GetGpuInstanceByMigUUID(sysInfo SystemInfo, uuid string) (*GpuInfo, *GpuInstanceInfo) {
+	for i := uint(0); i < sysInfo.GpuCount; i++ {
+		for j := range sysInfo.Gpus[i].GpuInstances {
+			if sysInfo.Gpus[i].GpuInstances[j].UUID == uuid {
+				return &sysInfo.Gpus[i], &sysInfo.Gpus[i].GpuInstances[j]
+			}
+		}
+	}
+
+	return nil, nil
+}
+
 func GpuIdExists(sysInfo *SystemInfo, gpuId int) bool {
 	for i := uint(0); i < sysInfo.GpuCount; i++ {
 		if sysInfo.Gpus[i].DeviceInfo.GPU == uint(gpuId) {
@@ -206,6 +276,11 @@ func InitializeSystemInfo(dOpt DeviceOptions, useFakeGpus bool) (SystemInfo, err
 		if err != nil {
 			return sysInfo, err
 		}
+
+		// Only needed to map the MIG devices identified by their UUID to the pods
+		if err = PopulateMigUUIDs(&sysInfo, entities); err != nil {
+			logrus.Warningf("Failed to get the UUIDs of the MIG devices, they can't be mapped to the pods with the '%s<uuid>' device IDs: %v", MIG_UUID_PREFIX, err)
+		}
 	}
 
 	sysInfo.dOpt = dOpt
@@ -17,21 +17,29 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
+	"regexp"
 	"sync"
-	"text/template"
+	"time"
 
 	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/dcgm"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+	"k8s.io/client-go/tools/cache"
 )
 
 var (
 	SkipDCGMValue   = "SKIPPING DCGM VALUE"
 	FailedToConvert = "ERROR - FAILED TO CONVERT TO STRING"
 
-	nvidiaResourceName      = "nvidia.com/gpu"
-	nvidiaMigResourcePrefix = "nvidia.com/mig-"
-	MIG_UUID_PREFIX         = "MIG-"
+	nvidiaResourceName       = "nvidia.com/gpu"
+	nvidiaMigResourcePattern = "nvidia.com/mig-*"
+	GPU_UUID_PREFIX          = "GPU-"
+	MIG_UUID_PREFIX          = "MIG-"
 
 	// Note standard resource attributes
 	podAttribute       = "pod"
@@ -41,6 +49,8 @@ var (
 	oldPodAttribute       = "pod_name"
 	oldNamespaceAttribute = "pod_namespace"
 	oldContainerAttribute = "container_name"
+
+	sharedAttribute = "shared"
 )
 
 type KubernetesGPUIDType string
@@ -62,19 +72,124 @@ type DeviceOptions struct {
 	GpuInstanceRange []int // The indices of each GPU instance to monitor, or -1 to monitor all
 }
 
+type CollectorBackend string
+
+const (
+	DCGMBackend      CollectorBackend = "dcgm"
+	SyntheticBackend CollectorBackend = "synthetic"
+)
+
+type CollectMode string
+
+const (
+	IntervalCollectMode CollectMode = "interval" // Collect every CollectInterval
+	ScrapeCollectMode   CollectMode = "scrape"   // Collect when the metrics are requested
+)
+
+// How the device plugin identifies the devices of a resource to the kubelet
+type GPUResourceIDType string
+
+const (
+	GPUUUIDResourceID    GPUResourceIDType = "gpu-uuid"    // The UUIDs of the GPUs, or of the MIG devices with the single MIG strategy
+	MIGUUIDResourceID    GPUResourceIDType = "mig-uuid"    // The UUIDs of the MIG devices
+	DeviceNameResourceID GPUResourceIDType = "device-name" // The names of the GPUs, e.g: "nvidia0"
+)
+
+// A GPUResource matches the resources of a device plugin, the first resource
+// matching the name of a resource is used.
+type GPUResource struct {
+	Pattern string // Shell pattern of the names, e.g: "nvidia.com/mig-*"
+	IDType  GPUResourceIDType
+}
+
+// How the metrics of the GPUs assigned to several pods are attributed
+type SharedGPUMode string
+
+const (
+	JoinSharedGPUMode   SharedGPUMode = "join"   // One series, the pods are joined in the labels
+	SeriesSharedGPUMode SharedGPUMode = "series" // One series per pod, with a "shared" label
+)
+
+type OTLPProtocol string
+
+const (
+	OTLPGRPCProtocol OTLPProtocol = "grpc"
+	OTLPHTTPProtocol OTLPProtocol = "http" // Binary protobuf over HTTP
+)
+
+type StatsDFormat string
+
+const (
+	DogStatsDFormat    StatsDFormat = "dogstatsd"
+	InfluxStatsDFormat StatsDFormat = "influx" // Tags in the name, as parsed by Telegraf
+)
+
 type Config struct {
-	CollectorsFile      string
-	Address             string
-	CollectInterval     int
-	Kubernetes          bool
-	KubernetesGPUIdType KubernetesGPUIDType
-	CollectDCP          bool
-	UseOldNamespace     bool
-	UseRemoteHE         bool
-	RemoteHEInfo        string
-	Devices             DeviceOptions
-	NoHostname          bool
-	UseFakeGpus         bool
+	ConfigFile                string
+	CollectorBackend          CollectorBackend
+	SyntheticGPUs             int
+	CollectorsFile            string
+	Address                   string
+	CollectInterval           int
+	CollectMode               CollectMode
+	ScrapeMinInterval         int
+	Kubernetes                bool
+	KubernetesGPUIdType       KubernetesGPUIDType
+	KubernetesRefreshInterval int
+	KubernetesNodeName        string
+	KubernetesPodLabels       []string
+	KubernetesPodAnnotations  []string
+	KubernetesPodOwners       bool
+	KubernetesNodeLabels      []string
+	KubernetesSharedGPUs      SharedGPUMode
+	KubernetesGPUResources    []GPUResource
+	Slurm                     bool
+	SlurmJobMappingDir        string
+	SlurmRefreshInterval      int
+	Containers                bool
+	ContainerRuntimeSocket    string
+	ContainerLabels           []string
+	ContainerRefreshInterval  int
+	CollectDCP                bool
+	UseOldNamespace           bool
+	UseRemoteHE               bool
+	RemoteHEInfo              string
+	Devices                   DeviceOptions
+	NoHostname                bool
+	UseFakeGpus               bool
+	RelabelConfigFile         string
+	RateConfigFile            string
+
+	NoHTTPServer               bool
+	RemoteWriteURL             string
+	RemoteWriteBearerTokenFile string
+	RemoteWriteUsername        string
+	RemoteWritePasswordFile    string
+	RemoteWriteQueueSize       int
+
+	OTLPEndpoint string
+	OTLPProtocol OTLPProtocol
+	OTLPInsecure bool
+
+	InfluxDBURL       string
+	InfluxDBTokenFile string
+	StatsDAddress     string
+	StatsDFormat      StatsDFormat
+
+	WebConfigFile        string
+	EnableCountersReload bool // The reload endpoint isn't served otherwise
+}
+
+// A Collector is a backend that produces the raw metrics of each monitored
+// entity, the rest of the pipeline is independent of the backend.
+type Collector interface {
+	GetMetrics() ([][]Metric, error)
+	SysInfo() SystemInfo
+
+	// UpdateCounters replaces the collected counters when the counters file is
+	// reloaded, it isn't called concurrently with GetMetrics. The current
+	// counters are kept if it fails.
+	UpdateCounters(counters []Counter) error
 }
 
 type Transform interface {
@@ -83,23 +198,50 @@ type Transform interface {
 }
 
 type MetricsPipeline struct {
+	sync.Mutex // Held by the collections and the reloads of the counters
+
 	config *Config
+	closed bool
 
-	transformations  []Transform
-	metricsFormat    *template.Template
-	migMetricsFormat *template.Template
+	transformations []Transform
 
 	counters     []Counter
-	gpuCollector *DCGMCollector
+	gpuCollector Collector
 }
 
 type DCGMCollector struct {
 	Counters        []Counter
 	DeviceFields    []dcgm.Short
+	FieldGroups     []dcgm.FieldHandle // Watched on the group, replaced when the counters are updated
 	Cleanups        []func()
 	UseOldNamespace bool
-	SysInfo         SystemInfo
+	SystemInfo      SystemInfo
+	Hostname        string
+	CollectInterval time.Duration
+
+	// Every sample of the histogram and summary counters is aggregated
+	Group              dcgm.GroupHandle
+	DistributionFields *dcgm.FieldHandle // nil if there are no histogram or summary counters
+	Distributions      *Distributions
+	since              int64
+}
+
+// The live collectors watching each field. DCGM has a single watch per field
+// and entity, the collectors of the running and rebuilt pipelines share it.
+type FieldWatchRegistry struct {
+	sync.Mutex
+	watchers map[dcgm.Short]int
+	unwatch  func(group dcgm.GroupHandle, fields []dcgm.Short) error
+}
+
+type SyntheticCollector struct {
+	Counters        []Counter
+	UseOldNamespace bool
+	SystemInfo      SystemInfo
 	Hostname        string
+	Distributions   *Distributions
+
+	tick int64
 }
 
 type Counter struct {
@@ -107,6 +249,17 @@ type Counter struct {
 	FieldName string
 	PromType  string
 	Help      string
+	Unit      string
+	Interval  time.Duration // DCGM watch frequency, the default is used if zero
+	Buckets   []float64     // Upper bounds of the buckets of a histogram
+	Quantiles []float64     // Quantiles of a summary
+}
+
+// A FieldWatch is a DCGM field group watched at a given frequency
+type FieldWatch struct {
+	Fields     []dcgm.Short
+	UpdateFreq time.Duration
+	MaxKeepAge time.Duration
 }
 
 type Metric struct {
@@ -125,6 +278,46 @@ type Metric struct {
 	Hostname      string
 
 	Attributes map[string]string
+
+	// Time at which DCGM sampled the value, zero if the collector doesn't know
+	Timestamp time.Time
+
+	// Samples aggregated since the start for histograms and summaries
+	Distribution *Distribution
+}
+
+type Distribution struct {
+	Buckets   []Bucket   // Cumulative counts, the +Inf bucket is implied by Count
+	Quantiles []Quantile // Computed over the samples since the previous collection
+	Sum       float64
+	Count     uint64
+	Start     time.Time // When the aggregation started
+}
+
+type Bucket struct {
+	UpperBound float64
+	Count      uint64
+}
+
+type Quantile struct {
+	Quantile float64
+	Value    float64
+}
+
+// Distributions aggregates the samples of the histogram and summary counters of each entity
+type Distributions struct {
+	states map[distributionKey]*distributionState
+}
+
+type distributionKey struct {
+	entity  dcgm.GroupEntityPair
+	fieldID dcgm.Short
+}
+
+type distributionState struct {
+	Distribution
+
+	window []float64
 }
 
 func (m Metric) getIDOfType(idType KubernetesGPUIDType) (string, error) {
@@ -146,18 +339,387 @@ var promMetricType = map[string]bool{
 	"counter":   true,
 	"histogram": true,
 	"summary":   true,
+	"info":      true,
 }
 
+type MetricsFormat int
+
+const (
+	TextFormat        MetricsFormat = iota // Prometheus text exposition format 0.0.4
+	OpenMetricsFormat                      // OpenMetrics text exposition format 1.0.0
+)
+
 type MetricsServer struct {
 	sync.Mutex
 
 	server      http.Server
-	metrics     string
-	metricsChan chan string
+	listener    net.Listener // Bound by Listen, or when the server starts
+	metrics     [][]Metric
+	metricsChan chan [][]Metric
+	cache       *MetricsCache // Only used in the scrape collect mode
+
+	reloadCounters func() error // Called by the reload API, not found if nil
+
+	health HealthConfig
+	self   *SelfMetrics // The state of the collections checked by the probes
+}
+
+// The thresholds of the health probes
+type HealthConfig struct {
+	CollectMode CollectMode
+	StaleAfter  time.Duration
+	WedgedAfter time.Duration
+}
+
+// The body of /livez and /readyz
+type HealthResponse struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+type HealthCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// The JSON API responses
+type APIMetricsResponse struct {
+	Entities []APIEntity `json:"entities"`
+}
+
+type APIEntity struct {
+	GPU           string            `json:"gpu"`
+	UUID          string            `json:"uuid"`
+	Device        string            `json:"device"`
+	ModelName     string            `json:"modelName"`
+	MigProfile    string            `json:"migProfile,omitempty"`
+	GPUInstanceID string            `json:"gpuInstanceId,omitempty"`
+	Hostname      string            `json:"hostname,omitempty"`
+	Attributes    map[string]string `json:"attributes"`
+	Fields        []APIField        `json:"fields"`
+}
+
+type APIField struct {
+	Name         string           `json:"name"`
+	Type         string           `json:"type"`
+	Unit         string           `json:"unit,omitempty"`
+	Help         string           `json:"help,omitempty"`
+	Value        interface{}      `json:"value"`
+	Timestamp    *time.Time       `json:"timestamp,omitempty"` // DCGM sample time
+	Distribution *APIDistribution `json:"distribution,omitempty"`
+}
+
+type APIDistribution struct {
+	Buckets   []APIBucket   `json:"buckets,omitempty"`
+	Quantiles []APIQuantile `json:"quantiles,omitempty"`
+	Sum       interface{}   `json:"sum"`
+	Count     uint64        `json:"count"`
+}
+
+type APIBucket struct {
+	UpperBound float64 `json:"upperBound"`
+	Count      uint64  `json:"count"`
+}
+
+type APIQuantile struct {
+	Quantile float64     `json:"quantile"`
+	Value    interface{} `json:"value"`
+}
+
+type APIError struct {
+	Error string `json:"error"`
+}
+
+type Exporter struct {
+	sync.Mutex
+
+	config      *Config
+	dcgmCleanup func()
+	components  map[string]*component  // The running components by name
+	settings    map[string]interface{} // The settings of the components when they were built
+
+	collections chan [][]Metric // Sent by the pipeline to every output
+	last        [][]Metric
+	stop        chan interface{}
+	wg          sync.WaitGroup
+}
+
+type exporterComponent struct {
+	name     string
+	settings func(c *Config) interface{}
+	build    func(e *Exporter, c *Config) (*component, error) // Returns nil if the component is disabled
+}
+
+type builtComponent struct {
+	*component // nil if the component is disabled
+	settings   interface{}
+}
+
+// A component runs until it is stopped, it's replaced when it's rebuilt
+type component struct {
+	name    string
+	run     func(stop chan interface{}, wg *sync.WaitGroup)
+	cleanup func()
+	metrics chan [][]Metric            // The collections, nil if the component doesn't consume them
+	collect func() ([][]Metric, error) // Only set for the pipeline in the scrape collect mode
+	reload  func() error               // Only set for the pipeline, reloads the counters file
+
+	stop chan interface{}
+	wg   sync.WaitGroup
+}
+
+type RemoteWriter struct {
+	URL         string
+	Client      *http.Client
+	BearerToken string
+	Username    string
+	Password    string
+
+	queue      *requestQueue
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// In memory queue of the snappy compressed remote write requests
+type requestQueue struct {
+	sync.Mutex
+
+	requests [][]byte
+	capacity int
+	notify   chan struct{}
+}
+
+type recoverableError struct {
+	error
+}
+
+type OTLPExporter struct {
+	Endpoint string
+	Protocol OTLPProtocol
+	Client   *http.Client // Only used by the HTTP protocol
+
+	client colmetricspb.MetricsServiceClient // Only used by the gRPC protocol
+	start  time.Time
+}
+
+type InfluxDBWriter struct {
+	URL    string
+	Client *http.Client // Only used over HTTP
+	Token  string
+
+	conn net.Conn // Only used over UDP
+}
+
+type StatsDWriter struct {
+	Address string
+	Format  StatsDFormat
+
+	conn net.Conn
+}
+
+// The web config file of the HTTP server, see LoadWebConfig
+type WebConfig struct {
+	TLSConfig      *TLSServerConfig  `yaml:"tls_server_config"` // nil to serve plain HTTP
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`  // bcrypt hashed password by user
+	BearerTokens   map[string]string `yaml:"bearer_tokens"`     // bcrypt hashed token by name
+	Routes         []WebRoute        `yaml:"routes"`
+}
+
+type TLSServerConfig struct {
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	ClientAuth string `yaml:"client_auth_type"`
+	ClientCAs  string `yaml:"client_ca_file"`
+	MinVersion string `yaml:"min_version"` // TLS12 by default
+	MaxVersion string `yaml:"max_version"`
+}
+
+type WebAuth string
+
+const (
+	WebAuthAny    WebAuth = "any" // Basic authentication or a bearer token
+	WebAuthBasic  WebAuth = "basic"
+	WebAuthBearer WebAuth = "bearer"
+	WebAuthNone   WebAuth = "none"
+)
+
+type WebRoute struct {
+	Path string  `yaml:"path"` // A prefix of the paths if it ends with '/'
+	Auth WebAuth `yaml:"auth"`
+}
+
+type authHandler struct {
+	sync.Mutex
+
+	config  *WebConfig
+	handler http.Handler
+	cache   map[[sha256.Size]byte]bool
+}
+
+type tlsReloader struct {
+	sync.Mutex
+
+	config  *TLSServerConfig
+	current *tls.Config
+	stamp   string // Modification time and size of the files of the current config
+}
+
+type SelfMetrics struct {
+	sync.Mutex
+
+	durations          map[stageKey]*Distribution
+	errors             map[stageKey]uint64
+	dropped            map[string]uint64 // By output
+	podMappingFailures map[string]uint64 // By reason
+	collections        CollectionTimes
+	now                func() time.Time
+
+	dcgmLock   sync.Mutex // Held by the DCGM calls
+	introspect func() (dcgm.DcgmStatus, error)
+	ping       func() error
+
+	hostengine        *dcgm.DcgmStatus // Last status read, nil if it failed
+	stopIntrospection func()
+}
+
+// The times of the last collections, zero if there was none
+type CollectionTimes struct {
+	Exporter  time.Time // Start of the exporter
+	Started   time.Time
+	Finished  time.Time // Successfully or not
+	Succeeded time.Time
+}
+
+type stageKey struct {
+	stage     string
+	transform string // Only set for the transform stage
+}
+
+type MetricsCache struct {
+	sync.Mutex
+
+	collect     func() ([][]Metric, error)
+	minInterval time.Duration
+	now         func() time.Time
+
+	metrics     [][]Metric
+	collectedAt time.Time
+	inflight    *collectCall
+}
+
+type collectCall struct {
+	done    chan struct{}
+	metrics [][]Metric
+	err     error
 }
 
 type PodMapper struct {
+	sync.Mutex
+
+	Config  *Config
+	socket  string
+	conn    *grpc.ClientConn
+	sysInfo SystemInfo
+
+	metadata *PodMetadata // Nil if the pods and the node aren't looked up from the API server
+
+	refreshLock   sync.Mutex // Held by the refreshes, protects the fields below
+	api           string     // Version of the pod-resources API served by the kubelet
+	noAllocatable bool       // The kubelet doesn't report the allocatable devices
+
+	deviceToPod map[string][]PodInfo // Several pods when the device is shared
+	allocatable map[string]bool      // Nil if the kubelet doesn't report them
+	refreshedAt time.Time
+	failing     bool // The last refresh failed
+	stale       bool
+}
+
+type PodMetadata struct {
 	Config *Config
+	pods   cache.Indexer // Pods of the node, by namespace/name
+	nodes  cache.Indexer // Only the node of the exporter
+
+	podLabels      map[string]string // Names of the attributes, by key
+	podAnnotations map[string]string
+	nodeLabels     map[string]string
+}
+
+type RelabelAction string
+
+const (
+	RelabelReplace   RelabelAction = "replace"
+	RelabelKeep      RelabelAction = "keep"
+	RelabelDrop      RelabelAction = "drop"
+	RelabelHashMod   RelabelAction = "hashmod"
+	RelabelLabelMap  RelabelAction = "labelmap"
+	RelabelLabelDrop RelabelAction = "labeldrop"
+	RelabelLabelKeep RelabelAction = "labelkeep"
+)
+
+type RelabelConfigFile struct {
+	RelabelConfigs []RelabelConfig `yaml:"relabel_configs"`
+}
+
+type RelabelConfig struct {
+	SourceLabels []string      `yaml:"source_labels,flow"`
+	Separator    string        `yaml:"separator"`
+	Regex        string        `yaml:"regex"`
+	Modulus      uint64        `yaml:"modulus"`
+	TargetLabel  string        `yaml:"target_label"`
+	Replacement  string        `yaml:"replacement"`
+	Action       RelabelAction `yaml:"action"`
+
+	regex *regexp.Regexp
+}
+
+type Relabeler struct {
+	Configs []RelabelConfig
+
+	counters map[renamedCounter]*Counter
+}
+
+type renamedCounter struct {
+	counter *Counter
+	name    string
+}
+
+// A RateConfig derives a gauge from the per second increase of a cumulative field
+type RateConfig struct {
+	Source string  `yaml:"source"`
+	Name   string  `yaml:"name"`
+	Help   string  `yaml:"help"`
+	Scale  float64 `yaml:"scale"`
+}
+
+type RateConfigFile struct {
+	Rates []RateConfig `yaml:"rates"`
+}
+
+type RateCalculator struct {
+	Configs []RateConfig
+
+	counters map[string][]rateCounter // Indexed by source field name
+	samples  map[rateKey]rateSample
+}
+
+type rateCounter struct {
+	counter *Counter
+	scale   float64
+}
+
+type rateKey struct {
+	name     string
+	gpu      string
+	instance string
+}
+
+type rateSample struct {
+	value float64
+	ts    time.Time
+
+	rate  float64
+	valid bool
 }
 
 type PodInfo struct {
@@ -165,3 +727,44 @@ type PodInfo struct {
 	Namespace string
 	Container string
 }
+
+type JobMapper struct {
+	sync.Mutex
+
+	Config    *Config
+	sysInfo   SystemInfo
+	processes func() (map[string][]uint, error) // The PIDs of the processes running on each GPU, by GPU UUID
+
+	gpuToJob map[string][]JobInfo // By GPU index or GPU instance identifier, several jobs when the GPU is shared
+}
+
+type JobInfo struct {
+	ID        string
+	User      string
+	Partition string
+}
+
+type ContainerMapper struct {
+	sync.Mutex
+
+	Config    *Config
+	processes func() (map[string][]uint, error) // The PIDs of the processes running on each GPU, by GPU UUID
+	runtime   ContainerRuntime                  // nil without a runtime socket
+	labels    map[string]string                 // The attribute names of the container labels
+
+	containers     map[string]ContainerInfo   // The containers looked up from the runtime, by ID
+	failed         map[string]bool            // The containers the runtime didn't know, by ID
+	gpuToContainer map[string][]ContainerInfo // By GPU UUID, several containers when the GPU is shared
+}
+
+type ContainerInfo struct {
+	ID     string
+	Name   string
+	Image  string
+	Labels map[string]string
+}
+
+// ContainerRuntime looks up the containers from the API of their runtime
+type ContainerRuntime interface {
+	Inspect(id string) (ContainerInfo, error)
+}
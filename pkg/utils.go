@@ -18,6 +18,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"sync"
@@ -44,3 +45,95 @@ func newOSWatcher(sigs ...os.Signal) chan os.Signal {
 
 	return sigChan
 }
+
+// writeDatagrams writes newline separated lines in as few datagrams of at
+// most maxSize bytes as possible, longer lines are written on their own.
+func writeDatagrams(w io.Writer, lines []string, maxSize int) error {
+	var packet []byte
+	for _, l := range lines {
+		if len(packet) > 0 && len(packet)+len(l)+1 > maxSize {
+			if _, err := w.Write(packet); err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, l...)
+	}
+
+	if len(packet) > 0 {
+		if _, err := w.Write(packet); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WatchFile notifies the changes of the content of a file, checked every
+// interval. Polling also detects the atomic symlink swaps of the Kubernetes
+// ConfigMap volumes.
+func WatchFile(filename string, interval time.Duration, stop chan interface{}) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	digest := fileDigest(filename)
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				current := fileDigest(filename)
+				if current == digest {
+					continue
+				}
+				digest = current
+
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return changes
+}
+
+// RefreshEvery calls refresh before returning, the first collections use its
+// result, then every interval in the background until the returned function is
+// called. That function waits for the refresh in progress.
+func RefreshEvery(interval time.Duration, refresh func()) func() {
+	refresh()
+
+	stop := make(chan interface{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				refresh()
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		wg.Wait()
+	}
+}
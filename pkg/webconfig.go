@@ -0,0 +1,350 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// Compared with the password of unknown users, so that they take as long to
+// reject as the known ones
+const dummyPasswordHash = "$2a$10$ls.et2N20aKA/7uGHm5Qy.1.0bQKVgyFryR8DzJbNKEOs.56Kl7YC"
+
+// Number of verified credentials remembered, bcrypt is slow by design
+const authCacheSize = 1024
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+var tlsClientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// LoadWebConfig reads a web config file in the format of the Prometheus
+// exporter-toolkit, extended with bearer tokens and the authentication of each
+// route.
+func LoadWebConfig(filename string) (*WebConfig, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var config WebConfig
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, fmt.Errorf("Failed to parse web config file %s: %v", filename, err)
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid web config file %s: %v", filename, err)
+	}
+
+	return &config, nil
+}
+
+func (c *WebConfig) validate() error {
+	for user, hash := range c.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("The password of user '%s' isn't a bcrypt hash: %v", user, err)
+		}
+	}
+
+	for name, hash := range c.BearerTokens {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("The bearer token '%s' isn't a bcrypt hash: %v", name, err)
+		}
+	}
+
+	for _, r := range c.Routes {
+		if !strings.HasPrefix(r.Path, "/") {
+			return fmt.Errorf("The path of a route must start with '/', got '%s'", r.Path)
+		}
+
+		switch r.Auth {
+		case WebAuthNone:
+		case WebAuthAny:
+			if len(c.BasicAuthUsers) == 0 && len(c.BearerTokens) == 0 {
+				return fmt.Errorf("Route %s requires authentication but no users or bearer tokens are configured", r.Path)
+			}
+		case WebAuthBasic:
+			if len(c.BasicAuthUsers) == 0 {
+				return fmt.Errorf("Route %s requires basic authentication but no users are configured", r.Path)
+			}
+		case WebAuthBearer:
+			if len(c.BearerTokens) == 0 {
+				return fmt.Errorf("Route %s requires a bearer token but no tokens are configured", r.Path)
+			}
+		default:
+			return fmt.Errorf("Invalid authentication '%s' of route %s, expected one of '%s', '%s', '%s' or '%s'",
+				r.Auth, r.Path, WebAuthNone, WebAuthAny, WebAuthBasic, WebAuthBearer)
+		}
+	}
+
+	if c.TLSConfig == nil {
+		return nil
+	}
+
+	t := c.TLSConfig
+	if t.CertFile == "" || t.KeyFile == "" {
+		return fmt.Errorf("Both 'cert_file' and 'key_file' are required to serve TLS")
+	}
+
+	clientAuth, ok := tlsClientAuthTypes[t.ClientAuth]
+	if !ok {
+		return fmt.Errorf("Invalid 'client_auth_type' '%s'", t.ClientAuth)
+	}
+
+	if t.ClientCAs != "" && clientAuth == tls.NoClientCert {
+		return fmt.Errorf("'client_ca_file' is set but 'client_auth_type' doesn't request client certificates")
+	}
+
+	if t.ClientCAs == "" && (clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert) {
+		return fmt.Errorf("'client_auth_type' %s requires a 'client_ca_file'", t.ClientAuth)
+	}
+
+	for _, v := range []string{t.MinVersion, t.MaxVersion} {
+		if _, ok := tlsVersions[v]; v != "" && !ok {
+			return fmt.Errorf("Invalid TLS version '%s', expected TLS10, TLS11, TLS12 or TLS13", v)
+		}
+	}
+
+	return nil
+}
+
+// routeAuth returns the authentication of the longest route matching the
+// path. Routes ending with '/' match the paths they prefix, the others only
+// match themselves. Unlisted paths require any of the configured credentials.
+func (c *WebConfig) routeAuth(path string) WebAuth {
+	auth, matched := WebAuthAny, -1
+	for _, r := range c.Routes {
+		matches := r.Path == path || (strings.HasSuffix(r.Path, "/") && strings.HasPrefix(path, r.Path))
+		if matches && len(r.Path) > matched {
+			auth, matched = r.Auth, len(r.Path)
+		}
+	}
+
+	if auth == WebAuthAny && len(c.BasicAuthUsers) == 0 && len(c.BearerTokens) == 0 {
+		return WebAuthNone
+	}
+
+	return auth
+}
+
+// NewAuthHandler requires the credentials of each route before calling the
+// handler
+func NewAuthHandler(c *WebConfig, handler http.Handler) http.Handler {
+	return &authHandler{
+		config:  c,
+		handler: handler,
+		cache:   make(map[[sha256.Size]byte]bool),
+	}
+}
+
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := h.config.routeAuth(r.URL.Path)
+	if auth == WebAuthNone {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	if user, password, ok := r.BasicAuth(); ok && auth != WebAuthBearer {
+		if h.checkBasicAuth(user, password) {
+			h.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	if token := bearerToken(r); token != "" && auth != WebAuthBasic {
+		if h.checkBearerToken(token) {
+			h.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	if auth == WebAuthBearer {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="dcgm-exporter"`)
+	} else {
+		w.Header().Set("WWW-Authenticate", `Basic realm="dcgm-exporter"`)
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+
+	return header[len(prefix):]
+}
+
+func (h *authHandler) checkBasicAuth(user, password string) bool {
+	hash, ok := h.config.BasicAuthUsers[user]
+	if !ok {
+		h.compare(dummyPasswordHash, password)
+		return false
+	}
+
+	return h.compare(hash, password)
+}
+
+func (h *authHandler) checkBearerToken(token string) bool {
+	valid := false
+	for _, hash := range h.config.BearerTokens {
+		// All the tokens are compared, the time doesn't tell which one matched
+		if h.compare(hash, token) {
+			valid = true
+		}
+	}
+
+	return valid
+}
+
+// compare checks a secret against its bcrypt hash, the results are cached
+func (h *authHandler) compare(hash, secret string) bool {
+	key := sha256.Sum256([]byte(hash + "\x00" + secret))
+
+	h.Lock()
+	valid, ok := h.cache[key]
+	h.Unlock()
+	if ok {
+		return valid
+	}
+
+	valid = bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) == nil
+
+	h.Lock()
+	if len(h.cache) >= authCacheSize {
+		h.cache = make(map[[sha256.Size]byte]bool)
+	}
+	h.cache[key] = valid
+	h.Unlock()
+
+	return valid
+}
+
+// NewTLSConfig returns the TLS configuration of the server. The certificate,
+// the key and the client CAs are read again when the files change, so that
+// they can be rotated without restarting the exporter.
+func NewTLSConfig(c *TLSServerConfig) (*tls.Config, error) {
+	reloader := &tlsReloader{config: c}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return reloader.get(), nil
+		},
+	}, nil
+}
+
+// get returns the current TLS configuration, the files that can't be read
+// anymore are logged and the previous configuration is kept.
+func (r *tlsReloader) get() *tls.Config {
+	if err := r.reload(); err != nil {
+		logrus.Errorf("Failed to reload the TLS certificate, keeping the current one: %v", err)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	return r.current
+}
+
+func (r *tlsReloader) reload() error {
+	files := []string{r.config.CertFile, r.config.KeyFile, r.config.ClientCAs}
+	stamp := make([]string, len(files))
+	for i, f := range files {
+		if f == "" {
+			continue
+		}
+
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		stamp[i] = fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+	}
+
+	r.Lock()
+	unchanged := strings.Join(stamp, ",") == r.stamp
+	r.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load the TLS certificate: %v", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tlsClientAuthTypes[r.config.ClientAuth],
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tlsVersions[r.config.MaxVersion],
+	}
+
+	if r.config.MinVersion != "" {
+		config.MinVersion = tlsVersions[r.config.MinVersion]
+	}
+
+	if r.config.ClientCAs != "" {
+		pem, err := ioutil.ReadFile(r.config.ClientCAs)
+		if err != nil {
+			return err
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificate found in the client CA file %s", r.config.ClientCAs)
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.current != nil {
+		logrus.Infof("Reloaded the TLS certificate %s", r.config.CertFile)
+	}
+	r.current = config
+	r.stamp = strings.Join(stamp, ",")
+
+	return nil
+}
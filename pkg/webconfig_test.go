@@ -0,0 +1,252 @@
+/*
+ * Copyright (c) 2021, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testHash(t *testing.T, secret string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	return string(hash)
+}
+
+func TestLoadWebConfig(t *testing.T) {
+	hash := testHash(t, "secret")
+
+	testCases := []struct {
+		config string
+		valid  bool
+	}{
+		{"basic_auth_users:\n  prometheus: " + hash + "\n", true},
+		{"bearer_tokens:\n  agent: " + hash + "\nroutes:\n- path: /health\n  auth: none\n- path: /api/\n  auth: bearer\n", true},
+		{"tls_server_config:\n  cert_file: tls.crt\n  key_file: tls.key\n  min_version: TLS13\n", true},
+		{"tls_server_config:\n  cert_file: tls.crt\n  key_file: tls.key\n  client_auth_type: RequireAndVerifyClientCert\n  client_ca_file: ca.crt\n", true},
+		{"basic_auth_users:\n  prometheus: secret\n", false},
+		{"routes:\n- path: /metrics\n  auth: basic\n", false},
+		{"basic_auth_users:\n  prometheus: " + hash + "\nroutes:\n- path: /metrics\n  auth: bearer\n", false},
+		{"basic_auth_users:\n  prometheus: " + hash + "\nroutes:\n- path: metrics\n  auth: none\n", false},
+		{"basic_auth_users:\n  prometheus: " + hash + "\nroutes:\n- path: /metrics\n  auth: digest\n", false},
+		{"tls_server_config:\n  cert_file: tls.crt\n", false},
+		{"tls_server_config:\n  cert_file: tls.crt\n  key_file: tls.key\n  client_auth_type: RequireAndVerifyClientCert\n", false},
+		{"tls_server_config:\n  cert_file: tls.crt\n  key_file: tls.key\n  client_ca_file: ca.crt\n", false},
+		{"tls_server_config:\n  cert_file: tls.crt\n  key_file: tls.key\n  min_version: SSL3\n", false},
+		{"tls_config:\n  cert_file: tls.crt\n", false},
+	}
+
+	for _, tc := range testCases {
+		_, err := LoadWebConfig(writeTestFile(t, tc.config))
+		if tc.valid {
+			require.NoError(t, err, tc.config)
+		} else {
+			require.Error(t, err, tc.config)
+		}
+	}
+}
+
+func TestAuthHandler(t *testing.T) {
+	config := &WebConfig{
+		BasicAuthUsers: map[string]string{"prometheus": testHash(t, "secret")},
+		BearerTokens:   map[string]string{"agent": testHash(t, "token")},
+		Routes: []WebRoute{
+			{Path: "/health", Auth: WebAuthNone},
+			{Path: "/metrics", Auth: WebAuthBasic},
+			{Path: "/api/", Auth: WebAuthBearer},
+			{Path: "/api/v1/metrics", Auth: WebAuthAny},
+		},
+	}
+	require.NoError(t, config.validate())
+
+	handler := NewAuthHandler(config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	testCases := []struct {
+		path     string
+		user     string
+		password string
+		token    string
+		status   int
+	}{
+		{"/health", "", "", "", http.StatusOK},
+		{"/metrics", "", "", "", http.StatusUnauthorized},
+		{"/metrics", "prometheus", "secret", "", http.StatusOK},
+		{"/metrics", "prometheus", "wrong", "", http.StatusUnauthorized},
+		{"/metrics", "unknown", "secret", "", http.StatusUnauthorized},
+		{"/metrics", "", "", "token", http.StatusUnauthorized},
+		{"/api/v1/counters/reload", "", "", "token", http.StatusOK},
+		{"/api/v1/counters/reload", "prometheus", "secret", "", http.StatusUnauthorized},
+		{"/api/v1/metrics", "prometheus", "secret", "", http.StatusOK},
+		{"/api/v1/metrics", "", "", "token", http.StatusOK},
+		{"/api/v1/metrics", "", "", "wrong", http.StatusUnauthorized},
+		{"/", "", "", "", http.StatusUnauthorized},
+		{"/", "", "", "token", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest("GET", tc.path, nil)
+		if tc.user != "" {
+			r.SetBasicAuth(tc.user, tc.password)
+		}
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		require.Equal(t, tc.status, w.Code, "%+v", tc)
+		if tc.status == http.StatusUnauthorized {
+			require.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	// Routes are open when there are no credentials
+	open := NewAuthHandler(&WebConfig{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	open.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCert{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (c *testCert) write(t *testing.T, dir string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "tls.crt"), c.pem, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "tls.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestTLSServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcgm-exporter")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	ca := newTestCert(t, "ca", nil)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ca.crt"), ca.pem, 0600))
+	newTestCert(t, "server", ca).write(t, dir)
+
+	webConfig := filepath.Join(dir, "web-config.yml")
+	require.NoError(t, ioutil.WriteFile(webConfig, []byte(fmt.Sprintf(`tls_server_config:
+  cert_file: %s
+  key_file: %s
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: %s
+`, filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt"))), 0600))
+
+	s, cleanup, err := NewMetricsServer(&Config{WebConfigFile: webConfig}, make(chan [][]Metric), nil)
+	require.NoError(t, err)
+	defer cleanup()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.server.ServeTLS(listener, "", "")
+	defer s.server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	get := func(client *testCert) (*http.Response, error) {
+		config := &tls.Config{RootCAs: roots}
+		if client != nil {
+			config.Certificates = []tls.Certificate{client.tlsCertificate()}
+		}
+
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		return c.Get("https://" + listener.Addr().String() + "/health")
+	}
+
+	// A client certificate signed by the CA is required
+	_, err = get(nil)
+	require.Error(t, err)
+
+	client := newTestCert(t, "client", ca)
+	resp, err := get(client)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "server", resp.TLS.PeerCertificates[0].Subject.CommonName)
+
+	// A rotated certificate is served without restarting the server
+	time.Sleep(10 * time.Millisecond)
+	newTestCert(t, "rotated", ca).write(t, dir)
+
+	resp, err = get(client)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "rotated", resp.TLS.PeerCertificates[0].Subject.CommonName)
+}